@@ -24,6 +24,7 @@ type DbBase struct {
 	DBName      string    `xml:"db_name"`
 	IPAddress   string    `xml:"ip_address"`
 	Port        string    `xml:"port"`
+	DBPath      string    `xml:"db_path"`
 	Table_name  TableName `xml:"table_name"`
 }
 
@@ -45,7 +46,7 @@ func ParseDBConfig(config_path string) *DBConfig {
 		if err != nil {
 			log.Fatalf("Error: db_config.go [ParseDBConfig] os.Getwd() error! \n")
 		}
-		config_path = dir + "/../../../db_config.xml"
+		config_path = dir + "/../../../oss_db_config.xml"
 		xmlFile, err = os.Open(config_path)
 		if err != nil {
 			log.Fatalln("Error opening XML file!")
@@ -8,14 +8,27 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"regexp"
+	"strings"
 
 	"github.com/common/definition"
 )
 
 type OssConfig struct {
-	XMLName          xml.Name         `xml:"oss_server_config"`
-	OssHolderConfigs OssHolderConfigs `xml:"oss_holder_config"`
-	OssCommonConfigs OssCommonConfigs `xml:"oss_common_config"`
+	XMLName              xml.Name             `xml:"oss_server_config"`
+	OssHolderConfigs     OssHolderConfigs     `xml:"oss_holder_config"`
+	OssCommonConfigs     OssCommonConfigs     `xml:"oss_common_config"`
+	OssFreshnessConfigs  OssFreshnessConfigs  `xml:"oss_freshness_config"`
+	OssMetaGcConfigs     OssMetaGcConfigs     `xml:"oss_meta_gc_config"`
+	OssCompactionConfigs OssCompactionConfigs `xml:"oss_compaction_config"`
+	OssEvictionConfigs   OssEvictionConfigs   `xml:"oss_eviction_config"`
+	OssAdmissionConfigs  OssAdmissionConfigs  `xml:"oss_admission_config"`
+	OssCacheKeyConfigs   OssCacheKeyConfigs   `xml:"oss_cache_key_config"`
+	OssPinConfigs        OssPinConfigs        `xml:"oss_pin_config"`
+	OssPrefetchConfigs   OssPrefetchConfigs   `xml:"oss_prefetch_config"`
+	OssS3Configs         OssS3Configs         `xml:"oss_s3_config"`
+	OssAliyunConfigs     OssAliyunConfigs     `xml:"oss_aliyun_config"`
+	OssDownloadConfigs   OssDownloadConfigs   `xml:"oss_download_config"`
 }
 
 type OssCommonConfigs struct {
@@ -27,6 +40,91 @@ type OssCommonConfigs struct {
 	LocalMode               bool   `xml:"local_mode"`
 }
 
+type OssFreshnessConfigs struct {
+	HonorCacheControl bool               `xml:"honor_cache_control"`
+	DefaultTtlSec     int64              `xml:"default_ttl_sec"`
+	TtlRules          []OssFreshnessRule `xml:"ttl_rule"`
+}
+
+type OssFreshnessRule struct {
+	Pattern string `xml:"pattern,attr"`
+	TtlSec  int64  `xml:"ttl_sec,attr"`
+}
+
+type OssMetaGcConfigs struct {
+	IntervalSec       int64 `xml:"interval_sec"`
+	PendingTimeoutSec int64 `xml:"pending_timeout_sec"`
+	DryRun            bool  `xml:"dry_run"`
+	RowsPerSec        int64 `xml:"rows_per_sec"`
+}
+
+type OssCompactionConfigs struct {
+	IntervalSec int64   `xml:"interval_sec"`
+	LiveRatio   float64 `xml:"live_ratio"`
+}
+
+type OssEvictionConfigs struct {
+	Policy          string  `xml:"policy"`
+	SaveIntervalSec int64   `xml:"save_interval_sec"`
+	HighWatermark   float64 `xml:"high_watermark"`
+	LowWatermark    float64 `xml:"low_watermark"`
+}
+
+type OssAdmissionConfigs struct {
+	MinHits         int64              `xml:"min_hits"`
+	WindowSec       int64              `xml:"window_sec"`
+	MaxObjectSizeMB int64              `xml:"max_object_size_mb"`
+	Rules           []OssAdmissionRule `xml:"admission_rule"`
+}
+
+type OssAdmissionRule struct {
+	Pattern string `xml:"pattern,attr"`
+	Admit   string `xml:"admit,attr"`
+}
+
+type OssCacheKeyConfigs struct {
+	StripQuery []string          `xml:"strip_query"`
+	FoldHost   bool              `xml:"fold_host"`
+	Rules      []OssCacheKeyRule `xml:"key_rule"`
+}
+
+type OssCacheKeyRule struct {
+	Pattern string `xml:"pattern,attr"`
+	Key     string `xml:"key,attr"`
+}
+
+type OssPinConfigs struct {
+	MaxPinnedSizeMB int64 `xml:"max_pinned_size_mb"`
+}
+
+type OssPrefetchConfigs struct {
+	Workers        int64 `xml:"workers"`
+	YieldDownloads int64 `xml:"yield_downloads"`
+	JobTtlSec      int64 `xml:"job_ttl_sec"`
+}
+
+type OssS3Configs struct {
+	Endpoint        string `xml:"endpoint"`
+	Region          string `xml:"region"`
+	AccessKeyId     string `xml:"access_key_id"`
+	SecretAccessKey string `xml:"secret_access_key"`
+	SessionToken    string `xml:"session_token"`
+	PathStyle       bool   `xml:"path_style"`
+}
+
+type OssAliyunConfigs struct {
+	Endpoint        string `xml:"endpoint"`
+	AccessKeyId     string `xml:"access_key_id"`
+	AccessKeySecret string `xml:"access_key_secret"`
+	SecurityToken   string `xml:"security_token"`
+}
+
+type OssDownloadConfigs struct {
+	PartSizeMB  int64 `xml:"part_size_mb"`
+	Parallel    int64 `xml:"parallel"`
+	PartRetries int64 `xml:"part_retries"`
+}
+
 type OssHolderConfigs struct {
 	ConfigFlag             string      `xml:"oss_sub_sys_name,attr"`
 	OssHolders             []OssHolder `xml:"oss_holder"`
@@ -87,6 +185,131 @@ func (cfg *OssConfig) ParseXMLConfig2Definition() {
 	log.Println("K_triplet_closing_threshold : ", definition.K_triplet_closing_threshold)
 	log.Println("K_triplet_large_threshold : ", definition.K_triplet_large_threshold)
 	log.Println("F_local_mode : ", definition.F_local_mode)
+
+	definition.F_default_ttl_sec = cfg.OssFreshnessConfigs.DefaultTtlSec
+	definition.F_honor_cache_control = cfg.OssFreshnessConfigs.HonorCacheControl
+	definition.F_ttl_rules = nil
+	for _, rule := range cfg.OssFreshnessConfigs.TtlRules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			log.Fatalf("Invalid ttl rule pattern %v: %v\n", rule.Pattern, err)
+		}
+		definition.F_ttl_rules = append(definition.F_ttl_rules,
+			definition.TtlRule{Pattern: re, TtlSec: rule.TtlSec})
+	}
+	log.Println("F_default_ttl_sec : ", definition.F_default_ttl_sec)
+	log.Println("F_honor_cache_control : ", definition.F_honor_cache_control)
+	log.Println("F_ttl_rules : ", len(definition.F_ttl_rules))
+
+	definition.F_meta_gc_interval_sec = cfg.OssMetaGcConfigs.IntervalSec
+	definition.F_meta_gc_pending_timeout_sec = cfg.OssMetaGcConfigs.PendingTimeoutSec
+	definition.F_meta_gc_dry_run = cfg.OssMetaGcConfigs.DryRun
+	definition.F_meta_gc_rows_per_sec = cfg.OssMetaGcConfigs.RowsPerSec
+	log.Println("F_meta_gc_interval_sec : ", definition.F_meta_gc_interval_sec)
+	log.Println("F_meta_gc_pending_timeout_sec : ", definition.F_meta_gc_pending_timeout_sec)
+	log.Println("F_meta_gc_dry_run : ", definition.F_meta_gc_dry_run)
+	log.Println("F_meta_gc_rows_per_sec : ", definition.F_meta_gc_rows_per_sec)
+
+	definition.F_compact_interval_sec = cfg.OssCompactionConfigs.IntervalSec
+	definition.F_compact_live_ratio = cfg.OssCompactionConfigs.LiveRatio
+	log.Println("F_compact_interval_sec : ", definition.F_compact_interval_sec)
+	log.Println("F_compact_live_ratio : ", definition.F_compact_live_ratio)
+
+	definition.F_eviction_policy = cfg.OssEvictionConfigs.Policy
+	definition.F_eviction_save_interval_sec = cfg.OssEvictionConfigs.SaveIntervalSec
+	log.Println("F_eviction_policy : ", definition.F_eviction_policy)
+	log.Println("F_eviction_save_interval_sec : ", definition.F_eviction_save_interval_sec)
+
+	definition.F_eviction_high_watermark = cfg.OssEvictionConfigs.HighWatermark
+	definition.F_eviction_low_watermark = cfg.OssEvictionConfigs.LowWatermark
+	if definition.F_eviction_high_watermark > 1 ||
+		definition.F_eviction_low_watermark > definition.F_eviction_high_watermark {
+		log.Fatalf("Invalid eviction watermarks: high %v, low %v\n",
+			definition.F_eviction_high_watermark, definition.F_eviction_low_watermark)
+	}
+	log.Println("F_eviction_high_watermark : ", definition.F_eviction_high_watermark)
+	log.Println("F_eviction_low_watermark : ", definition.F_eviction_low_watermark)
+
+	definition.F_admission_min_hits = cfg.OssAdmissionConfigs.MinHits
+	definition.F_admission_window_sec = cfg.OssAdmissionConfigs.WindowSec
+	definition.F_admission_max_size = int64(definition.K_MiB) * cfg.OssAdmissionConfigs.MaxObjectSizeMB
+	definition.F_admission_rules = nil
+	for _, rule := range cfg.OssAdmissionConfigs.Rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			log.Fatalf("Invalid admission rule pattern %v: %v\n", rule.Pattern, err)
+		}
+		if rule.Admit != "always" && rule.Admit != "never" {
+			log.Fatalf("Invalid admission rule admit %v, always or never\n", rule.Admit)
+		}
+		definition.F_admission_rules = append(definition.F_admission_rules,
+			definition.AdmissionRule{Pattern: re, Admit: rule.Admit == "always"})
+	}
+	log.Println("F_admission_min_hits : ", definition.F_admission_min_hits)
+	log.Println("F_admission_window_sec : ", definition.F_admission_window_sec)
+	log.Println("F_admission_max_size : ", definition.F_admission_max_size)
+	log.Println("F_admission_rules : ", len(definition.F_admission_rules))
+
+	definition.F_cache_key_strip_query = nil
+	for _, name := range cfg.OssCacheKeyConfigs.StripQuery {
+		if name = strings.TrimSpace(name); name != "" {
+			definition.F_cache_key_strip_query = append(definition.F_cache_key_strip_query, name)
+		}
+	}
+	definition.F_cache_key_fold_host = cfg.OssCacheKeyConfigs.FoldHost
+	definition.F_cache_key_rules = nil
+	for _, rule := range cfg.OssCacheKeyConfigs.Rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			log.Fatalf("Invalid cache key rule pattern %v: %v\n", rule.Pattern, err)
+		}
+		if rule.Key == "" {
+			log.Fatalf("Invalid cache key rule %v, key required\n", rule.Pattern)
+		}
+		definition.F_cache_key_rules = append(definition.F_cache_key_rules,
+			definition.CacheKeyRule{Pattern: re, Key: rule.Key})
+	}
+	log.Println("F_cache_key_strip_query : ", definition.F_cache_key_strip_query)
+	log.Println("F_cache_key_fold_host : ", definition.F_cache_key_fold_host)
+	log.Println("F_cache_key_rules : ", len(definition.F_cache_key_rules))
+
+	definition.F_pin_max_size = int64(definition.K_MiB) * cfg.OssPinConfigs.MaxPinnedSizeMB
+	log.Println("F_pin_max_size : ", definition.F_pin_max_size)
+
+	definition.F_prefetch_workers = cfg.OssPrefetchConfigs.Workers
+	definition.F_prefetch_yield_downloads = cfg.OssPrefetchConfigs.YieldDownloads
+	definition.F_prefetch_job_ttl_sec = cfg.OssPrefetchConfigs.JobTtlSec
+	log.Println("F_prefetch_workers : ", definition.F_prefetch_workers)
+	log.Println("F_prefetch_yield_downloads : ", definition.F_prefetch_yield_downloads)
+	log.Println("F_prefetch_job_ttl_sec : ", definition.F_prefetch_job_ttl_sec)
+
+	definition.F_s3_endpoint = cfg.OssS3Configs.Endpoint
+	definition.F_s3_region = cfg.OssS3Configs.Region
+	definition.F_s3_access_key_id = cfg.OssS3Configs.AccessKeyId
+	definition.F_s3_secret_access_key = cfg.OssS3Configs.SecretAccessKey
+	definition.F_s3_session_token = cfg.OssS3Configs.SessionToken
+	definition.F_s3_path_style = cfg.OssS3Configs.PathStyle
+	log.Println("F_s3_endpoint : ", definition.F_s3_endpoint)
+	log.Println("F_s3_region : ", definition.F_s3_region)
+	log.Println("F_s3_access_key_id : ", definition.F_s3_access_key_id)
+	log.Println("F_s3_path_style : ", definition.F_s3_path_style)
+
+	definition.F_aliyun_endpoint = cfg.OssAliyunConfigs.Endpoint
+	definition.F_aliyun_access_key_id = cfg.OssAliyunConfigs.AccessKeyId
+	definition.F_aliyun_access_key_secret = cfg.OssAliyunConfigs.AccessKeySecret
+	definition.F_aliyun_security_token = cfg.OssAliyunConfigs.SecurityToken
+	log.Println("F_aliyun_endpoint : ", definition.F_aliyun_endpoint)
+	log.Println("F_aliyun_access_key_id : ", definition.F_aliyun_access_key_id)
+
+	definition.F_download_part_size = int64(definition.K_MiB) * cfg.OssDownloadConfigs.PartSizeMB
+	definition.F_download_parallel = cfg.OssDownloadConfigs.Parallel
+	definition.F_download_part_retries = cfg.OssDownloadConfigs.PartRetries
+	if definition.F_download_part_size < 0 {
+		log.Fatalf("Invalid download part size %v\n", definition.F_download_part_size)
+	}
+	log.Println("F_download_part_size : ", definition.F_download_part_size)
+	log.Println("F_download_parallel : ", definition.F_download_parallel)
+	log.Println("F_download_part_retries : ", definition.F_download_part_retries)
 }
 
 func (cfg *OssConfig) ParseOssHolderConfigAddress(_shardID int) string {
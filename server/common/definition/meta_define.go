@@ -28,6 +28,11 @@ type FileMeta struct {
 
 	// Etag of OSS object
 	Etag string
+	// Unix seconds of the last time Etag was validated against OSS.
+	ValidatedAt int64
+	// Freshness lifetime in seconds told by OSS Cache-Control: max-age,
+	// -1 if absent.
+	MaxAge int64
 }
 
 // Token can be used to access blob in triplet, or blob in cloud
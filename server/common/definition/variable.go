@@ -3,6 +3,8 @@
 // ///////////////////////////////////////////////
 package definition
 
+import "regexp"
+
 // variable definition
 
 // ///////////////////////////////////////////////////////
@@ -10,6 +12,15 @@ package definition
 var DataPosition string
 var BlobLocalPathPrefix string
 
+// Directory of the triplet files and the other local state of the cache,
+// BlobLocalPathPrefix or the default persistence path.
+func BlobDir() string {
+	if BlobLocalPathPrefix == "" {
+		return F_cache_persistence_path
+	}
+	return BlobLocalPathPrefix
+}
+
 // holder end
 ////////////////////////////////////////
 
@@ -39,5 +50,110 @@ var K_triplet_large_threshold int64
 // Local Mode for test
 var F_local_mode bool
 
+// Freshness of cached objects. A cache hit validated less than ttl seconds
+// ago is served without asking OSS. Ttl is taken from the first rule whose
+// pattern matches the url, then from OSS Cache-Control: max-age if honored,
+// and falls back to the default.
+var F_default_ttl_sec int64
+var F_honor_cache_control bool
+var F_ttl_rules []TtlRule
+
+type TtlRule struct {
+	Pattern *regexp.Regexp
+	TtlSec  int64
+}
+
+// Metadata GC reconciles DB rows with triplets on disk every interval
+// seconds, 0 disables it. Pending rows untouched for pending timeout
+// seconds are considered as died downloads. In dry run mode, GC only
+// reports what it would delete. Rows scanned per second are limited by
+// rows per sec, 0 means unlimited.
+var F_meta_gc_interval_sec int64
+var F_meta_gc_pending_timeout_sec int64
+var F_meta_gc_dry_run bool
+var F_meta_gc_rows_per_sec int64
+
+// Every interval seconds, closed triplets whose ratio of live bytes is
+// below live ratio get compacted, 0 disables compaction.
+var F_compact_interval_sec int64
+var F_compact_live_ratio float64
+
+// Eviction policy of cached objects: lru, lfu, arc or gdsf. Its state is
+// saved every save interval seconds and on shutdown, 0 only saves it on
+// shutdown.
+var F_eviction_policy string
+var F_eviction_save_interval_sec int64
+
+// Once the cache uses more than high watermark of its max size, objects
+// are evicted in background down to low watermark. Both are ratios of the
+// max size, 0 disables watermark eviction.
+var F_eviction_high_watermark float64
+var F_eviction_low_watermark float64
+
+// Admission of missed objects into the cache. The first rule whose pattern
+// matches the url decides. Otherwise an object is admitted on its min hits
+// th miss within window seconds, and only if it's not larger than max
+// size bytes, 0 for no limit. Objects not admitted are served straight
+// from origin.
+var F_admission_min_hits int64
+var F_admission_window_sec int64
+var F_admission_max_size int64
+var F_admission_rules []AdmissionRule
+
+type AdmissionRule struct {
+	Pattern *regexp.Regexp
+	Admit   bool
+}
+
+// Objects are cached under a key derived from their url. The first rule
+// whose pattern matches the url gives the key by expanding its template
+// with the submatches of the pattern. Otherwise the query parameters named
+// in strip query are dropped, case insensitively and names ending with * as
+// prefix, and the host is lower cased with fold host.
+var F_cache_key_strip_query []string
+var F_cache_key_fold_host bool
+var F_cache_key_rules []CacheKeyRule
+
+type CacheKeyRule struct {
+	Pattern *regexp.Regexp
+	Key     string
+}
+
+// Pinned objects are never evicted. Their bytes, up to max size, aren't
+// counted against F_CACHE_MAX_SIZE, the disk needs room for both.
+var F_pin_max_size int64
+
+// Prefetch jobs are run by workers, which don't start a url while yield
+// downloads or more triggered by reads are running, 0 never yields.
+// Finished jobs are kept job ttl seconds.
+var F_prefetch_workers int64
+var F_prefetch_yield_downloads int64
+var F_prefetch_job_ttl_sec int64
+
+// S3 compatible store serving s3://bucket/key urls, requests are signed
+// with the access key, anonymous without. Buckets are addressed in the
+// path of the endpoint with path style, else as its subdomain.
+var F_s3_endpoint string
+var F_s3_region string
+var F_s3_access_key_id string
+var F_s3_secret_access_key string
+var F_s3_session_token string
+var F_s3_path_style bool
+
+// Aliyun OSS serving oss://bucket/object urls, with an AccessKey, or STS
+// credentials if security token is set.
+var F_aliyun_endpoint string
+var F_aliyun_access_key_id string
+var F_aliyun_access_key_secret string
+var F_aliyun_security_token string
+
+// Objects larger than part size are downloaded as parallel concurrent
+// ranged reads of part size bytes, if origin honors ranges. A failed part
+// is retried part retries times from where it stopped. Parts spooled are
+// checkpointed, a restart resumes the download.
+var F_download_part_size int64
+var F_download_parallel int64
+var F_download_part_retries int64
+
 // common end
 ////////////////////////////////////////
@@ -17,8 +17,8 @@ import (
 // Maybe we can use bloom filter.
 // TODO: implement a Range hash instead of simple range struct..
 type RangeCode struct {
-	Start int32
-	End   int32
+	Start int64
+	End   int64
 	Token string
 }
 
@@ -44,17 +44,17 @@ func ToRangeCode(jsStr string) RangeCode {
 
 // TODO: Currently using offset of ranger. Need to verify the idx order in DB
 func (rc RangeCode) ToDbEntry() string {
-	numOfZeros := 9 - countDigits(int(rc.Start))
+	numOfZeros := 9 - countDigits(rc.Start)
 	leadingZeros := ""
 	for i := 0; i < numOfZeros; i++ {
 		leadingZeros += "0"
 	}
-	rg := leadingZeros + strconv.Itoa(int(rc.Start))
+	rg := leadingZeros + strconv.FormatInt(rc.Start, 10)
 	hash := fmt.Sprintf("rg(%s)_tk(%s)", rg, rc.Token)
 	return hash
 }
 
-func countDigits(num int) int {
+func countDigits(num int64) int {
 	if num == 0 {
 		return 1
 	}
@@ -0,0 +1,53 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+package util
+
+import "sync"
+
+// SingleFlight collapses concurrent calls sharing a same key into 1
+// execution. Callers arriving while the execution is in flight wait for
+// it and all get its result. Zero value is ready to use.
+type SingleFlight struct {
+	mtx   sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+	// Number of callers joined the execution.
+	dups int
+}
+
+// Execute fn once for all concurrent callers of key. The returned bool
+// tells if the result is shared with other callers.
+func (sf *SingleFlight) Do(
+	key string, fn func() (interface{}, error)) (val interface{}, err error, shared bool) {
+	sf.mtx.Lock()
+	if sf.calls == nil {
+		sf.calls = make(map[string]*flightCall)
+	}
+	if call, exist := sf.calls[key]; exist {
+		call.dups++
+		sf.mtx.Unlock()
+		call.wg.Wait()
+		return call.val, call.err, true
+	}
+	call := new(flightCall)
+	call.wg.Add(1)
+	sf.calls[key] = call
+	sf.mtx.Unlock()
+
+	// Release waiters even if fn panics.
+	defer func() {
+		sf.mtx.Lock()
+		delete(sf.calls, key)
+		shared = call.dups > 0
+		sf.mtx.Unlock()
+		call.wg.Done()
+	}()
+	call.val, call.err = fn()
+	return call.val, call.err, false
+}
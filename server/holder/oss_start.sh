@@ -29,6 +29,7 @@ rm $bin
 if [ ! -f "$bin" ]; then
     echo "./$bin not exist"
     go build -o bin src/$main.go
+    go build -o bin/riverpass-fsck ./src/riverpass_fsck
 else
     echo "./$bin exist"
 fi
@@ -5,9 +5,13 @@
 package blob_handler
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"strings"
 	"sync"
@@ -52,29 +56,25 @@ type BinHeader struct {
 // }
 
 // shardId is the holder instance id.
-func (bh *BinHeader) New(shardId int, triId string) int64 {
+func (bh *BinHeader) New(shardId int, triId string) (int64, error) {
 	bh.RWLock = new(sync.RWMutex)
 
 	bh.ShardId = shardId
 	bh.TripletId = triId
-	localfsPrefix := definition.BlobLocalPathPrefix
-	if localfsPrefix == "" {
-		localfsPrefix = "/var/lib/docker/.cache"
-	}
-	bh.LocalName =
-		fmt.Sprintf("%s/binary_%d_%s.dat", localfsPrefix, shardId, triId)
+	bh.LocalName = fmt.Sprintf("%s/binary_%d_%s.dat", BlobDir(), shardId, triId)
 	info, err := os.Stat(bh.LocalName)
 	if os.IsNotExist(err) {
 		bh.CurOff = 0
-		return 0
+		return 0, nil
 	} else if err != nil {
-		ZapLogger.Fatal("os.Stat", zap.Any("file", bh.LocalName), zap.Any("err", err))
+		ZapLogger.Error("os.Stat", zap.Any("file", bh.LocalName), zap.Any("err", err))
+		return 0, ioError("stat", bh.LocalName, err)
 	}
 	bh.CurOff = info.Size()
-	return info.Size()
+	return info.Size(), nil
 }
 
-func (bh *BinHeader) Put(blobId string, binary []byte) (int64, int64) {
+func (bh *BinHeader) Put(blobId string, binary []byte) (int64, int64, error) {
 	bh.RWLock.Lock()
 	defer bh.RWLock.Unlock()
 	var encoded []byte
@@ -83,65 +83,141 @@ func (bh *BinHeader) Put(blobId string, binary []byte) (int64, int64) {
 	} else {
 		encoded = Encode(blobId, binary)
 	}
-	offset, sizeWritten := bh.flush(&encoded)
+	offset, sizeWritten, err := bh.flush(&encoded)
+	if err != nil {
+		return 0, 0, err
+	}
 	bh.CurOff += sizeWritten
 	ZapLogger.Info("Put blob succeeded", zap.Any("blobId", blobId),
 		zap.Any("offset", offset), zap.Any("sizeWritten", sizeWritten))
-	return offset, sizeWritten
+	return offset, sizeWritten, nil
+}
+
+// Streaming version of Put, size bytes are consumed from r and encoded on
+// the fly, so the blob is never held in memory as a whole. If r fails
+// before size bytes are read, the torn record is truncated from the file.
+// Returns the offset and size of the record, and the checksum of content.
+func (bh *BinHeader) PutStream(blobId string, r io.Reader, size int64) (int64, int64, string, error) {
+	bh.RWLock.Lock()
+	defer bh.RWLock.Unlock()
+	f, err := os.OpenFile(bh.LocalName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0755)
+	if err != nil {
+		ZapLogger.Error("os.OpenFile", zap.Any("file", bh.LocalName), zap.Any("err", err))
+		return 0, 0, "", ioError("open", bh.LocalName, err)
+	}
+	defer f.Close()
+	w := bufio.NewWriterSize(f, definition.K_MiB)
+	var written int64
+	var checksum string
+	if definition.F_4K_Align {
+		written, checksum, err = EncodeStream4K(w, blobId, r, size)
+	} else {
+		written, checksum, err = EncodeStream(w, blobId, r, size)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		ZapLogger.Error("Put blob stream failed", zap.Any("blobId", blobId),
+			zap.Any("file", bh.LocalName), zap.Any("err", err))
+		if tErr := f.Truncate(bh.CurOff); tErr != nil {
+			ZapLogger.Error("f.Truncate", zap.Any("file", bh.LocalName), zap.Any("err", tErr))
+		}
+		var se *StorageError
+		if !errors.As(err, &se) {
+			// Errors of r are returned as is, content is only written.
+			err = ioError("write", bh.LocalName, err)
+		}
+		return 0, 0, "", err
+	}
+	offset := bh.CurOff
+	bh.CurOff += written
+	ZapLogger.Info("Put blob stream succeeded", zap.Any("blobId", blobId),
+		zap.Any("offset", offset), zap.Any("sizeWritten", written),
+		zap.Any("checksum", checksum))
+	return offset, written, checksum, nil
 }
 
-func (bh *BinHeader) Get(blobId string, offset int64) (binary []byte) {
+// Read the blob at offset, its content is verified against checksum, the
+// one of its index entry.
+func (bh *BinHeader) Get(blobId string, offset int64, checksum string) ([]byte, error) {
 	bh.RWLock.RLock()
 	defer bh.RWLock.RUnlock()
 	var data []byte
+	var err error
 	if definition.F_4K_Align {
-		data = bh.readBlob4K(blobId, offset)
+		data, err = bh.readBlob4K(blobId, offset)
 	} else {
-		data = bh.readBlob(blobId, offset)
+		data, err = bh.readBlob(blobId, offset)
+	}
+	if err == nil {
+		err = verifyBlobChecksum(checksum, data)
+	}
+	if err != nil {
+		ZapLogger.Error("Get blob failed", zap.Any("blobId", blobId),
+			zap.Any("file", bh.LocalName), zap.Any("offset", offset), zap.Any("err", err))
+		return nil, err
 	}
 	ZapLogger.Info("Get blob succeeded", zap.Any("blobId", blobId),
 		zap.Any("offset", offset), zap.Any("size read", len(data)))
-	return data
+	return data, nil
 }
 
-func (bh *BinHeader) flush(binary *[]byte) (int64, int64) {
+func (bh *BinHeader) flush(binary *[]byte) (int64, int64, error) {
 	f, err := os.OpenFile(bh.LocalName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0755)
 	if err != nil {
-		ZapLogger.Fatal("os.OpenFile", zap.Any("file", bh.LocalName), zap.Any("err", err))
+		ZapLogger.Error("os.OpenFile", zap.Any("file", bh.LocalName), zap.Any("err", err))
+		return 0, 0, ioError("open", bh.LocalName, err)
 	}
 	defer f.Close()
 	// Persist
 	written := 0
 	if written, err = f.Write(*binary); err != nil {
-		ZapLogger.Fatal("f.Write", zap.Any("file", bh.LocalName), zap.Any("err", err))
+		ZapLogger.Error("f.Write", zap.Any("file", bh.LocalName), zap.Any("err", err))
+		if tErr := f.Truncate(bh.CurOff); tErr != nil {
+			ZapLogger.Error("f.Truncate", zap.Any("file", bh.LocalName), zap.Any("err", tErr))
+		}
+		return 0, 0, ioError("write", bh.LocalName, err)
 	}
-	return bh.CurOff, int64(written)
+	return bh.CurOff, int64(written), nil
 }
 
-func (bh *BinHeader) readBlob(blbId string, offset int64) (blobBody []byte) {
+// Must be called with RWLock held, the record is checked to lie within
+// CurOff.
+func (bh *BinHeader) readBlob(blbId string, offset int64) ([]byte, error) {
 	f, err := os.OpenFile(bh.LocalName, os.O_RDONLY, 0755)
 	if err != nil {
-		ZapLogger.Fatal("os.OpenFile", zap.Any("file", bh.LocalName), zap.Any("err", err))
+		return nil, ioError("open", bh.LocalName, err)
 	}
 	defer f.Close()
 
-	idAndSize := make([]byte, 136)
+	idAndSize := make([]byte, K_blob_header_len)
 	if _, err = f.ReadAt(idAndSize, offset); err != nil {
-		ZapLogger.Fatal("f.readAt", zap.Any("file", bh.LocalName), zap.Any("err", err))
+		return nil, ioError("read", bh.LocalName, err)
 	}
 
-	idOnDisk := DecodeName(idAndSize[:128])
+	idOnDisk, err := DecodeName(idAndSize[:definition.F_BLOBID_SIZE])
+	if err != nil {
+		return nil, err
+	}
 	if strings.Compare(blbId, idOnDisk) != 0 {
-		ZapLogger.Fatal("blob name mismatch",
+		ZapLogger.Error("blob name mismatch",
 			zap.Any("blobId", blbId),
 			zap.Any("idOnDisk", idOnDisk))
+		return nil, corruptError("read", bh.LocalName, "blob name mismatch")
 	}
 
-	cntSize := DecodeSize(idAndSize[128:136])
+	cntSize, err := DecodeSize(idAndSize[definition.F_BLOBID_SIZE:K_blob_header_len])
+	if err != nil {
+		return nil, err
+	}
+	if cntSize < 0 || offset+K_blob_header_len+cntSize > bh.CurOff {
+		return nil, corruptError("read", bh.LocalName, "blob size out of file")
+	}
 	bodyBytes := make([]byte, cntSize)
 	start := time.Now()
-	if _, err = f.ReadAt(bodyBytes, offset+136); err != nil {
-		ZapLogger.Fatal("f.Read failed", zap.Any("err", err))
+	if _, err = f.ReadAt(bodyBytes, offset+K_blob_header_len); err != nil {
+		return nil, ioError("read", bh.LocalName, err)
 	}
 	duration := time.Now().Sub(start)
 	ZapLogger.Info("read file from cache",
@@ -149,39 +225,67 @@ func (bh *BinHeader) readBlob(blbId string, offset int64) (blobBody []byte) {
 		zap.Any("size", cntSize),
 		zap.Any("duration seconds", duration.Seconds()))
 
-	return bodyBytes
+	return bodyBytes, nil
 }
 
-func (bh *BinHeader) readBlob4K(blbId string, offset int64) (blobBody []byte) {
+// Same as readBlob for 4K aligned blobs. Chunk checksums are verified, the
+// whole content checksum is left to the caller.
+func (bh *BinHeader) readBlob4K(blbId string, offset int64) ([]byte, error) {
 	f, err := os.OpenFile(bh.LocalName, os.O_RDONLY, 0755)
 	if err != nil {
-		ZapLogger.Fatal("os.OpenFile", zap.Any("file", bh.LocalName), zap.Any("err", err))
+		return nil, ioError("open", bh.LocalName, err)
 	}
 	defer f.Close()
-	idSizeAndCheckSum := make([]byte, definition.F_BLOBID_SIZE+8+definition.F_CHECKSUM_SIZE)
+	idSizeAndCheckSum := make([]byte, K_chunk_header_len)
 	if _, err = f.ReadAt(idSizeAndCheckSum, offset); err != nil {
-		ZapLogger.Fatal("f.ReadAt failed", zap.Any("err", err))
+		return nil, ioError("read", bh.LocalName, err)
+	}
+	idOnDisk, err := DecodeName(idSizeAndCheckSum[:definition.F_BLOBID_SIZE])
+	if err != nil {
+		return nil, err
 	}
-	idOnDisk := DecodeName(idSizeAndCheckSum[:definition.F_BLOBID_SIZE])
 	if strings.Compare(blbId, idOnDisk) != 0 {
-		ZapLogger.Fatal("blob name mismatch",
+		ZapLogger.Error("blob name mismatch",
 			zap.Any("blobId", blbId),
 			zap.Any("idOnDisk", idOnDisk))
+		return nil, corruptError("read", bh.LocalName, "blob name mismatch")
+	}
+	dataSize, err := DecodeSize(idSizeAndCheckSum[definition.F_BLOBID_SIZE : definition.F_BLOBID_SIZE+8])
+	if err != nil {
+		return nil, err
 	}
-	dataSize := DecodeSize(idSizeAndCheckSum[definition.F_BLOBID_SIZE : definition.F_BLOBID_SIZE+8])
 	chunksNum := (dataSize + definition.F_CONTENT_SIZE - 1) / definition.F_CONTENT_SIZE
+	if dataSize <= 0 || offset+chunksNum*4*definition.K_KiB > bh.CurOff {
+		return nil, corruptError("read", bh.LocalName, "blob size out of file")
+	}
 	totalBytes := make([]byte, chunksNum*4*definition.K_KiB)
 	if _, err = f.ReadAt(totalBytes, offset); err != nil {
-		ZapLogger.Fatal("f.ReadAt failed", zap.Any("err", err))
+		return nil, ioError("read", bh.LocalName, err)
+	}
+	for i := int64(0); i < chunksNum; i++ {
+		chunk := totalBytes[i*4*definition.K_KiB : (i+1)*4*definition.K_KiB]
+		cntLen := dataSize - i*definition.F_CONTENT_SIZE
+		if cntLen > definition.F_CONTENT_SIZE {
+			cntLen = definition.F_CONTENT_SIZE
+		}
+		if err := verifyChunkChecksum(chunk[definition.F_BLOBID_SIZE+8:K_chunk_header_len],
+			chunk[K_chunk_header_len:K_chunk_header_len+cntLen]); err != nil {
+			ZapLogger.Error("chunk checksum mismatch", zap.Any("blobId", blbId),
+				zap.Any("file", bh.LocalName), zap.Any("chunk", i))
+			return nil, err
+		}
+	}
+	blobId, bodyBytes, err := Decode4K(totalBytes)
+	if err != nil {
+		return nil, err
 	}
-	blobId, bodyBytes := Decode4K(totalBytes)
-	//TODO: Use error return instead, rather than directly crashing the server
 	if strings.Compare(blobId, idOnDisk) != 0 {
-		ZapLogger.Fatal("blob name mismatch",
+		ZapLogger.Error("blob name mismatch",
 			zap.Any("blobId", blobId),
 			zap.Any("idOnDisk", idOnDisk))
+		return nil, corruptError("read", bh.LocalName, "blob name mismatch")
 	}
-	return bodyBytes
+	return bodyBytes, nil
 }
 
 //////////////////////////////////////////////////////
@@ -219,17 +323,43 @@ func Encode(blobId string, data []byte) (encoded []byte) {
 	return allBytes
 }
 
-func Decode(encoded []byte) (blobId string, data []byte) {
-	blbId := DecodeName(encoded[0:128])
-	size := DecodeSize(encoded[128:136])
+// Same layout as Encode, but content is copied from r into w. Returns the
+// checksum of content as well.
+func EncodeStream(w io.Writer, blobId string, r io.Reader, size int64) (int64, string, error) {
+	header := make([]byte, K_blob_header_len)
+	copy(header[:definition.F_BLOBID_SIZE], blobId)
+	binary.LittleEndian.PutUint64(header[definition.F_BLOBID_SIZE:], uint64(size))
+	n, err := w.Write(header)
+	if err != nil {
+		return int64(n), "", err
+	}
+	h := crc32.New(crc32cTable)
+	copied, err := io.CopyN(w, io.TeeReader(r, h), size)
+	return int64(n) + copied, FormatChecksum(h.Sum32()), err
+}
+
+func Decode(encoded []byte) (blobId string, data []byte, err error) {
+	if len(encoded) < K_blob_header_len {
+		return "", nil, corruptError("decode", "", "short blob header")
+	}
+	blbId, err := DecodeName(encoded[0:128])
+	if err != nil {
+		return "", nil, err
+	}
+	size, err := DecodeSize(encoded[128:136])
+	if err != nil {
+		return "", nil, err
+	}
+	if size < 0 || 136+size > int64(len(encoded)) {
+		return "", nil, corruptError("decode", "", "blob size out of record")
+	}
 
 	dataBytes := make([]byte, size)
 	copy(dataBytes, encoded[136:(136+size)])
 
-	return blbId, dataBytes
+	return blbId, dataBytes, nil
 }
 
-// TODO implement the checksum.
 func Encode4K(blobId string, data []byte) (encoded []byte) {
 	chunks := make([]Chunk, 0)
 	//get content length
@@ -244,15 +374,16 @@ func Encode4K(blobId string, data []byte) (encoded []byte) {
 		copy(tmp.ChunkHeader.BlobId[:], blbIdBytes)
 		//chunk.size
 		tmp.ChunkHeader.Size = size
-		//TODO: fake chunk.checksum
-		fakeChecksum := []byte("12345678123456781234567812345678")
-		copy(tmp.ChunkHeader.Checksum[:], fakeChecksum)
 		//chunk.content
+		var content []byte
 		if int64(start+definition.F_CONTENT_SIZE) > tmpSize {
-			copy(tmp.Content[:], data[start:])
+			content = data[start:]
 		} else {
-			copy(tmp.Content[:], data[start:start+definition.F_CONTENT_SIZE])
+			content = data[start : start+definition.F_CONTENT_SIZE]
 		}
+		copy(tmp.Content[:], content)
+		//chunk.checksum
+		putChunkChecksum(tmp.ChunkHeader.Checksum[:], content)
 		chunks = append(chunks, tmp)
 		start += definition.F_CONTENT_SIZE
 		size -= definition.F_CONTENT_SIZE
@@ -263,14 +394,48 @@ func Encode4K(blobId string, data []byte) (encoded []byte) {
 	return res.Bytes()
 }
 
-func Decode4K(encoded []byte) (blobId string, data []byte) {
+// Same layout as Encode4K, but content is read from r chunk by chunk.
+// Returns the checksum of the whole content as well.
+func EncodeStream4K(w io.Writer, blobId string, r io.Reader, size int64) (int64, string, error) {
+	chunk := make([]byte, 4*definition.K_KiB)
+	written := int64(0)
+	sum := uint32(0)
+	for left := size; left > 0; left -= definition.F_CONTENT_SIZE {
+		for i := range chunk {
+			chunk[i] = 0
+		}
+		copy(chunk[:definition.F_BLOBID_SIZE], blobId)
+		binary.LittleEndian.PutUint64(chunk[definition.F_BLOBID_SIZE:], uint64(left))
+		cntLen := int64(definition.F_CONTENT_SIZE)
+		if left < cntLen {
+			cntLen = left
+		}
+		content := chunk[K_chunk_header_len : K_chunk_header_len+cntLen]
+		if _, err := io.ReadFull(r, content); err != nil {
+			return written, "", err
+		}
+		putChunkChecksum(chunk[definition.F_BLOBID_SIZE+8:K_chunk_header_len], content)
+		sum = crc32.Update(sum, crc32cTable, content)
+		n, err := w.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, "", err
+		}
+	}
+	return written, FormatChecksum(sum), nil
+}
+
+func Decode4K(encoded []byte) (blobId string, data []byte, err error) {
+	if len(encoded) == 0 || len(encoded)%(4*definition.K_KiB) != 0 {
+		return "", nil, corruptError("decode", "", "not whole 4K chunks")
+	}
 	chunks := make([]Chunk, 0)
 	for i := 0; i < len(encoded); i += 4 * definition.K_KiB {
 		buf := bytes.NewReader(encoded[i : i+4*definition.K_KiB])
 		tmp := Chunk{}
 		err := binary.Read(buf, binary.LittleEndian, &tmp)
 		if err != nil {
-			ZapLogger.Fatal("binary.Read failed", zap.Any("err", err))
+			return "", nil, ioError("decode", "", err)
 		}
 		chunks = append(chunks, tmp)
 	}
@@ -280,27 +445,28 @@ func Decode4K(encoded []byte) (blobId string, data []byte) {
 	for i := 0; i < len(chunks); i++ {
 		dataBytes = append(dataBytes, chunks[i].Content[:]...)
 	}
+	if size < 0 || size > int64(len(dataBytes)) {
+		return "", nil, corruptError("decode", "", "chunk size out of blob")
+	}
 	dataBytes = dataBytes[:size]
-	return blbId, dataBytes
+	return blbId, dataBytes, nil
 }
 
-func DecodeName(encoded []byte) (blobId string) {
+func DecodeName(encoded []byte) (blobId string, err error) {
 	decoded := make([]byte, 128)
 	buf := bytes.NewReader(encoded)
-	err := binary.Read(buf, binary.LittleEndian, &decoded)
-	if err != nil {
-		ZapLogger.Fatal("binary.Read failed", zap.Any("err", err))
+	if err := binary.Read(buf, binary.LittleEndian, &decoded); err != nil {
+		return "", ioError("decode", "", err)
 	}
 	// TODO: A bit dirty. refactor the hardcoded 8 number
-	return string(decoded[:8])
+	return string(decoded[:8]), nil
 }
 
-func DecodeSize(encoded []byte) int64 {
+func DecodeSize(encoded []byte) (int64, error) {
 	var size int64
 	buf := bytes.NewReader(encoded)
-	err := binary.Read(buf, binary.LittleEndian, &size)
-	if err != nil {
-		ZapLogger.Fatal("binary.Read failed", zap.Any("err", err))
+	if err := binary.Read(buf, binary.LittleEndian, &size); err != nil {
+		return 0, ioError("decode", "", err)
 	}
-	return size
+	return size, nil
 }
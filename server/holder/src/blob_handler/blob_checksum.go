@@ -0,0 +1,79 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package blob_handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/common/definition"
+)
+
+// Blob content is protected by CRC32C at 2 levels: each 4K chunk carries
+// the checksum of its content in ChunkHeader.Checksum, and IndexEntry
+// carries the checksum of the whole blob content. Checksums are stored as
+// "crc32c:<8 hex digits>". Blobs written before checksums existed carry
+// an empty index checksum and a fake chunk checksum, they aren't verified.
+
+const K_checksum_prefix = "crc32c:"
+
+// A checksum mismatch is a kind of corruption, errors.Is(err, ErrCorrupt)
+// holds for it.
+var ErrChecksumMismatch error = &StorageError{
+	Kind: ErrCorrupt, Op: "verify", Err: errors.New("blob checksum mismatch")}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func FormatChecksum(sum uint32) string {
+	return fmt.Sprintf("%s%08x", K_checksum_prefix, sum)
+}
+
+// Returns false if s isn't a checksum written by FormatChecksum.
+func ParseChecksum(s string) (uint32, bool) {
+	if !strings.HasPrefix(s, K_checksum_prefix) {
+		return 0, false
+	}
+	sum, err := strconv.ParseUint(s[len(K_checksum_prefix):], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(sum), true
+}
+
+// Write the checksum of content into the checksum field of a chunk header.
+func putChunkChecksum(field []byte, content []byte) {
+	for i := range field {
+		field[i] = 0
+	}
+	copy(field, FormatChecksum(crc32.Checksum(content, crc32cTable)))
+}
+
+// Verify content against the checksum field of its chunk header.
+func verifyChunkChecksum(field []byte, content []byte) error {
+	want, ok := ParseChecksum(string(bytes.TrimRight(field[:definition.F_CHECKSUM_SIZE], "\x00")))
+	if !ok {
+		return nil
+	}
+	if crc32.Checksum(content, crc32cTable) != want {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// Verify the whole content of a blob against its index checksum.
+func verifyBlobChecksum(checksum string, content []byte) error {
+	want, ok := ParseChecksum(checksum)
+	if !ok {
+		return nil
+	}
+	if crc32.Checksum(content, crc32cTable) != want {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
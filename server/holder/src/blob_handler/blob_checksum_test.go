@@ -0,0 +1,161 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package blob_handler
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/common/definition"
+)
+
+// Point the blob directory at a temporary one and pick the binary layout,
+// both are restored once the test is done.
+func setupBlobDir(t *testing.T, align4K bool) {
+	prefix, align := definition.BlobLocalPathPrefix, definition.F_4K_Align
+	t.Cleanup(func() {
+		definition.BlobLocalPathPrefix, definition.F_4K_Align = prefix, align
+	})
+	definition.BlobLocalPathPrefix = t.TempDir()
+	definition.F_4K_Align = align4K
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+var kContentSizes = []int{1, definition.F_CONTENT_SIZE - 1, definition.F_CONTENT_SIZE,
+	definition.F_CONTENT_SIZE + 1, 3*definition.F_CONTENT_SIZE + 17}
+
+func TestParseChecksum(t *testing.T) {
+	sum, ok := ParseChecksum(FormatChecksum(0xdeadbeef))
+	if !ok || sum != 0xdeadbeef {
+		t.Fatalf("got %x, %v", sum, ok)
+	}
+	for _, s := range []string{"", "deadbeef", "crc32c:", "crc32c:xyz", "md5:00000000"} {
+		if _, ok := ParseChecksum(s); ok {
+			t.Errorf("%q parsed as a checksum", s)
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, n := range kContentSizes {
+		data := randomBytes(n)
+		blbId, got, err := Decode(Encode("abcdefgh", data))
+		if err != nil || blbId != "abcdefgh" || !bytes.Equal(got, data) {
+			t.Fatalf("size %d: got %q, %d bytes, %v", n, blbId, len(got), err)
+		}
+
+		var streamed bytes.Buffer
+		written, sum, err := EncodeStream(&streamed, "abcdefgh", bytes.NewReader(data), int64(n))
+		if err != nil || written != int64(streamed.Len()) {
+			t.Fatalf("size %d: stream wrote %d, %v", n, written, err)
+		}
+		if !bytes.Equal(streamed.Bytes(), Encode("abcdefgh", data)) {
+			t.Fatalf("size %d: EncodeStream differs from Encode", n)
+		}
+		if sum != FormatChecksum(crc32.Checksum(data, crc32cTable)) {
+			t.Fatalf("size %d: checksum %s", n, sum)
+		}
+	}
+}
+
+func TestEncode4KRoundTrip(t *testing.T) {
+	for _, n := range kContentSizes {
+		data := randomBytes(n)
+		encoded := Encode4K("abcdefgh", data)
+		if len(encoded)%(4*definition.K_KiB) != 0 {
+			t.Fatalf("size %d: %d bytes aren't whole chunks", n, len(encoded))
+		}
+		blbId, got, err := Decode4K(encoded)
+		if err != nil || blbId != "abcdefgh" || !bytes.Equal(got, data) {
+			t.Fatalf("size %d: got %q, %d bytes, %v", n, blbId, len(got), err)
+		}
+		// Each chunk carries the checksum of its own content.
+		for off := 0; off < len(encoded); off += 4 * definition.K_KiB {
+			chunk := encoded[off : off+4*definition.K_KiB]
+			start := off / (4 * definition.K_KiB) * definition.F_CONTENT_SIZE
+			end := start + definition.F_CONTENT_SIZE
+			if end > n {
+				end = n
+			}
+			err := verifyChunkChecksum(
+				chunk[definition.F_BLOBID_SIZE+8:K_chunk_header_len], data[start:end])
+			if err != nil {
+				t.Fatalf("size %d: chunk at %d: %v", n, off, err)
+			}
+		}
+
+		var streamed bytes.Buffer
+		_, sum, err := EncodeStream4K(&streamed, "abcdefgh", bytes.NewReader(data), int64(n))
+		if err != nil || !bytes.Equal(streamed.Bytes(), encoded) {
+			t.Fatalf("size %d: EncodeStream4K differs from Encode4K, %v", n, err)
+		}
+		if sum != FormatChecksum(crc32.Checksum(data, crc32cTable)) {
+			t.Fatalf("size %d: checksum %s", n, sum)
+		}
+	}
+}
+
+// Flip a byte in the content of a blob on disk, reads must fail with
+// ErrChecksumMismatch.
+func TestCorruptedBlobDetected(t *testing.T) {
+	for _, align4K := range []bool{false, true} {
+		setupBlobDir(t, align4K)
+		var bh BinHeader
+		bh.New(0, "crc")
+		data := randomBytes(5 * definition.F_CONTENT_SIZE)
+		off, _, sum, err := bh.PutStream("abcdefgh", bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := bh.Get("abcdefgh", off, sum); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("4K %v: intact blob read failed, %v", align4K, err)
+		}
+
+		// In the 3rd chunk, or the 3rd chunk worth of content.
+		f, err := os.OpenFile(bh.LocalName, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{0xff, 0xfe}, off+int64(2*4*definition.K_KiB+500))
+		f.Close()
+
+		if _, err := bh.Get("abcdefgh", off, sum); !errors.Is(err, ErrChecksumMismatch) ||
+			!errors.Is(err, ErrCorrupt) {
+			t.Fatalf("4K %v: Get returned %v", align4K, err)
+		}
+		br, err := bh.OpenBlob("abcdefgh", off, sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(io.Discard, io.NewSectionReader(br, 0, br.Size()))
+		if !errors.Is(err, ErrChecksumMismatch) || !br.Corrupted() {
+			t.Fatalf("4K %v: streaming returned %v, corrupted %v", align4K, err, br.Corrupted())
+		}
+		br.Close()
+
+		// Chunks before the corrupted one are still served in 4K mode.
+		if align4K {
+			br, _ := bh.OpenBlob("abcdefgh", off, sum)
+			p := make([]byte, definition.F_CONTENT_SIZE)
+			if _, err := br.ReadAt(p, 0); err != nil || !bytes.Equal(p, data[:len(p)]) {
+				t.Fatalf("intact chunk read failed, %v", err)
+			}
+			if _, err := br.ReadAt(p, 2*definition.F_CONTENT_SIZE); err != ErrChecksumMismatch {
+				t.Fatalf("corrupted chunk read returned %v", err)
+			}
+			br.Close()
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package blob_handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/common/util"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Compaction copies the live blobs of a closed triplet into a new one, so
+// the bytes of deleted blobs are given back once the old one is purged. A
+// blob keeps its id across compaction, only the triplet part of its token
+// changes.
+//
+// Crash safety relies on the startup orphan cleanup of PhyBH.New: a target
+// no file points at yet is deleted at startup. The target is sealed and
+// synced before the journal is written, and the journal is written before
+// any file is pointed at the target, so a restart finding the journal can
+// roll the compaction forward.
+
+// Compaction in progress of a shard, persisted as json.
+type CompactionJournal struct {
+	Src string
+	Dst string
+}
+
+func compactionJournalPath(shardId int) string {
+	return fmt.Sprintf("%s/compaction_%d.json", BlobDir(), shardId)
+}
+
+// Durably record the compaction of src into dst. Written to a temp file
+// then renamed, so a crash never leaves a partial journal.
+func WriteCompactionJournal(shardId int, src string, dst string) error {
+	data, err := json.Marshal(CompactionJournal{Src: src, Dst: dst})
+	if err != nil {
+		return err
+	}
+	path := compactionJournalPath(shardId)
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(BlobDir())
+}
+
+// Returns nil if no compaction was in progress.
+func ReadCompactionJournal(shardId int) (*CompactionJournal, error) {
+	data, err := os.ReadFile(compactionJournalPath(shardId))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var journal CompactionJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return nil, err
+	}
+	return &journal, nil
+}
+
+func RemoveCompactionJournal(shardId int) error {
+	err := os.Remove(compactionJournalPath(shardId))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDONLY, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Closed triplets of this shard, large object triplets excluded.
+func (pbh *PhyBH) ClosedTriplets() []*Triplet {
+	var tplts []*Triplet
+	pbh.ClosedTplt.dict.Range(func(k, v interface{}) bool {
+		tplts = append(tplts, v.(*Node).value)
+		return true
+	})
+	return tplts
+}
+
+// Tokens of the blobs still indexed by the triplet.
+func (tri *Triplet) LiveTokens() []string {
+	tri.IdxHeader.RWLock.RLock()
+	defer tri.IdxHeader.RWLock.RUnlock()
+	tokens := make([]string, 0, len(tri.IdxHeader.RefMap))
+	for blbId := range tri.IdxHeader.RefMap {
+		tokens = append(tokens, util.GenerateBlobToken(tri.Id, blbId))
+	}
+	return tokens
+}
+
+// Open a triplet receiving the blobs relocated by compaction. It's exposed
+// to readers as closed right away, so it never takes writes from clients.
+func (pbh *PhyBH) OpenCompactionTarget() (*Triplet, error) {
+	tplt, size, err := pbh.openNewTplt(false)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&pbh.totalBytes, size)
+	pbh.ClosedTplt.Put(tplt.Id, tplt)
+	return tplt, nil
+}
+
+// Persist the closed state of a compaction target once all blobs are
+// copied, and flush its files to disk before any file points at it.
+func (pbh *PhyBH) SealCompactionTarget(dst *Triplet) error {
+	if err := dst.IdxHeader.Close(); err != nil {
+		ZapLogger.Error("close compaction target failed", zap.Any("id", dst.Id), zap.Any("err", err))
+		return err
+	}
+	for _, path := range []string{
+		dst.BinHeader.LocalName, dst.IdxHeader.LocalName, dst.MFHeader.LocalName} {
+		if err := syncFile(path); err != nil {
+			ZapLogger.Error("sync compaction target failed",
+				zap.Any("file", path), zap.Any("err", err))
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy the blob of token into dst, returns the token of the copy. The
+// content is verified while being copied, ErrChecksumMismatch is returned
+// for a corrupted blob.
+func (pbh *PhyBH) CopyBlob(token string, dst *Triplet) (string, error) {
+	src, blbId, err := pbh.peek(token)
+	if err != nil {
+		return "", err
+	}
+	entry := src.IdxHeader.Get(blbId)
+	if entry == nil {
+		return "", notFoundError("copy", "blob already deleted in triplet")
+	}
+	br, err := src.BinHeader.OpenBlob(blbId, entry.Offset, entry.Checksum)
+	if err != nil {
+		pbh.checkCorrupted(src.Id, err)
+		return "", err
+	}
+	defer br.Close()
+	offset, size, checksum, err := dst.BinHeader.PutStream(
+		blbId, io.NewSectionReader(br, 0, br.Size()), br.Size())
+	if err != nil {
+		return "", err
+	}
+	idxBytes, err := dst.IdxHeader.Put(blbId, offset, size, checksum)
+	if err != nil {
+		atomic.AddInt64(&pbh.totalBytes, size)
+		return "", err
+	}
+	mfBytes, err := dst.MFHeader.Put(blbId)
+	atomic.AddInt64(&pbh.totalBytes, size+idxBytes+mfBytes)
+	if err != nil {
+		return "", err
+	}
+	return util.GenerateBlobToken(dst.Id, blbId), nil
+}
+
+// Token of the copy of the blob of token in dst, "" if dst has no copy.
+func (pbh *PhyBH) CompactedToken(token string, dst *Triplet) string {
+	blbId := util.GetBlobIdFromToken(token)
+	if dst.IdxHeader.Get(blbId) == nil {
+		return ""
+	}
+	return util.GenerateBlobToken(dst.Id, blbId)
+}
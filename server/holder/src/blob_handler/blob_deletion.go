@@ -0,0 +1,102 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package blob_handler
+
+import (
+	"sync/atomic"
+
+	"github.com/common/definition"
+	"github.com/common/util"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Blobs are deleted one by one: the deletion is logged in manifest and the
+// blob is dropped from the in-memory index, but its bytes stay in the
+// binary file until the triplet is compacted, see blob_compaction.go.
+
+// Bytes of blobs still indexed by the triplet, and bytes of its binary.
+func (tri *Triplet) LiveBytes() (live int64, total int64) {
+	tri.IdxHeader.RWLock.RLock()
+	for _, entry := range tri.IdxHeader.RefMap {
+		live += entry.Size
+	}
+	tri.IdxHeader.RWLock.RUnlock()
+	tri.BinHeader.RWLock.RLock()
+	total = tri.BinHeader.CurOff
+	tri.BinHeader.RWLock.RUnlock()
+	return live, total
+}
+
+// Ratio of live bytes in the binary file, 1 for an empty triplet.
+func (tri *Triplet) LiveRatio() float64 {
+	live, total := tri.LiveBytes()
+	if total == 0 {
+		return 1
+	}
+	return float64(live) / float64(total)
+}
+
+func (tri *Triplet) NumBlobs() int {
+	tri.IdxHeader.RWLock.RLock()
+	defer tri.IdxHeader.RWLock.RUnlock()
+	return len(tri.IdxHeader.RefMap)
+}
+
+// Same as locate, but doesn't refresh the triplet recency.
+func (pbh *PhyBH) peek(token string) (*Triplet, string, error) {
+	if len(token) > len(definition.K_LARGE_OBJECT_PREFIX) &&
+		token[:len(definition.K_LARGE_OBJECT_PREFIX)] == definition.K_LARGE_OBJECT_PREFIX {
+		token = token[len(definition.K_LARGE_OBJECT_PREFIX):]
+		if triplet := pbh.LargeObjTplt.Peek(util.GetTripletIdFromToken(token)); triplet != nil {
+			return triplet, util.GetBlobIdFromToken(token), nil
+		}
+	} else {
+		tpltId := util.GetTripletIdFromToken(token)
+		if triplet := pbh.OpenTplt.Peek(tpltId); triplet != nil {
+			return triplet, util.GetBlobIdFromToken(token), nil
+		} else if triplet := pbh.ClosedTplt.Peek(tpltId); triplet != nil {
+			return triplet, util.GetBlobIdFromToken(token), nil
+		}
+	}
+	return nil, "", notFoundError("peek", "blob not exist in this blob handler shard")
+}
+
+// Delete the blob of token, returns the triplet which held it. The caller
+// must make sure no file points at the blob anymore.
+func (pbh *PhyBH) DeleteBlob(token string) (*Triplet, error) {
+	hostTplt, blbId, err := pbh.peek(token)
+	if err != nil {
+		return nil, err
+	}
+	if hostTplt.IdxHeader.Get(blbId) == nil {
+		return hostTplt, notFoundError("delete", "blob already deleted in triplet")
+	}
+	// Log first, a crash after logging loses nothing since no file points
+	// at the blob.
+	mfBytes, err := hostTplt.MFHeader.Delete(blbId)
+	if err != nil {
+		ZapLogger.Error("mf.Delete", zap.Any("token", token), zap.Any("err", err))
+		return hostTplt, err
+	}
+	atomic.AddInt64(&pbh.totalBytes, mfBytes)
+	if err := hostTplt.IdxHeader.Delete(blbId); err != nil {
+		return hostTplt, err
+	}
+	ZapLogger.Info("Deleted blob", zap.Any("token", token))
+	return hostTplt, nil
+}
+
+func (pbh *PhyBH) IsClosedTriplet(tpltId string) bool {
+	return pbh.ClosedTplt.Peek(tpltId) != nil
+}
+
+func (pbh *PhyBH) IsLargeTriplet(tpltId string) bool {
+	return pbh.LargeObjTplt.Peek(tpltId) != nil
+}
+
+func (pbh *PhyBH) GetTotalBytes() int64 {
+	return atomic.LoadInt64(&pbh.totalBytes)
+}
@@ -0,0 +1,80 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package blob_handler
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Kinds of storage errors, test with errors.Is.
+var (
+	// Data on disk disagrees with its index, header or checksum.
+	ErrCorrupt = errors.New("blob data corrupt")
+	// Disk or cache capacity is exhausted.
+	ErrNoSpace = errors.New("no space for blob")
+	// Triplet or blob isn't held by this shard, or already deleted.
+	ErrNotFound = errors.New("blob not found")
+)
+
+// Error of a storage operation on a file. Kind is 1 of the errors above,
+// nil if the error couldn't be classified.
+type StorageError struct {
+	Kind error
+	Op   string
+	File string
+	Err  error
+}
+
+func (e *StorageError) Error() string {
+	msg := e.Op
+	if e.File != "" {
+		msg += " " + e.File
+	}
+	if e.Kind != nil {
+		msg += ": " + e.Kind.Error()
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *StorageError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// Wrap the I/O error of op on file. A full disk is classified as
+// ErrNoSpace, a missing file as ErrNotFound, and reading past the end of
+// a file as ErrCorrupt since the index points at data that isn't there.
+func ioError(op string, file string, err error) error {
+	if err == nil {
+		return nil
+	}
+	se := &StorageError{Op: op, File: file, Err: err}
+	switch {
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		se.Kind = ErrNoSpace
+	case errors.Is(err, os.ErrNotExist):
+		se.Kind = ErrNotFound
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		se.Kind = ErrCorrupt
+	}
+	return se
+}
+
+func corruptError(op string, file string, detail string) error {
+	return &StorageError{Kind: ErrCorrupt, Op: op, File: file, Err: errors.New(detail)}
+}
+
+func notFoundError(op string, detail string) error {
+	return &StorageError{Kind: ErrNotFound, Op: op, Err: errors.New(detail)}
+}
@@ -5,16 +5,12 @@
 package blob_handler
 
 import (
-	"bytes"
 	"container/list"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
-	"strings"
 	"sync"
-	"unsafe"
 
 	"github.com/common/definition"
 	. "github.com/common/zaplog"
@@ -28,19 +24,17 @@ const K_state_base_ascii = 48
 const K_index_header_open = 2
 const K_index_header_closed = 3
 const K_index_header_large = 4
-const K_index_entry_len = 252
+
+// Index record: blob id, offset, size, checksum and CRC, see blob_record.go.
+const K_index_entry_len = definition.F_BLOBID_SIZE + 8 + 8 + definition.F_CHECKSUM_SIZE + K_record_crc_len
 
 // Analogy: row in a list.
 type IndexEntry struct {
 	// maxlen = 128
-	BlobId string
-	//maxlen = 22
-	Offset int64
-	//maxlen = 22
+	BlobId   string
+	Offset   int64
 	Size     int64
 	Checksum string
-	Fid      string
-	Padding  string
 	// TODO: use this ptr to obtain the chain of blobs that's correlated.
 	// In this sense, IndexHeader composites a keylist data structure that
 	// holds reference to blob positions on disk.
@@ -71,14 +65,38 @@ type IndexHeader struct {
 	RefMap map[string]*IndexEntry
 
 	Empty bool
+
+	// Left in place by a read-only load: the file is in the legacy json
+	// format, the bytes of a torn tail record.
+	Legacy    bool
+	TornBytes int64
 }
 
-func (ie *IndexEntry) Serialize() []byte {
-	jsonbyte, err := json.Marshal(ie)
-	if err != nil {
-		panic(err)
+func (ie *IndexEntry) Serialize() ([]byte, error) {
+	rec := make([]byte, K_index_entry_len)
+	if err := putFixedString(rec[:definition.F_BLOBID_SIZE], ie.BlobId); err != nil {
+		return nil, err
+	}
+	pos := definition.F_BLOBID_SIZE
+	binary.LittleEndian.PutUint64(rec[pos:], uint64(ie.Offset))
+	binary.LittleEndian.PutUint64(rec[pos+8:], uint64(ie.Size))
+	pos += 16
+	if err := putFixedString(rec[pos:pos+definition.F_CHECKSUM_SIZE], ie.Checksum); err != nil {
+		return nil, err
+	}
+	sealRecord(rec)
+	return rec, nil
+}
+
+// Decode a record checked by readRecordFile.
+func decodeIndexEntry(rec []byte) IndexEntry {
+	pos := definition.F_BLOBID_SIZE
+	return IndexEntry{
+		BlobId:   getFixedString(rec[:pos]),
+		Offset:   int64(binary.LittleEndian.Uint64(rec[pos:])),
+		Size:     int64(binary.LittleEndian.Uint64(rec[pos+8:])),
+		Checksum: getFixedString(rec[pos+16 : pos+16+definition.F_CHECKSUM_SIZE]),
 	}
-	return jsonbyte
 }
 
 // TODO: use index to wrap indexHeader, 1 index can contain
@@ -90,7 +108,12 @@ func (ie *IndexEntry) Serialize() []byte {
 // }
 
 // shardId is the holder instance id.
-func (ih *IndexHeader) New(shardId int, triId string, isLarge bool) int64 {
+func (ih *IndexHeader) New(shardId int, triId string, isLarge bool) (int64, error) {
+	return ih.open(shardId, triId, isLarge, false)
+}
+
+// A read-only open doesn't write to disk, the file must exist.
+func (ih *IndexHeader) open(shardId int, triId string, isLarge bool, readOnly bool) (int64, error) {
 	ih.RWLock = new(sync.RWMutex)
 
 	ih.ShardId = shardId
@@ -99,14 +122,12 @@ func (ih *IndexHeader) New(shardId int, triId string, isLarge bool) int64 {
 	ih.RefMap = make(map[string]*IndexEntry)
 
 	ih.Empty = true
-	localfsPrefix := definition.BlobLocalPathPrefix
-	if localfsPrefix == "" {
-		localfsPrefix = "/var/lib/docker/.cache"
-	}
-	ih.LocalName = fmt.Sprintf("%s/idx_h_%d_%s.dat", localfsPrefix, shardId, triId)
+	ih.LocalName = fmt.Sprintf("%s/idx_h_%d_%s.dat", BlobDir(), shardId, triId)
 	info, err := os.Stat(ih.LocalName)
 
-	if os.IsNotExist(err) {
+	if os.IsNotExist(err) && readOnly {
+		return 0, notFoundError("load", "index file not on disk")
+	} else if os.IsNotExist(err) {
 		if isLarge {
 			state := K_index_header_large + K_state_base_ascii
 			return ih.create(uint8(state))
@@ -115,89 +136,89 @@ func (ih *IndexHeader) New(shardId int, triId string, isLarge bool) int64 {
 			return ih.create(uint8(state))
 		}
 	} else if err != nil {
-		ZapLogger.Fatal("IndexHeader", zap.Any("err", err))
+		return 0, ioError("stat", ih.LocalName, err)
+	}
+	size, err := ih.load(info.Size(), readOnly)
+	if err != nil {
+		return 0, err
 	}
-	ih.load(info.Size())
 	if len(ih.RefMap) > 0 {
 		ih.Empty = false
 	}
-	return info.Size()
+	return size, nil
 }
 
 // created with open state
-func (ih *IndexHeader) create(state uint8) int64 {
+func (ih *IndexHeader) create(state uint8) (int64, error) {
 	ZapLogger.Info("Index file doesn't exist, creating a new one",
 		zap.Any("file", ih.LocalName))
-	f, err := os.Create(ih.LocalName)
-	Check(err)
-	// Prepare encoded state bytes.
-	ih.Info.State = state
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, &ih.Info)
-
-	// Seek to offset 0 and flush state struct.
-	f.Seek(0, 0)
-	byteSize, err := f.Write(buf.Bytes())
-	Check(err)
-
-	otherSize, err := f.WriteAt([]byte("\n[\n]"), int64(len(buf.Bytes())))
-	Check(err)
-	f.Close()
+	size, err := createRecordFile(ih.LocalName, K_index_magic, state)
+	if err != nil {
+		return 0, err
+	}
 
 	// Better offload state to file before set in memory.
 	ih.Info = IndexBaseInfo{
 		State: K_index_header_open + K_state_base_ascii,
 	}
-	return int64(byteSize) + int64(otherSize)
+	return size, nil
 }
 
-// Hydrate IndexHeader by loading from local file
-func (ih *IndexHeader) load(size int64) {
+// Hydrate IndexHeader by loading from local file, returns the file size
+// once loaded. A legacy json file is migrated first, unless readOnly.
+func (ih *IndexHeader) load(size int64, readOnly bool) (int64, error) {
 	ZapLogger.Info("Index file already exists, loading state and blob indices from it",
 		zap.Any("file", ih.LocalName), zap.Any("size", size))
 	ih.RWLock.Lock()
 	defer ih.RWLock.Unlock()
 
-	idxBaseInfoLen := int64(unsafe.Sizeof(ih.Info))
-	stateBytes := make([]byte, idxBaseInfoLen)
-
-	// File already checked before Load() call.
-	f, _ := os.Open(ih.LocalName)
-	f.Read(stateBytes)
-
-	buf := bytes.NewReader(stateBytes)
-	err := binary.Read(buf, binary.LittleEndian, &ih.Info)
-	Check(err)
-
-	// 1st byte state byte, 2nd byte '\n', starting from '['
-	// Second parameter is used for setting path mode
-	f.Seek(int64(idxBaseInfoLen)+1, 0)
-	// Exclude the leading 2 bytes.
-	logBytes := make([]byte, size-idxBaseInfoLen-1)
-	// TODO: consider doing for loop iterative read.
-	_, err = f.Read(logBytes)
-	Check(err)
-
-	var ies []IndexEntry
-	err = json.Unmarshal([]byte(logBytes), &ies)
-	Check(err)
-
 	if ih.Entries.Len() != 0 || len(ih.RefMap) != 0 {
-		err = errors.New("loading loaded IndexHeader")
-		panic(err)
+		return 0, errors.New("loading loaded IndexHeader")
+	}
+	isRecord, err := isRecordFile(ih.LocalName, K_index_magic)
+	if err != nil {
+		return 0, err
 	}
-	for i := 0; i < len(ies); i++ {
+	if !isRecord && readOnly {
+		ih.Legacy = true
+		state, records, err := decodeLegacyIndex(ih.LocalName)
+		if err != nil {
+			return 0, err
+		}
+		ih.Info.State = state
+		ih.addEntries(records)
+		return size, nil
+	}
+	if !isRecord {
+		if err := migrateLegacyIndex(ih.LocalName); err != nil {
+			return 0, err
+		}
+	}
+	hdr, records, torn, err := readRecordFile(ih.LocalName, K_index_magic, K_index_entry_len, readOnly)
+	if err != nil {
+		return 0, err
+	}
+	if readOnly {
+		ih.TornBytes = torn
+	}
+	ih.Info.State = hdr.State
+	ih.addEntries(records)
+	return int64(K_record_file_header_len + len(records)*K_index_entry_len), nil
+}
+
+func (ih *IndexHeader) addEntries(records [][]byte) {
+	for _, rec := range records {
+		ie := decodeIndexEntry(rec)
 		// TODO: Use priority list sorted by offset instead.
 		// Append to list
-		ih.Entries.PushBack(ies[i])
+		ih.Entries.PushBack(ie)
 		// Store in map for lookup
-		ih.RefMap[ies[i].BlobId] = &ies[i]
+		ih.RefMap[ie.BlobId] = &ie
 	}
-
 }
 
 // TODO: Add fid as backward reference to the file it belongs.
-func (ih *IndexHeader) Put(blobId string, offset int64, size int64) (int64, error) {
+func (ih *IndexHeader) Put(blobId string, offset int64, size int64, checksum string) (int64, error) {
 	ih.RWLock.Lock()
 	defer ih.RWLock.Unlock()
 
@@ -209,8 +230,7 @@ func (ih *IndexHeader) Put(blobId string, offset int64, size int64) (int64, erro
 		BlobId:   blobId,
 		Offset:   offset,
 		Size:     size,
-		Checksum: "",
-		Fid:      "",
+		Checksum: checksum,
 	}
 
 	// If we store in memory first, reader could try to read binary with RLock
@@ -260,70 +280,33 @@ func (ih *IndexHeader) Delete(blobId string) (err error) {
 }
 
 func (ih *IndexHeader) flush(entry IndexEntry) (int64, error) {
-	f, err := os.OpenFile(ih.LocalName, os.O_WRONLY, 0755)
+	rec, err := entry.Serialize()
 	if err != nil {
 		return 0, err
 	}
-	defer f.Close()
-	f.Seek(-1, 2)
-
-	leading := make([]byte, 0)
-	if !ih.Empty {
-		leading = []byte(",\n")
-	}
-	serializeBytes := entry.Serialize()
-	paddingLen := K_index_entry_len - len(serializeBytes) - 2
-	var builder strings.Builder
-	for i := 0; i < paddingLen; i++ {
-		builder.WriteString("#")
-	}
-	entry.Padding = builder.String()
-	bytes := append(append(leading, entry.Serialize()...), ']')
-	// Persist
-	res, err := f.Write(bytes)
+	res, err := appendRecord(ih.LocalName, rec)
 	if err != nil {
 		return 0, err
 	}
-	if !ih.Empty {
-		if int64(res)-1 != K_index_entry_len {
-			ZapLogger.Fatal("index flush", zap.Any("datalen", int64(res)-1), zap.Any("size", K_index_entry_len))
-		}
-	} else {
-		if int64(res)-1 != K_index_entry_len-2 {
-			ZapLogger.Fatal("index flush", zap.Any("datalen", int64(res)-1), zap.Any("size", K_index_entry_len-2))
-		}
-	}
 	ih.Empty = false
-	return int64(res) - 1, nil
+	return res, nil
 }
 
 // Idempotent. Close the index list and the local file, manager will open
 // new headers for writes.
-func (ih IndexHeader) Close() {
+func (ih IndexHeader) Close() error {
 	ih.RWLock.Lock()
 	defer ih.RWLock.Unlock()
 	if ih.Info.State == K_index_header_closed+K_state_base_ascii {
 		ZapLogger.Info("File already closed", zap.Any("file", ih.LocalName))
-		return
+		return nil
 	}
 
-	// File already checked before Load() call.
-	f, err := os.OpenFile(ih.LocalName, os.O_WRONLY, 0755)
-	Check(err)
 	ih.Info.State = K_index_header_closed + K_state_base_ascii
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, &ih.Info)
-
-	// Go to beginning and write state
-	_, err = f.WriteAt(buf.Bytes(), 0)
-	Check(err)
+	if err := writeRecordFileState(ih.LocalName, ih.Info.State); err != nil {
+		return err
+	}
 
 	ZapLogger.Info("Closing the file", zap.Any("file", ih.LocalName))
-	f.Close()
-}
-
-func Check(err error) {
-	if err != nil {
-		panic(err)
-	}
+	return nil
 }
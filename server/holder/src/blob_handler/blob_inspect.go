@@ -0,0 +1,150 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package blob_handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Inspection of the triplets on disk, used by offline tools such as
+// riverpass-fsck. Nothing here needs a running PhyBH, and nothing writes to
+// disk unless asked to.
+
+// Load the triplets of the shard found on disk, see Triplet.Unrepaired for
+// read-only loads. Triplets failing to load are returned with their error
+// instead.
+func LoadTripletsOnDisk(shardId int, readOnly bool) ([]*Triplet, map[string]error, error) {
+	triIds, _, err := ScanLocalFS(shardId)
+	if err != nil {
+		return nil, nil, err
+	}
+	var tplts []*Triplet
+	failed := make(map[string]error)
+	for _, triId := range triIds {
+		tplt := new(Triplet)
+		if _, err := tplt.open(shardId, triId, false, readOnly); err != nil {
+			failed[triId] = err
+			continue
+		}
+		tplts = append(tplts, tplt)
+	}
+	return tplts, failed, nil
+}
+
+// Load 1 triplet of the shard, which must be on disk already.
+func LoadTripletOnDisk(shardId int, triId string, readOnly bool) (*Triplet, error) {
+	idxFilePath := fmt.Sprintf("%s/idx_h_%d_%s.dat", BlobDir(), shardId, triId)
+	if ok, _, err := PathExists(idxFilePath); err != nil {
+		return nil, ioError("stat", idxFilePath, err)
+	} else if !ok {
+		return nil, notFoundError("load", "triplet not on disk")
+	}
+	tplt := new(Triplet)
+	if _, err := tplt.open(shardId, triId, false, readOnly); err != nil {
+		return nil, err
+	}
+	return tplt, nil
+}
+
+// What a writable load of the triplet would repair, found by a read-only
+// one.
+func (tri *Triplet) Unrepaired() []string {
+	var found []string
+	if tri.IdxHeader.Legacy {
+		found = append(found, "index in legacy json format")
+	}
+	if tri.IdxHeader.TornBytes > 0 {
+		found = append(found, fmt.Sprintf("index has %d torn bytes", tri.IdxHeader.TornBytes))
+	}
+	if tri.MFHeader.Missing {
+		found = append(found, "manifest missing")
+	}
+	if tri.MFHeader.Legacy {
+		found = append(found, "manifest in legacy json format")
+	}
+	if tri.MFHeader.TornBytes > 0 {
+		found = append(found, fmt.Sprintf("manifest has %d torn bytes", tri.MFHeader.TornBytes))
+	}
+	return found
+}
+
+// State of the triplet as persisted in its index: open, closed or large.
+func (tri *Triplet) State() string {
+	switch tri.IdxHeader.Info.State {
+	case K_state_base_ascii + K_index_header_open:
+		return "open"
+	case K_state_base_ascii + K_index_header_closed:
+		return "closed"
+	case K_state_base_ascii + K_index_header_large:
+		return "large"
+	}
+	return "unknown"
+}
+
+// Open the blob of the triplet for streaming read.
+func (tri *Triplet) OpenBlob(blbId string) (*BlobReader, error) {
+	ptrIdx := tri.IdxHeader.Get(blbId)
+	if ptrIdx == nil {
+		ZapLogger.Info("Open failed, blob already deleted in tplt",
+			zap.Any("blobId", blbId), zap.Any("tpltId", tri.Id))
+		return nil, notFoundError("open", "blob already deleted in triplet")
+	}
+	return tri.BinHeader.OpenBlob(blbId, ptrIdx.Offset, ptrIdx.Checksum)
+}
+
+// Result of reading through the live blobs of a triplet.
+type ChecksumReport struct {
+	// Blobs whose content matched their checksum.
+	Verified int
+	// Blobs written before checksums existed, only read through.
+	Unverified int
+	// Blobs failing verification or which couldn't be read.
+	Corrupted []string
+}
+
+// Read every live blob of the triplet and verify its checksums.
+func (tri *Triplet) VerifyChecksums() *ChecksumReport {
+	report := new(ChecksumReport)
+	tri.IdxHeader.RWLock.RLock()
+	entries := make([]IndexEntry, 0, len(tri.IdxHeader.RefMap))
+	for _, entry := range tri.IdxHeader.RefMap {
+		entries = append(entries, *entry)
+	}
+	tri.IdxHeader.RWLock.RUnlock()
+	for _, entry := range entries {
+		err := verifyBlob(tri.BinHeader, entry)
+		if err != nil {
+			ZapLogger.Error("verify blob failed", zap.Any("tpltId", tri.Id),
+				zap.Any("blobId", entry.BlobId), zap.Any("err", err))
+			report.Corrupted = append(report.Corrupted, entry.BlobId)
+		} else if _, ok := ParseChecksum(entry.Checksum); ok {
+			report.Verified++
+		} else {
+			report.Unverified++
+		}
+	}
+	return report
+}
+
+func verifyBlob(bh *BinHeader, entry IndexEntry) error {
+	br, err := bh.OpenBlob(entry.BlobId, entry.Offset, entry.Checksum)
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+	n, err := io.Copy(io.Discard, io.NewSectionReader(br, 0, br.Size()))
+	if err != nil {
+		return err
+	}
+	if n != br.Size() {
+		return errors.New("blob read short")
+	}
+	return nil
+}
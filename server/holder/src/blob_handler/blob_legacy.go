@@ -0,0 +1,144 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package blob_handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Index and manifest files used to be json arrays of entries padded with
+// '#' to a fixed length, the index one preceded by its state byte. They're
+// migrated to the record format of blob_record.go the first time they're
+// loaded, read-only loads decode them in place.
+
+// Length of a padded legacy json entry, including the ",\n" separator.
+const K_legacy_index_entry_len = 252
+const K_legacy_mf_entry_len = 202
+
+type legacyIndexEntry struct {
+	BlobId   string
+	Offset   int64
+	Size     int64
+	Checksum string
+}
+
+type legacyMFEntry struct {
+	BlobId string
+	Action uint8
+}
+
+func migrateLegacyIndex(path string) error {
+	state, records, err := decodeLegacyIndex(path)
+	if err != nil {
+		return err
+	}
+	if _, err := rewriteRecordFile(path, K_index_magic, state, records); err != nil {
+		return err
+	}
+	ZapLogger.Info("Migrated legacy index file", zap.Any("file", path),
+		zap.Any("entries", len(records)))
+	return nil
+}
+
+// State and records of a legacy index file, the file is left as is.
+func decodeLegacyIndex(path string) (uint8, [][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, ioError("read", path, err)
+	}
+	if len(data) == 0 {
+		return 0, nil, corruptError("migrate", path, "empty legacy index")
+	}
+	state := data[0]
+	var records [][]byte
+	err = decodeLegacyArray(path, data[1:], K_legacy_index_entry_len, func(dec *json.Decoder) error {
+		var old legacyIndexEntry
+		if err := dec.Decode(&old); err != nil {
+			return err
+		}
+		entry := IndexEntry{BlobId: old.BlobId, Offset: old.Offset, Size: old.Size, Checksum: old.Checksum}
+		rec, err := entry.Serialize()
+		if err != nil {
+			return err
+		}
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return state, records, nil
+}
+
+func migrateLegacyManifest(path string) error {
+	records, err := decodeLegacyManifest(path)
+	if err != nil {
+		return err
+	}
+	if _, err := rewriteRecordFile(path, K_manifest_magic, 0, records); err != nil {
+		return err
+	}
+	ZapLogger.Info("Migrated legacy manifest file", zap.Any("file", path),
+		zap.Any("entries", len(records)))
+	return nil
+}
+
+// Records of a legacy manifest file, the file is left as is.
+func decodeLegacyManifest(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, ioError("read", path, err)
+	}
+	var records [][]byte
+	err = decodeLegacyArray(path, data, K_legacy_mf_entry_len, func(dec *json.Decoder) error {
+		var old legacyMFEntry
+		if err := dec.Decode(&old); err != nil {
+			return err
+		}
+		entry := MFEntry{BlobId: old.BlobId, Action: old.Action}
+		rec, err := entry.Serialize()
+		if err != nil {
+			return err
+		}
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Decode the entries of a legacy json array one by one. An entry torn by a
+// crash can only be the last one, so decoding stops without error if less
+// than 1 entry of data is left.
+func decodeLegacyArray(path string, data []byte, entryLen int,
+	decodeEntry func(dec *json.Decoder) error) error {
+	if len(bytes.TrimSpace(data)) == 0 {
+		// Crashed while creating the file.
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return corruptError("migrate", path, "legacy file isn't a json array")
+	}
+	for dec.More() {
+		offset := dec.InputOffset()
+		if err := decodeEntry(dec); err != nil {
+			if int64(len(data))-offset > int64(entryLen) {
+				return corruptError("migrate", path, err.Error())
+			}
+			ZapLogger.Warn("Dropping torn legacy entry", zap.Any("file", path),
+				zap.Any("offset", offset))
+			return nil
+		}
+	}
+	return nil
+}
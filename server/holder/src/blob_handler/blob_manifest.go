@@ -5,10 +5,8 @@
 package blob_handler
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
-	"strings"
 	"sync"
 
 	"github.com/common/definition"
@@ -20,13 +18,15 @@ import (
 const K_action_base_ascii = 65
 const K_action_put = 15
 const K_action_delete = 3
-const K_mf_entry_len = 202
+
+// Manifest record: blob id, action, 3 reserved bytes and CRC, see
+// blob_record.go.
+const K_mf_entry_len = definition.F_BLOBID_SIZE + 4 + K_record_crc_len
 
 // Analogy: action.
 type MFEntry struct {
-	BlobId  string
-	Action  uint8
-	Padding string
+	BlobId string
+	Action uint8
 }
 
 // Analogy: log.
@@ -46,6 +46,12 @@ type MFHeader struct {
 
 	// Currently only storing deletion log, for initialization.
 	deletionLog map[string]uint8
+
+	// Left in place by a read-only load: the file is missing, it's in the
+	// legacy json format, the bytes of a torn tail record.
+	Missing   bool
+	Legacy    bool
+	TornBytes int64
 }
 
 // TODO: use index to wrap indexHeader, 1 index can contain
@@ -57,7 +63,12 @@ type MFHeader struct {
 // }
 
 // shardId is the holder instance id.
-func (mfh *MFHeader) New(shardId int, triId string) int64 {
+func (mfh *MFHeader) New(shardId int, triId string) (int64, error) {
+	return mfh.open(shardId, triId, false)
+}
+
+// A read-only open doesn't write to disk, a missing file loads empty.
+func (mfh *MFHeader) open(shardId int, triId string, readOnly bool) (int64, error) {
 	mfh.RWLock = new(sync.RWMutex)
 
 	mfh.Empty = true
@@ -66,21 +77,18 @@ func (mfh *MFHeader) New(shardId int, triId string) int64 {
 	// Maybe not need to be map. Leave for future purpose.
 	mfh.deletionLog = make(map[string]uint8)
 	fileName := fmt.Sprintf("mf_h_%d_%s.dat", shardId, triId)
-
-	localfsPrefix := definition.BlobLocalPathPrefix
-	if localfsPrefix == "" {
-		localfsPrefix = "/var/lib/docker/.cache"
-	}
-	mfh.LocalName = fmt.Sprintf("%s/%s", localfsPrefix, fileName)
+	mfh.LocalName = fmt.Sprintf("%s/%s", BlobDir(), fileName)
 
 	info, err := os.Stat(mfh.LocalName)
-	if os.IsNotExist(err) {
+	if os.IsNotExist(err) && readOnly {
+		mfh.Missing = true
+		return 0, nil
+	} else if os.IsNotExist(err) {
 		return mfh.create()
 	} else if err != nil {
-		ZapLogger.Fatal("MFHeader New", zap.Any("err", err))
+		return 0, ioError("stat", mfh.LocalName, err)
 	}
-	mfh.load(info.Size())
-	return info.Size()
+	return mfh.load(info.Size(), readOnly)
 }
 
 func (mfh *MFHeader) GetDeletionLog() map[string]uint8 {
@@ -93,7 +101,9 @@ func (mfh *MFHeader) ClearDeletionLog() {
 	}
 }
 
-func (ih *MFHeader) load(size int64) {
+// Returns the file size once loaded. A legacy json file is migrated first,
+// unless readOnly.
+func (ih *MFHeader) load(size int64, readOnly bool) (int64, error) {
 	fmt.Printf(
 		"[INFO] File(%s) already exists, size(%d bytes), loading "+
 			"blob actions from it.\n",
@@ -101,43 +111,52 @@ func (ih *MFHeader) load(size int64) {
 	ih.RWLock.Lock()
 	defer ih.RWLock.Unlock()
 
-	// File already checked before Load() call.
-	f, _ := os.Open(ih.LocalName)
-
-	logBytes := make([]byte, size)
-	// TODO: consider doing for loop iterative read.
-	_, err := f.Read(logBytes)
-	Check(err)
-
-	var ies []MFEntry
-	err = json.Unmarshal([]byte(logBytes), &ies)
-	Check(err)
+	isRecord, err := isRecordFile(ih.LocalName, K_manifest_magic)
+	if err != nil {
+		return 0, err
+	}
+	var records [][]byte
+	if !isRecord && readOnly {
+		ih.Legacy = true
+		if records, err = decodeLegacyManifest(ih.LocalName); err != nil {
+			return 0, err
+		}
+	} else {
+		if !isRecord {
+			if err := migrateLegacyManifest(ih.LocalName); err != nil {
+				return 0, err
+			}
+		}
+		var torn int64
+		_, records, torn, err = readRecordFile(ih.LocalName, K_manifest_magic, K_mf_entry_len, readOnly)
+		if err != nil {
+			return 0, err
+		}
+		if readOnly {
+			ih.TornBytes = torn
+		}
+	}
 
-	for i := 0; i < len(ies); i++ {
-		blbId := ies[i].BlobId
-		if ies[i].Action == K_action_delete+K_action_base_ascii {
-			ih.deletionLog[blbId] = ies[i].Action
-			ZapLogger.Info("Emplaced deletion log in-memory", zap.Any("blobId", blbId))
+	for _, rec := range records {
+		entry := decodeMFEntry(rec)
+		if entry.Action == K_action_delete+K_action_base_ascii {
+			ih.deletionLog[entry.BlobId] = entry.Action
+			ZapLogger.Info("Emplaced deletion log in-memory", zap.Any("blobId", entry.BlobId))
 		}
 	}
 	ZapLogger.Info("", zap.Any("manifest file", ih.LocalName),
-		zap.Any("entry num", len(ies)))
-	if len(ies) > 0 {
+		zap.Any("entry num", len(records)))
+	if len(records) > 0 {
 		ih.Empty = false
 	}
+	return int64(K_record_file_header_len + len(records)*K_mf_entry_len), nil
 }
 
 // created with open state
-func (mfh *MFHeader) create() int64 {
+func (mfh *MFHeader) create() (int64, error) {
 	ZapLogger.Info("Manifest file doesn't exist, creating a new one",
 		zap.Any("file", mfh.LocalName))
-	f, err := os.Create(mfh.LocalName)
-	Check(err)
-
-	res, err := f.WriteAt([]byte("[\n]"), 0)
-	Check(err)
-	f.Close()
-	return int64(res)
+	return createRecordFile(mfh.LocalName, K_manifest_magic, 0)
 }
 
 func (mfh *MFHeader) Put(blobId string) (int64, error) {
@@ -163,47 +182,32 @@ func (mfh *MFHeader) Delete(blobId string) (int64, error) {
 }
 
 func (mfh *MFHeader) flush(entry *MFEntry) (int64, error) {
-	f, err := os.OpenFile(mfh.LocalName, os.O_WRONLY, 0755)
+	rec, err := entry.Serialize()
 	if err != nil {
 		return 0, err
 	}
-	defer f.Close()
-	f.Seek(-1, 2)
-
-	leading := make([]byte, 0)
-	if !mfh.Empty {
-		leading = []byte(",\n")
-	}
-	serializeBytes := entry.Serialize()
-	paddingLen := K_mf_entry_len - len(serializeBytes) - 2
-	var builder strings.Builder
-	for i := 0; i < paddingLen; i++ {
-		builder.WriteString("#")
-	}
-	entry.Padding = builder.String()
-	bytes := append(append(leading, entry.Serialize()...), ']')
-	// Persist
-	res, err := f.Write(bytes)
+	res, err := appendRecord(mfh.LocalName, rec)
 	if err != nil {
 		return 0, err
 	}
-	if !mfh.Empty {
-		if int64(res)-1 != K_mf_entry_len {
-			ZapLogger.Fatal("mf flush", zap.Any("datalen", int64(res)-1), zap.Any("size", K_mf_entry_len))
-		}
-	} else {
-		if int64(res)-1 != K_mf_entry_len-2 {
-			ZapLogger.Fatal("mf flush", zap.Any("datalen", int64(res)-1), zap.Any("size", K_mf_entry_len-2))
-		}
-	}
 	mfh.Empty = false
-	return int64(res) - 1, nil
+	return res, nil
 }
 
-func (entry *MFEntry) Serialize() []byte {
-	jsonbyte, err := json.Marshal(entry)
-	if err != nil {
-		panic(err)
+func (entry *MFEntry) Serialize() ([]byte, error) {
+	rec := make([]byte, K_mf_entry_len)
+	if err := putFixedString(rec[:definition.F_BLOBID_SIZE], entry.BlobId); err != nil {
+		return nil, err
+	}
+	rec[definition.F_BLOBID_SIZE] = entry.Action
+	sealRecord(rec)
+	return rec, nil
+}
+
+// Decode a record checked by readRecordFile.
+func decodeMFEntry(rec []byte) MFEntry {
+	return MFEntry{
+		BlobId: getFixedString(rec[:definition.F_BLOBID_SIZE]),
+		Action: rec[definition.F_BLOBID_SIZE],
 	}
-	return jsonbyte
 }
@@ -0,0 +1,145 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package blob_handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// A triplet whose files disagree with each other is quarantined: it's
+// dropped from the shard and its files are moved aside to the quarantine
+// directory for inspection, instead of taking the whole node down. Files
+// pointing at it then miss in cache and are fetched again from origin.
+// A single blob failing its checksum doesn't quarantine its triplet, only
+// its file is refetched. Offline, riverpass-fsck quarantines single blobs
+// too: the blob is dropped from its triplet and its bytes copied aside.
+
+const K_quarantine_dir = "quarantine"
+
+// Prefixes of the names of the files of a triplet.
+var kTripletFileKinds = []string{"binary", "idx_h", "mf_h"}
+
+func quarantineDir() string {
+	return fmt.Sprintf("%s/%s", BlobDir(), K_quarantine_dir)
+}
+
+// Drop the triplet from the shard and move its files to quarantine.
+func (pbh *PhyBH) QuarantineTriplet(tpltId string, reason error) {
+	ZapLogger.Error("Quarantining triplet", zap.Any("tpltId", tpltId), zap.Any("reason", reason))
+	wasOpen := pbh.OpenTplt.Peek(tpltId) != nil
+	pbh.OpenTplt.DeleteFromCache(tpltId)
+	pbh.ClosedTplt.DeleteFromCache(tpltId)
+	pbh.LargeObjTplt.DeleteFromCache(tpltId)
+	atomic.AddInt64(&pbh.totalBytes, ^int64(QuarantineTripletFiles(pbh.ShardId, tpltId)-1))
+	if wasOpen && pbh.OpenTplt.size == 0 {
+		// Writes pick among open triplets, keep 1 open.
+		tplt, size, err := pbh.openNewTplt(false)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&pbh.totalBytes, size)
+		pbh.OpenTplt.Put(tplt.Id, tplt)
+	}
+}
+
+// Quarantine the triplet of a blob if err tells its files are corrupt.
+// Checksum mismatches are left to the caller.
+func (pbh *PhyBH) checkCorrupted(tpltId string, err error) {
+	if errors.Is(err, ErrCorrupt) && !errors.Is(err, ErrChecksumMismatch) {
+		pbh.QuarantineTriplet(tpltId, err)
+	}
+}
+
+// Move the files of the triplet of the shard to the quarantine directory,
+// returns the bytes moved. They're deleted if they can't be moved.
+func QuarantineTripletFiles(shardId int, tpltId string) int64 {
+	dir := quarantineDir()
+	mkErr := os.MkdirAll(dir, 0755)
+	if mkErr != nil {
+		ZapLogger.Error("create quarantine dir failed", zap.Any("err", mkErr))
+	}
+	res := int64(0)
+	for _, kind := range kTripletFileKinds {
+		name := fmt.Sprintf("%s_%d_%s.dat", kind, shardId, tpltId)
+		path := fmt.Sprintf("%s/%s", BlobDir(), name)
+		if mkErr != nil {
+			res += RemoveFile(path)
+			continue
+		}
+		ok, size, _ := PathExists(path)
+		if !ok {
+			continue
+		}
+		err := os.Rename(path, fmt.Sprintf("%s/%s", dir, name))
+		if err != nil {
+			ZapLogger.Error("quarantine file failed", zap.Any("file", name), zap.Any("err", err))
+			continue
+		}
+		res += size
+	}
+	return res
+}
+
+// Drop the blob from its triplet on disk, which no running holder may have
+// loaded: its deletion is logged in the manifest, after its encoded bytes
+// are copied to the quarantine directory. Returns the bytes copied.
+func QuarantineBlob(shardId int, tpltId string, blbId string) (int64, error) {
+	tplt, err := LoadTripletOnDisk(shardId, tpltId, false)
+	if err != nil {
+		return 0, err
+	}
+	entry := tplt.IdxHeader.Get(blbId)
+	if entry == nil {
+		return 0, notFoundError("quarantine", "blob already deleted in triplet")
+	}
+	dir := quarantineDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, ioError("mkdir", dir, err)
+	}
+	src, err := os.Open(tplt.BinHeader.LocalName)
+	if err != nil {
+		return 0, ioError("open", tplt.BinHeader.LocalName, err)
+	}
+	defer src.Close()
+	path := fmt.Sprintf("%s/blob_%d_%s_%s.dat", dir, shardId, tpltId, blbId)
+	dst, err := os.Create(path)
+	if err != nil {
+		return 0, ioError("create", path, err)
+	}
+	n, err := io.Copy(dst, io.NewSectionReader(src, entry.Offset, entry.Size))
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err != nil {
+		return 0, ioError("copy", path, err)
+	}
+	if _, err := tplt.MFHeader.Delete(blbId); err != nil {
+		return n, err
+	}
+	return n, tplt.IdxHeader.Delete(blbId)
+}
+
+// Whether any file of the triplet of the shard is on disk.
+func TripletOnDisk(shardId int, tpltId string) (bool, error) {
+	for _, kind := range kTripletFileKinds {
+		path := fmt.Sprintf("%s/%s_%d_%s.dat", BlobDir(), kind, shardId, tpltId)
+		ok, _, err := PathExists(path)
+		if err != nil {
+			return false, ioError("stat", path, err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,215 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package blob_handler
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/common/definition"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Length of the record header written by Encode: blob id and content size.
+const K_blob_header_len = definition.F_BLOBID_SIZE + 8
+
+// Length of the chunk header written by Encode4K: blob id, remaining size
+// and checksum.
+const K_chunk_header_len = definition.F_BLOBID_SIZE + 8 + definition.F_CHECKSUM_SIZE
+
+// BlobReader exposes the content of one blob in a binary file as an
+// io.ReaderAt, so callers can stream it with io.SectionReader instead of
+// loading the whole blob into memory. For 4K aligned blobs the chunk
+// headers are skipped on the fly.
+// Binary files are append only, so reading without holding the BinHeader
+// lock is safe. An opened reader keeps working even if the triplet is
+// purged meanwhile, since the file descriptor is still held.
+// Content is verified on the fly: every 4K chunk read is checked against
+// its chunk checksum, and the whole blob checksum is checked once the
+// content is read through from the start. ErrChecksumMismatch is returned
+// instead of a bad chunk, but without 4K alignment it's only returned for
+// the last bytes, the ones before were returned already.
+type BlobReader struct {
+	f *os.File
+	// Offset of the blob record in the binary file.
+	base    int64
+	size    int64
+	align4K bool
+	token   string
+
+	mtx sync.Mutex
+	// Checksum of the whole content, from the index entry.
+	checksum string
+	// Checksum of the content read so far from the start.
+	sum       uint32
+	summedOff int64
+	corrupted bool
+}
+
+func (br *BlobReader) Size() int64 {
+	return br.size
+}
+
+func (br *BlobReader) Close() error {
+	return br.f.Close()
+}
+
+// Token of the blob, set when opened through PhyBH.Open.
+func (br *BlobReader) Token() string {
+	return br.token
+}
+
+// Whether a checksum mismatch was met while reading.
+func (br *BlobReader) Corrupted() bool {
+	br.mtx.Lock()
+	defer br.mtx.Unlock()
+	return br.corrupted
+}
+
+func (br *BlobReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= br.size {
+		return 0, io.EOF
+	}
+	var err error
+	if int64(len(p)) > br.size-off {
+		p = p[:br.size-off]
+		err = io.EOF
+	}
+	var n int
+	var rErr error
+	if br.align4K {
+		n, rErr = br.readAt4K(p, off)
+	} else {
+		n, rErr = br.f.ReadAt(p, br.base+K_blob_header_len+off)
+		rErr = ioError("read", br.f.Name(), rErr)
+	}
+	if rErr == nil {
+		rErr = br.updateSum(p[:n], off)
+	}
+	if rErr == ErrChecksumMismatch {
+		return 0, rErr
+	} else if rErr != nil {
+		return n, rErr
+	}
+	return n, err
+}
+
+// Whole chunks are read to verify their checksum, the requested part is
+// copied into p.
+func (br *BlobReader) readAt4K(p []byte, off int64) (int, error) {
+	chunk := make([]byte, 4*definition.K_KiB)
+	read := 0
+	for read < len(p) {
+		cur := off + int64(read)
+		chunkIdx := cur / definition.F_CONTENT_SIZE
+		inChunk := cur % definition.F_CONTENT_SIZE
+		cntLen := br.size - chunkIdx*definition.F_CONTENT_SIZE
+		if cntLen > definition.F_CONTENT_SIZE {
+			cntLen = definition.F_CONTENT_SIZE
+		}
+		pos := br.base + chunkIdx*4*definition.K_KiB
+		if _, err := br.f.ReadAt(chunk[:K_chunk_header_len+cntLen], pos); err != nil {
+			return read, ioError("read", br.f.Name(), err)
+		}
+		content := chunk[K_chunk_header_len : K_chunk_header_len+cntLen]
+		if err := verifyChunkChecksum(
+			chunk[definition.F_BLOBID_SIZE+8:K_chunk_header_len], content); err != nil {
+			br.markCorrupted(chunkIdx)
+			return read, err
+		}
+		read += copy(p[read:], content[inChunk:])
+	}
+	return read, nil
+}
+
+// Extend the checksum of the content read so far if p continues it, and
+// verify it once the whole content is read.
+func (br *BlobReader) updateSum(p []byte, off int64) error {
+	want, ok := ParseChecksum(br.checksum)
+	if !ok {
+		return nil
+	}
+	br.mtx.Lock()
+	defer br.mtx.Unlock()
+	if off != br.summedOff || len(p) == 0 {
+		return nil
+	}
+	br.sum = crc32.Update(br.sum, crc32cTable, p)
+	br.summedOff += int64(len(p))
+	if br.summedOff == br.size && br.sum != want {
+		br.corrupted = true
+		ZapLogger.Error("blob checksum mismatch", zap.Any("file", br.f.Name()),
+			zap.Any("offset", br.base), zap.Any("token", br.token))
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+func (br *BlobReader) markCorrupted(chunkIdx int64) {
+	br.mtx.Lock()
+	br.corrupted = true
+	br.mtx.Unlock()
+	ZapLogger.Error("chunk checksum mismatch", zap.Any("file", br.f.Name()),
+		zap.Any("offset", br.base), zap.Any("chunk", chunkIdx), zap.Any("token", br.token))
+}
+
+// Open a reader on the blob at offset. The blob id stored on disk is
+// checked against blbId before the reader is returned. checksum is the one
+// of the index entry of the blob.
+func (bh *BinHeader) OpenBlob(blbId string, offset int64, checksum string) (*BlobReader, error) {
+	f, err := os.OpenFile(bh.LocalName, os.O_RDONLY, 0755)
+	if err != nil {
+		return nil, ioError("open", bh.LocalName, err)
+	}
+	br, err := openBlobAt(f, blbId, offset, checksum)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return br, nil
+}
+
+func openBlobAt(f *os.File, blbId string, offset int64, checksum string) (*BlobReader, error) {
+	idAndSize := make([]byte, K_blob_header_len)
+	if _, err := f.ReadAt(idAndSize, offset); err != nil {
+		return nil, ioError("read", f.Name(), err)
+	}
+	idOnDisk, err := DecodeName(idAndSize[:definition.F_BLOBID_SIZE])
+	if err != nil {
+		return nil, err
+	}
+	if blbId != idOnDisk {
+		return nil, corruptError("open blob", f.Name(), "blob name mismatch")
+	}
+	size, err := DecodeSize(idAndSize[definition.F_BLOBID_SIZE:K_blob_header_len])
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, ioError("stat", f.Name(), err)
+	}
+	recordLen := K_blob_header_len + size
+	if definition.F_4K_Align {
+		recordLen = (size + definition.F_CONTENT_SIZE - 1) / definition.F_CONTENT_SIZE * 4 * definition.K_KiB
+	}
+	if size < 0 || offset+recordLen > info.Size() {
+		return nil, corruptError("open blob", f.Name(), "blob size out of file")
+	}
+	return &BlobReader{
+		f:        f,
+		base:     offset,
+		size:     size,
+		align4K:  definition.F_4K_Align,
+		checksum: checksum,
+	}, nil
+}
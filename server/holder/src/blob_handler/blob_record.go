@@ -0,0 +1,217 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package blob_handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Index and manifest files share 1 layout: a fixed size file header, then
+// fixed size records appended one after another. The header carries a magic
+// number telling the file kind and the format version, index files also
+// keep their state in it. Each record ends with the CRC32C of its other
+// bytes, so a record torn by a crash is told apart from a valid one. Only
+// the last record can be torn, since records are only ever appended, it's
+// dropped on load. A bad record followed by others means the file is
+// corrupt.
+
+const K_record_format_version = 1
+const K_record_file_header_len = 16
+const K_record_crc_len = 4
+
+// Offset of the state byte in the file header.
+const K_record_state_offset = 6
+
+var K_index_magic = [4]byte{'R', 'P', 'I', 'X'}
+var K_manifest_magic = [4]byte{'R', 'P', 'M', 'F'}
+
+type RecordFileHeader struct {
+	Magic    [4]byte
+	Version  uint16
+	State    uint8
+	Reserved [9]byte
+}
+
+// Whether the file starts with magic, false for files of the legacy json
+// format.
+func isRecordFile(path string, magic [4]byte) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, ioError("open", path, err)
+	}
+	defer f.Close()
+	var head [4]byte
+	if _, err := io.ReadFull(f, head[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, ioError("read", path, err)
+	}
+	return head == magic, nil
+}
+
+func encodeRecordFileHeader(magic [4]byte, state uint8) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &RecordFileHeader{
+		Magic:   magic,
+		Version: K_record_format_version,
+		State:   state,
+	})
+	return buf.Bytes()
+}
+
+// Create the file with an empty record list, returns the bytes written.
+func createRecordFile(path string, magic [4]byte, state uint8) (int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return 0, ioError("create", path, err)
+	}
+	defer f.Close()
+	n, err := f.Write(encodeRecordFileHeader(magic, state))
+	if err != nil {
+		return 0, ioError("write", path, err)
+	}
+	return int64(n), nil
+}
+
+// Atomically replace the file by one holding records, used to migrate
+// legacy files.
+func rewriteRecordFile(path string, magic [4]byte, state uint8, records [][]byte) (int64, error) {
+	data := encodeRecordFileHeader(magic, state)
+	for _, rec := range records {
+		data = append(data, rec...)
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return 0, ioError("create", tmp, err)
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return 0, ioError("write", tmp, err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return 0, ioError("rename", path, err)
+	}
+	return int64(len(data)), syncDir(filepath.Dir(path))
+}
+
+// Read the header and the records of the file, with the bytes of a torn
+// last record. The torn record is truncated from the file unless readOnly.
+func readRecordFile(path string, magic [4]byte, recLen int, readOnly bool) (RecordFileHeader, [][]byte, int64, error) {
+	var hdr RecordFileHeader
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return hdr, nil, 0, ioError("read", path, err)
+	}
+	if len(data) < K_record_file_header_len {
+		return hdr, nil, 0, corruptError("load", path, "file header truncated")
+	}
+	binary.Read(bytes.NewReader(data[:K_record_file_header_len]), binary.LittleEndian, &hdr)
+	if hdr.Magic != magic {
+		return hdr, nil, 0, corruptError("load", path, "bad magic number")
+	}
+	if hdr.Version != K_record_format_version {
+		return hdr, nil, 0, corruptError("load", path,
+			fmt.Sprintf("unsupported format version %d", hdr.Version))
+	}
+	body := data[K_record_file_header_len:]
+	var records [][]byte
+	for len(body) >= recLen {
+		rec := body[:recLen]
+		body = body[recLen:]
+		if !recordValid(rec) {
+			if len(body) > 0 {
+				return hdr, nil, 0, corruptError("load", path,
+					fmt.Sprintf("bad record %d", len(records)))
+			}
+			// Torn by a crash while appended.
+			body = rec
+			break
+		}
+		records = append(records, rec)
+	}
+	if len(body) > 0 && !readOnly {
+		valid := int64(K_record_file_header_len + len(records)*recLen)
+		ZapLogger.Warn("Dropping torn tail record", zap.Any("file", path),
+			zap.Any("bytes", len(body)))
+		if err := os.Truncate(path, valid); err != nil {
+			return hdr, nil, 0, ioError("truncate", path, err)
+		}
+	}
+	return hdr, records, int64(len(body)), nil
+}
+
+// Append rec to the file. A partially written record is truncated, so the
+// next appends stay aligned.
+func appendRecord(path string, rec []byte) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0755)
+	if err != nil {
+		return 0, ioError("open", path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, ioError("stat", path, err)
+	}
+	n, err := f.Write(rec)
+	if err != nil {
+		if tErr := f.Truncate(info.Size()); tErr != nil {
+			ZapLogger.Error("f.Truncate", zap.Any("file", path), zap.Any("err", tErr))
+		}
+		return 0, ioError("write", path, err)
+	}
+	return int64(n), nil
+}
+
+// Overwrite the state byte of the file header.
+func writeRecordFileState(path string, state uint8) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0755)
+	if err != nil {
+		return ioError("open", path, err)
+	}
+	defer f.Close()
+	if _, err = f.WriteAt([]byte{state}, K_record_state_offset); err != nil {
+		return ioError("write", path, err)
+	}
+	return nil
+}
+
+// Fill the trailing CRC of rec.
+func sealRecord(rec []byte) {
+	body := rec[:len(rec)-K_record_crc_len]
+	binary.LittleEndian.PutUint32(rec[len(body):], crc32.Checksum(body, crc32cTable))
+}
+
+func recordValid(rec []byte) bool {
+	body := rec[:len(rec)-K_record_crc_len]
+	return binary.LittleEndian.Uint32(rec[len(body):]) == crc32.Checksum(body, crc32cTable)
+}
+
+// Copy s into a fixed size field padded with zeros.
+func putFixedString(field []byte, s string) error {
+	if len(s) > len(field) {
+		return fmt.Errorf("%q longer than %d bytes", s, len(field))
+	}
+	copy(field, s)
+	return nil
+}
+
+func getFixedString(field []byte) string {
+	return string(bytes.TrimRight(field, "\x00"))
+}
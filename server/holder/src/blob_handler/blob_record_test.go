@@ -0,0 +1,203 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package blob_handler
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/common/definition"
+)
+
+func writeIndexFile(t *testing.T, path string, state uint8, entries []IndexEntry) {
+	if _, err := createRecordFile(path, K_index_magic, state); err != nil {
+		t.Fatal(err)
+	}
+	for _, ie := range entries {
+		rec, err := ie.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := appendRecord(path, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var kIndexEntries = []IndexEntry{
+	{BlobId: "b1", Offset: 0, Size: 5, Checksum: "crc32c:00000001"},
+	{BlobId: "b2", Offset: 4096, Size: 1 << 40, Checksum: ""},
+	{BlobId: "b3", Offset: 1<<40 + 4096, Size: 7, Checksum: "crc32c:ffffffff"},
+}
+
+func TestIndexRecordRoundTrip(t *testing.T) {
+	path := t.TempDir() + "/idx"
+	state := uint8(K_index_header_closed + K_state_base_ascii)
+	writeIndexFile(t, path, state, kIndexEntries)
+
+	hdr, records, _, err := readRecordFile(path, K_index_magic, K_index_entry_len, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.State != state || hdr.Version != K_record_format_version {
+		t.Fatalf("header %+v", hdr)
+	}
+	if len(records) != len(kIndexEntries) {
+		t.Fatalf("%d records", len(records))
+	}
+	for i, rec := range records {
+		if got := decodeIndexEntry(rec); got != kIndexEntries[i] {
+			t.Errorf("record %d: got %+v", i, got)
+		}
+	}
+	// An index file isn't read as a manifest.
+	if _, _, _, err := readRecordFile(path, K_manifest_magic, K_mf_entry_len, false); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("read with the manifest magic returned %v", err)
+	}
+}
+
+func TestManifestRecordRoundTrip(t *testing.T) {
+	path := t.TempDir() + "/mf"
+	if _, err := createRecordFile(path, K_manifest_magic, 0); err != nil {
+		t.Fatal(err)
+	}
+	entries := []MFEntry{
+		{BlobId: "b1", Action: K_action_put + K_action_base_ascii},
+		{BlobId: "b1", Action: K_action_delete + K_action_base_ascii},
+	}
+	for _, entry := range entries {
+		rec, _ := entry.Serialize()
+		appendRecord(path, rec)
+	}
+	_, records, _, err := readRecordFile(path, K_manifest_magic, K_mf_entry_len, false)
+	if err != nil || len(records) != len(entries) {
+		t.Fatalf("%d records, %v", len(records), err)
+	}
+	for i, rec := range records {
+		if got := decodeMFEntry(rec); got != entries[i] {
+			t.Errorf("record %d: got %+v", i, got)
+		}
+	}
+}
+
+func TestSerializeTooLong(t *testing.T) {
+	long := string(make([]byte, definition.F_BLOBID_SIZE+1))
+	if _, err := (&IndexEntry{BlobId: long}).Serialize(); err == nil {
+		t.Error("index entry with a too long blob id serialized")
+	}
+	if _, err := (&MFEntry{BlobId: long}).Serialize(); err == nil {
+		t.Error("manifest entry with a too long blob id serialized")
+	}
+}
+
+// A bad record followed by others isn't a torn append, the file is corrupt.
+func TestBadRecordCrc(t *testing.T) {
+	path := t.TempDir() + "/idx"
+	writeIndexFile(t, path, K_index_header_open+K_state_base_ascii, kIndexEntries)
+	data, _ := os.ReadFile(path)
+	data[K_record_file_header_len+K_index_entry_len+3] ^= 1
+	os.WriteFile(path, data, 0644)
+
+	if _, _, _, err := readRecordFile(path, K_index_magic, K_index_entry_len, false); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("got %v", err)
+	}
+	// The file is left as is for inspection.
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Fatalf("file size changed to %d", info.Size())
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	valid := int64(K_record_file_header_len + len(kIndexEntries)*K_index_entry_len)
+	lastRec, _ := kIndexEntries[0].Serialize()
+	lastRec[5] ^= 1
+	for name, tail := range map[string][]byte{
+		"partial record": lastRec[:K_index_entry_len/2],
+		"bad last crc":   lastRec,
+	} {
+		path := t.TempDir() + "/idx"
+		writeIndexFile(t, path, K_index_header_open+K_state_base_ascii, kIndexEntries)
+		f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		f.Write(tail)
+		f.Close()
+
+		// A read-only read reports the torn record and leaves it.
+		_, records, torn, err := readRecordFile(path, K_index_magic, K_index_entry_len, true)
+		if err != nil || len(records) != len(kIndexEntries) || torn != int64(len(tail)) {
+			t.Fatalf("%s: read-only %d records, %d torn bytes, %v", name, len(records), torn, err)
+		}
+		if info, _ := os.Stat(path); info.Size() != valid+int64(len(tail)) {
+			t.Fatalf("%s: read-only read truncated the file to %d bytes", name, info.Size())
+		}
+
+		_, records, _, err = readRecordFile(path, K_index_magic, K_index_entry_len, false)
+		if err != nil || len(records) != len(kIndexEntries) {
+			t.Fatalf("%s: %d records, %v", name, len(records), err)
+		}
+		if info, _ := os.Stat(path); info.Size() != valid {
+			t.Fatalf("%s: file is %d bytes, want %d", name, info.Size(), valid)
+		}
+	}
+}
+
+// Legacy json files are rewritten as record files on load, with entries and
+// state kept and a torn trailing entry dropped.
+func TestLegacyMigration(t *testing.T) {
+	setupBlobDir(t, false)
+	dir := definition.BlobLocalPathPrefix
+	e1 := `{"BlobId":"b1","Offset":0,"Size":5,"Checksum":"","Fid":"","Padding":"###"}`
+	e2 := `{"BlobId":"b2","Offset":141,"Size":7,"Checksum":"crc32c:0000000a","Fid":"","Padding":"#"}`
+	idx := "3\n[\n" + e1 + ",\n" + e2 + ",\n{\"BlobId\":\"b3\",\"Off"
+	os.WriteFile(dir+"/idx_h_0_leg.dat", []byte(idx), 0644)
+	mf := "[\n" + `{"BlobId":"b1","Action":80,"Padding":"##"}` + ",\n" +
+		`{"BlobId":"b1","Action":68,"Padding":"##"}` + "]"
+	os.WriteFile(dir+"/mf_h_0_leg.dat", []byte(mf), 0644)
+
+	// A read-only load decodes the legacy files in place.
+	var inspected Triplet
+	if _, err := inspected.open(0, "leg", false, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(inspected.IdxHeader.RefMap) != 1 || len(inspected.Unrepaired()) != 2 {
+		t.Fatalf("read-only load: entries %v, unrepaired %v",
+			inspected.IdxHeader.RefMap, inspected.Unrepaired())
+	}
+	if data, _ := os.ReadFile(dir + "/idx_h_0_leg.dat"); string(data) != idx {
+		t.Fatal("read-only load rewrote the legacy index")
+	}
+
+	var tri Triplet
+	if _, err := tri.New(0, "leg", false); err != nil {
+		t.Fatal(err)
+	}
+	ih := tri.IdxHeader
+	if ih.Info.State != K_index_header_closed+K_state_base_ascii {
+		t.Fatalf("state %d", ih.Info.State)
+	}
+	// b1 is deleted by the migrated manifest.
+	if len(ih.RefMap) != 1 || ih.RefMap["b2"] == nil || ih.RefMap["b2"].Offset != 141 ||
+		ih.RefMap["b2"].Size != 7 || ih.RefMap["b2"].Checksum != "crc32c:0000000a" {
+		t.Fatalf("entries %v", ih.RefMap)
+	}
+	for path, magic := range map[string][4]byte{
+		dir + "/idx_h_0_leg.dat": K_index_magic,
+		dir + "/mf_h_0_leg.dat":  K_manifest_magic,
+	} {
+		if ok, err := isRecordFile(path, magic); !ok || err != nil {
+			t.Fatalf("%s not migrated, %v", path, err)
+		}
+	}
+
+	// Loading the migrated files again gives the same content.
+	var again Triplet
+	if _, err := again.New(0, "leg", false); err != nil {
+		t.Fatal(err)
+	}
+	if again.IdxHeader.Info.State != ih.Info.State || len(again.IdxHeader.RefMap) != 1 ||
+		*again.IdxHeader.RefMap["b2"] != *ih.RefMap["b2"] {
+		t.Fatalf("reloaded entries %v", again.IdxHeader.RefMap)
+	}
+}
@@ -0,0 +1,140 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package blob_handler
+
+import (
+	"encoding/binary"
+	"os"
+
+	"github.com/common/definition"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Blobs are written in binary, then index, then manifest. A crash in
+// between leaves trailing binary bytes no index entry points at, or an
+// index entry whose binary record never made it to disk. Reconcile walks
+// the records of the binary file and checks the index entries against
+// them: entries without a matching record are dropped through the
+// manifest, and bytes after the last indexed record are truncated.
+
+// What Reconcile found in a triplet, and repaired unless dry run.
+type RecoveryReport struct {
+	TripletId string
+	// Records walked in the binary file.
+	Records int
+	// Bytes after the last record an index entry points at.
+	TornBytes int64
+	// Live blobs whose index entry has no matching binary record.
+	DroppedBlobs []string
+}
+
+func (r *RecoveryReport) Clean() bool {
+	return r.TornBytes == 0 && len(r.DroppedBlobs) == 0
+}
+
+type binRecord struct {
+	blobId string
+	end    int64
+}
+
+// Check the triplet and, if repair is set, fix what's found. Must not run
+// while the triplet takes writes.
+func (tri *Triplet) Reconcile(repair bool) (*RecoveryReport, error) {
+	report := &RecoveryReport{TripletId: tri.Id}
+	bh := tri.BinHeader
+	records, fileSize, err := walkBinary(bh.LocalName, definition.F_4K_Align)
+	if err != nil {
+		return nil, err
+	}
+	report.Records = len(records)
+
+	keepEnd := int64(0)
+	tri.IdxHeader.RWLock.RLock()
+	for e := tri.IdxHeader.Entries.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(IndexEntry)
+		rec, ok := records[entry.Offset]
+		if definition.F_4K_Align && entry.Size == 0 && entry.Offset <= fileSize {
+			// Empty blobs take no chunk.
+			rec, ok = binRecord{blobId: entry.BlobId, end: entry.Offset}, true
+		}
+		// Size of an index entry is the one of the whole record.
+		if ok && rec.blobId == entry.BlobId && rec.end-entry.Offset == entry.Size {
+			if rec.end > keepEnd {
+				keepEnd = rec.end
+			}
+			continue
+		}
+		if _, live := tri.IdxHeader.RefMap[entry.BlobId]; live {
+			report.DroppedBlobs = append(report.DroppedBlobs, entry.BlobId)
+		}
+	}
+	tri.IdxHeader.RWLock.RUnlock()
+	report.TornBytes = fileSize - keepEnd
+
+	if !repair || report.Clean() {
+		return report, nil
+	}
+	for _, blbId := range report.DroppedBlobs {
+		if _, err := tri.MFHeader.Delete(blbId); err != nil {
+			return report, err
+		}
+		tri.IdxHeader.Delete(blbId)
+	}
+	if report.TornBytes > 0 {
+		if err := os.Truncate(bh.LocalName, keepEnd); err != nil {
+			return report, ioError("truncate", bh.LocalName, err)
+		}
+		bh.RWLock.Lock()
+		bh.CurOff = keepEnd
+		bh.RWLock.Unlock()
+	}
+	ZapLogger.Warn("Repaired triplet", zap.Any("report", report))
+	return report, nil
+}
+
+// Records of the binary file by offset, with the file size. Walking stops
+// at the first record which doesn't fit in the file. Only record headers
+// are read, bodies are skipped.
+func walkBinary(path string, align4K bool) (map[int64]binRecord, int64, error) {
+	records := make(map[int64]binRecord)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return records, 0, nil
+	} else if err != nil {
+		return nil, 0, ioError("open", path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, ioError("stat", path, err)
+	}
+	fileSize := info.Size()
+	hdrLen := int64(K_blob_header_len)
+	if align4K {
+		hdrLen = K_chunk_header_len
+	}
+	header := make([]byte, hdrLen)
+	for pos := int64(0); pos+hdrLen <= fileSize; {
+		if _, err := f.ReadAt(header, pos); err != nil {
+			return nil, 0, ioError("read", path, err)
+		}
+		size := int64(binary.LittleEndian.Uint64(header[definition.F_BLOBID_SIZE:]))
+		recLen := hdrLen + size
+		if align4K {
+			recLen = (size + definition.F_CONTENT_SIZE - 1) / definition.F_CONTENT_SIZE * 4 * definition.K_KiB
+		}
+		if size < 0 || recLen <= 0 || pos+recLen > fileSize {
+			break
+		}
+		blbId, err := DecodeName(header[:definition.F_BLOBID_SIZE])
+		if err != nil {
+			return nil, 0, err
+		}
+		records[pos] = binRecord{blobId: blbId, end: pos + recLen}
+		pos += recLen
+	}
+	return records, fileSize, nil
+}
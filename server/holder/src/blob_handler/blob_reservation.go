@@ -0,0 +1,97 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package blob_handler
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/common/definition"
+	"github.com/common/util"
+)
+
+// Space for a blob can be reserved before its content is at hand, e.g. when
+// a download starts, so the put doesn't fail once the download is done.
+// Reserved bytes count as used by other puts, the put of the reserved blob
+// consumes the reservation.
+
+// Bytes the put of a blob of dataLen takes at most.
+func PutAllocSize(dataLen int64) int64 {
+	return K_empty_idxmf_file_overhead + util.GetPayloadSize(dataLen) +
+		K_index_entry_len + K_mf_entry_len + 4
+}
+
+// Reserve the space to put a blob of dataLen, returns the reserved bytes
+// to pass to PutStreamReserved, or to Unreserve if the blob is never put.
+func (pbh *PhyBH) Reserve(dataLen int64) (int64, error) {
+	size := PutAllocSize(dataLen)
+	pbh.mtx.Lock()
+	defer pbh.mtx.Unlock()
+	if size > pbh.capacity()-atomic.LoadInt64(&pbh.totalBytes)-
+		atomic.LoadInt64(&pbh.reservedBytes) {
+		return 0, &StorageError{Kind: ErrNoSpace, Op: "reserve", Err: errors.New("cache full")}
+	}
+	atomic.AddInt64(&pbh.reservedBytes, size)
+	return size, nil
+}
+
+func (pbh *PhyBH) Unreserve(size int64) {
+	atomic.AddInt64(&pbh.reservedBytes, -size)
+}
+
+func (pbh *PhyBH) GetReservedBytes() int64 {
+	return atomic.LoadInt64(&pbh.reservedBytes)
+}
+
+// Pinned bytes, up to F_pin_max_size, are given room on top of
+// F_CACHE_MAX_SIZE.
+func (pbh *PhyBH) SetPinnedBytes(size int64) {
+	if size > definition.F_pin_max_size {
+		size = definition.F_pin_max_size
+	}
+	atomic.StoreInt64(&pbh.pinnedBytes, size)
+}
+
+// Pinned bytes not counted against F_CACHE_MAX_SIZE.
+func (pbh *PhyBH) GetPinnedBytes() int64 {
+	return atomic.LoadInt64(&pbh.pinnedBytes)
+}
+
+func (pbh *PhyBH) capacity() int64 {
+	return definition.F_CACHE_MAX_SIZE + atomic.LoadInt64(&pbh.pinnedBytes)
+}
+
+// Bytes purges and compactions would reclaim once the blobs of the pending
+// tokens are deleted too: all the bytes of closed and large triplets left
+// without live blob, and the dead bytes of closed triplets whose live ratio
+// is below liveRatio. Dead bytes of other triplets stay on disk.
+func (pbh *PhyBH) GetReclaimableBytes(liveRatio float64, pending []string) int64 {
+	deleted := make(map[string]int64)
+	for _, token := range pending {
+		tplt, blbId, err := pbh.peek(token)
+		if err != nil {
+			continue
+		}
+		if entry := tplt.IdxHeader.Get(blbId); entry != nil {
+			deleted[tplt.Id] += entry.Size
+		}
+	}
+	reclaimable := int64(0)
+	for _, lru := range []*LruCache{pbh.ClosedTplt, pbh.LargeObjTplt} {
+		closed := lru == pbh.ClosedTplt
+		lru.dict.Range(func(k, v interface{}) bool {
+			tplt := v.(*Node).value
+			live, total := tplt.LiveBytes()
+			live -= deleted[tplt.Id]
+			if live <= 0 {
+				reclaimable += total
+			} else if closed && float64(live) < liveRatio*float64(total) {
+				reclaimable += total - live
+			}
+			return true
+		})
+	}
+	return reclaimable
+}
@@ -46,6 +46,14 @@ func (c *LruCache) Get(key string) *Triplet {
 	return nil
 }
 
+// Same as Get, but doesn't refresh the recency of key.
+func (c *LruCache) Peek(key string) *Triplet {
+	if v, ok := c.dict.Load(key); ok {
+		return v.(*Node).value
+	}
+	return nil
+}
+
 func (c *LruCache) Put(key string, value *Triplet) {
 	c.rwLock.Lock()
 	defer c.rwLock.Unlock()
@@ -117,5 +125,6 @@ func (c *LruCache) DeleteFromCache(key string) {
 	if ok {
 		c.deleteNode(node.(*Node))
 		c.dict.Delete(node.(*Node).key)
+		c.size--
 	}
 }
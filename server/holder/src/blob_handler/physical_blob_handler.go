@@ -8,9 +8,11 @@
 package blob_handler
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	dbops "holder/src/db_ops"
+	"io"
 	"math/rand"
 	"os"
 	"regexp"
@@ -25,7 +27,7 @@ import (
 )
 
 // A triplet is a combination of 3 harnessed blob operation headers.
-const K_empty_idxmf_file_overhead = 8
+const K_empty_idxmf_file_overhead = 2 * K_record_file_header_len
 
 type Triplet struct {
 	Id        string
@@ -57,28 +59,55 @@ type PhyBH struct {
 	LargeObjTplt *LruCache
 	// Protected by atomic operations.
 	totalBytes int64
+	// Bytes reserved for puts to come, see Reserve.
+	reservedBytes int64
+	// Bytes of pinned objects not counted against F_CACHE_MAX_SIZE.
+	pinnedBytes int64
 	// mtx is used by totalBytes
 	mtx sync.Mutex
-	FDb *dbops.DBOpsFile
+	FDb dbops.MetadataStore
 }
 
-func (tri *Triplet) New(shardId int, triId string, isLarge bool) int64 {
+func (tri *Triplet) New(shardId int, triId string, isLarge bool) (int64, error) {
+	return tri.open(shardId, triId, isLarge, false)
+}
+
+// A read-only open doesn't write to disk, for inspection. What a writable
+// one would repair is left in place and flagged in the headers.
+func (tri *Triplet) open(shardId int, triId string, isLarge bool, readOnly bool) (int64, error) {
 	var idx IndexHeader
 	var mf MFHeader
 	var bin BinHeader
-	idxSize := idx.New(shardId, triId, isLarge)
-	mfSize := mf.New(shardId, triId)
-	binSize := bin.New(shardId, triId)
+	idxSize, err := idx.open(shardId, triId, isLarge, readOnly)
+	if err != nil {
+		return 0, err
+	}
+	mfSize, err := mf.open(shardId, triId, readOnly)
+	if err != nil {
+		return 0, err
+	}
+	binSize, err := bin.New(shardId, triId)
+	if err != nil {
+		return 0, err
+	}
+
+	// Blobs deleted after they were indexed are only logged in manifest.
+	for blbId := range mf.GetDeletionLog() {
+		idx.Delete(blbId)
+	}
+	mf.ClearDeletionLog()
 
 	tri.Id = triId
 	tri.IdxHeader = &idx
 	tri.MFHeader = &mf
 	tri.BinHeader = &bin
-	return idxSize + mfSize + binSize
+	return idxSize + mfSize + binSize, nil
 }
 
-// TODO: Add idx file and bin file cross check loading logic.
-func (pbh *PhyBH) New(shardId int, fdb *dbops.DBOpsFile) {
+// Each loaded triplet is reconciled with its binary file, see
+// blob_recovery.go. Triplets failing to load are quarantined, an error is only returned if
+// the shard can't serve at all.
+func (pbh *PhyBH) New(shardId int, fdb dbops.MetadataStore) error {
 	pbh.ShardId = shardId
 	pbh.OpenTplt = new(LruCache)
 	pbh.OpenTplt.New()
@@ -93,15 +122,19 @@ func (pbh *PhyBH) New(shardId int, fdb *dbops.DBOpsFile) {
 	var totalSize int64
 	ZapLogger.Info("ScanLocalFS")
 	var triIdsInDisk []string
-	triIdsInDisk, totalSize = ScanLocalFS(shardId)
+	triIdsInDisk, totalSize, err := ScanLocalFS(shardId)
+	if err != nil {
+		return err
+	}
 
 	pbh.FDb = fdb
 
-	ZapLogger.Info("DELETE PENDING FILES IN DB")
-	pbh.FDb.DeleteAllPendingFileInDB()
-	triIds, err := pbh.FDb.ListTripleIdOfAllFiles()
+	// Pending files are left to the cache manager, which resumes the
+	// downloads it can and deletes the others.
+	triIds, err = pbh.FDb.ListTripleIdOfAllFiles()
 	if err != nil {
-		ZapLogger.Fatal("ListTripleIdOfAllFiles", zap.Any("err", err))
+		ZapLogger.Error("ListTripleIdOfAllFiles", zap.Any("err", err))
+		return err
 	}
 	setDB := make(map[string]struct{})
 	for _, v := range triIds {
@@ -111,7 +144,7 @@ func (pbh *PhyBH) New(shardId int, fdb *dbops.DBOpsFile) {
 	for _, v := range triIdsInDisk {
 		if _, ok := setDB[v]; !ok {
 			ZapLogger.Info("DELETE ORPHAN FILE ON DISK", zap.Any("tripId", v))
-			orphanSize += DeleteTripletFilesOnDisk(v)
+			orphanSize += DeleteTripletFilesOnDisk(shardId, v)
 		}
 	}
 	ZapLogger.Info("PhyBH.New",
@@ -127,10 +160,23 @@ func (pbh *PhyBH) New(shardId int, fdb *dbops.DBOpsFile) {
 		zap.Any("totalBytes", pbh.totalBytes))
 	cnt := 0
 	for _, triId := range triIds {
+		// Owner of the pending files kept for resuming.
+		if triId == "" {
+			continue
+		}
 		var triplet Triplet
 		// Although the third arg of LargeObjTplt should be true,but in this loop it is ok.
 		// Because the file has already on disk. we only need to read triplet.IdxHeader.Info.State.
-		triplet.New(pbh.ShardId, triId, false)
+		if _, err := triplet.New(pbh.ShardId, triId, false); err != nil {
+			pbh.QuarantineTriplet(triId, err)
+			continue
+		}
+		sizeBefore := GetTripletSizeOnDisk(pbh.ShardId, triId)
+		if _, err := triplet.Reconcile(true); err != nil {
+			pbh.QuarantineTriplet(triId, err)
+			continue
+		}
+		pbh.totalBytes += GetTripletSizeOnDisk(pbh.ShardId, triId) - sizeBefore
 		switch triplet.IdxHeader.Info.State {
 		case K_state_base_ascii + K_index_header_open:
 			cnt++
@@ -141,15 +187,16 @@ func (pbh *PhyBH) New(shardId int, fdb *dbops.DBOpsFile) {
 			ZapLogger.Info("RECREAT LARGE FILE ON DISK", zap.Any("tripId", triId))
 			pbh.LargeObjTplt.Put(triId, &triplet)
 		default:
-			{
-				err := errors.New("indexHeader state unrecognized")
-				panic(err)
-			}
+			pbh.QuarantineTriplet(triId, corruptError("load", triplet.IdxHeader.LocalName,
+				fmt.Sprintf("indexHeader state %d unrecognized", triplet.IdxHeader.Info.State)))
 		}
 	}
 	// Create a new triplet for taking write.
 	if cnt == 0 {
-		ptrTplt, tmpSize := pbh.openNewTplt(false)
+		ptrTplt, tmpSize, err := pbh.openNewTplt(false)
+		if err != nil {
+			return err
+		}
 		pbh.totalBytes += tmpSize
 		pbh.OpenTplt.Put((*ptrTplt).Id, ptrTplt)
 	}
@@ -159,23 +206,13 @@ func (pbh *PhyBH) New(shardId int, fdb *dbops.DBOpsFile) {
 		zap.Any("totalBytes", pbh.totalBytes))
 	// init goroutine for size checking and closing.
 	go pbh.LoopHotSwap()
+	return nil
 }
 
 func (pbh *PhyBH) PurgeTriplet(tpltId string) {
 	pbh.ClosedTplt.DeleteFromCache(tpltId)
 	pbh.LargeObjTplt.DeleteFromCache(tpltId)
-	atomic.AddInt64(&pbh.totalBytes, ^int64(DeleteTripletFilesOnDisk(tpltId)-1))
-}
-
-// TODO: always purge small object tplt first. Need to change to more
-// wise logic.
-func (pbh *PhyBH) GetTailNameForEvict() (string, error) {
-	if pbh.ClosedTplt.size > 0 {
-		return pbh.ClosedTplt.GetCurTailNameForEvict(), nil
-	} else if pbh.LargeObjTplt.size > 0 {
-		return pbh.LargeObjTplt.GetCurTailNameForEvict(), nil
-	}
-	return "", errors.New("no tail to purge")
+	atomic.AddInt64(&pbh.totalBytes, ^int64(DeleteTripletFilesOnDisk(pbh.ShardId, tpltId)-1))
 }
 
 // Stateful:
@@ -184,15 +221,30 @@ func (pbh *PhyBH) GetTailNameForEvict() (string, error) {
 // * if service crashes between bin-flush and idx-flush, data not persisted.
 // * if service crashes after bin-flush and idx-flush, data persisted.
 // * it's ok mf file doesn't contain put record.
+// * binary bytes no idx entry points at are truncated at startup, idx
+// * entries pointing past the binary are dropped.
 func (pbh *PhyBH) Put(blbId string, data []byte) (token string, err error) {
-	payloadSize := util.GetPayloadSize(len(data))
-	maxAllocSize := K_empty_idxmf_file_overhead + payloadSize +
-		K_index_entry_len + K_mf_entry_len + 4
+	return pbh.PutStream(blbId, bytes.NewReader(data), int64(len(data)))
+}
+
+// Same as Put, but the blob content of size bytes is streamed from r into
+// the binary file instead of being passed in memory.
+func (pbh *PhyBH) PutStream(blbId string, r io.Reader, dataLen int64) (token string, err error) {
+	return pbh.PutStreamReserved(blbId, r, dataLen, 0)
+}
+
+// Same as PutStream, with reserved bytes returned by Reserve. The
+// reservation is consumed whether the put succeeds or not.
+func (pbh *PhyBH) PutStreamReserved(blbId string, r io.Reader, dataLen int64, reserved int64) (token string, err error) {
+	payloadSize := util.GetPayloadSize(dataLen)
+	maxAllocSize := PutAllocSize(dataLen)
 
 	pbh.mtx.Lock()
-	if maxAllocSize > definition.F_CACHE_MAX_SIZE-atomic.LoadInt64(&pbh.totalBytes) {
+	atomic.AddInt64(&pbh.reservedBytes, -reserved)
+	if maxAllocSize > pbh.capacity()-atomic.LoadInt64(&pbh.totalBytes)-
+		atomic.LoadInt64(&pbh.reservedBytes) {
 		pbh.mtx.Unlock()
-		return "", errors.New("cache full")
+		return "", &StorageError{Kind: ErrNoSpace, Op: "put", Err: errors.New("cache full")}
 	}
 	atomic.AddInt64(&pbh.totalBytes, maxAllocSize)
 	pbh.mtx.Unlock()
@@ -202,7 +254,11 @@ func (pbh *PhyBH) Put(blbId string, data []byte) (token string, err error) {
 	var increaseBytes int64 = 0
 	if payloadSize > definition.K_triplet_large_threshold {
 		var size int64
-		triplet, size = pbh.openNewTplt(true)
+		triplet, size, err = pbh.openNewTplt(true)
+		if err != nil {
+			atomic.AddInt64(&pbh.totalBytes, ^int64(maxAllocSize-1))
+			return "", err
+		}
 		increaseBytes += size
 		pbh.LargeObjTplt.Put(triplet.Id, triplet)
 		ZapLogger.Info("Large triplet has created", zap.Any("id", triplet.Id))
@@ -230,15 +286,19 @@ func (pbh *PhyBH) Put(blbId string, data []byte) (token string, err error) {
 	}
 	// TODO: Error handling for each step.
 	// step 1: Persist in binary. Flush must succeed.
-	offset, size := triplet.BinHeader.Put(blbId, data)
-	if size != payloadSize {
+	offset, size, checksum, binErr := triplet.BinHeader.PutStream(blbId, r, dataLen)
+	if binErr != nil || size != payloadSize {
 		atomic.AddInt64(&pbh.totalBytes, ^int64(maxAllocSize-1))
 		ZapLogger.Error("BinHeader put error",
-			zap.Any("datalen", payloadSize), zap.Any("size", size))
+			zap.Any("datalen", payloadSize), zap.Any("size", size),
+			zap.Any("err", binErr))
+		if binErr != nil {
+			return "", binErr
+		}
 		return "", errors.New("BinHeader put error")
 	}
 	// step 2: Store the idx in memory; Flush must succeed
-	idxBytes, idxErr := triplet.IdxHeader.Put(blbId, offset, size)
+	idxBytes, idxErr := triplet.IdxHeader.Put(blbId, offset, size, checksum)
 	if idxErr != nil {
 		atomic.AddInt64(&pbh.totalBytes, ^int64(maxAllocSize-1))
 		ZapLogger.Error("idx.Put", zap.Any("err", idxErr))
@@ -269,12 +329,13 @@ func (pbh *PhyBH) Get(token string) (data []byte, err error) {
 		if triplet := pbh.LargeObjTplt.Get(tpltId); triplet != nil {
 			hostTplt = triplet
 		} else {
-			err := errors.New("blob not exist in this blob handler shard")
-			return nil, err
+			return nil, notFoundError("get", "blob not exist in this blob handler shard")
 		}
 
 		if ptrIdx := hostTplt.IdxHeader.Get(blbId); ptrIdx != nil {
-			return hostTplt.BinHeader.Get(blbId, ptrIdx.Offset), nil
+			data, err := hostTplt.BinHeader.Get(blbId, ptrIdx.Offset, ptrIdx.Checksum)
+			pbh.checkCorrupted(hostTplt.Id, err)
+			return data, err
 		}
 		ZapLogger.Info("Get failed, blob already deleted in tplt",
 			zap.Any("blobId", blbId), zap.Any("tpltId", tpltId))
@@ -289,12 +350,13 @@ func (pbh *PhyBH) Get(token string) (data []byte, err error) {
 		} else if triplet := pbh.ClosedTplt.Get(tpltId); triplet != nil {
 			hostTplt = triplet
 		} else {
-			err := errors.New("blob not exist in this blob handler shard")
-			return nil, err
+			return nil, notFoundError("get", "blob not exist in this blob handler shard")
 		}
 
 		if ptrIdx := hostTplt.IdxHeader.Get(blbId); ptrIdx != nil {
-			return hostTplt.BinHeader.Get(blbId, ptrIdx.Offset), nil
+			data, err := hostTplt.BinHeader.Get(blbId, ptrIdx.Offset, ptrIdx.Checksum)
+			pbh.checkCorrupted(hostTplt.Id, err)
+			return data, err
 		}
 		ZapLogger.Info("Get failed, blob already deleted in tplt",
 			zap.Any("blobId", blbId), zap.Any("tpltId", tpltId))
@@ -302,17 +364,94 @@ func (pbh *PhyBH) Get(token string) (data []byte, err error) {
 	return data, nil
 }
 
-func (pbh *PhyBH) openNewTplt(isLarge bool) (*Triplet, int64) {
+// Open the blob referenced by token for streaming read. Unlike Get, the
+// content is not loaded in memory, caller must close the returned reader.
+func (pbh *PhyBH) Open(token string) (*BlobReader, error) {
+	hostTplt, blbId, err := pbh.locate(token)
+	if err != nil {
+		return nil, err
+	}
+	br, err := hostTplt.OpenBlob(blbId)
+	if err != nil {
+		pbh.checkCorrupted(hostTplt.Id, err)
+		return nil, err
+	}
+	br.token = token
+	return br, nil
+}
+
+// Find the triplet hosting the blob of token, returns it with the blob id.
+func (pbh *PhyBH) locate(token string) (*Triplet, string, error) {
+	if len(token) > len(definition.K_LARGE_OBJECT_PREFIX) &&
+		token[:len(definition.K_LARGE_OBJECT_PREFIX)] == definition.K_LARGE_OBJECT_PREFIX {
+		token = token[len(definition.K_LARGE_OBJECT_PREFIX):]
+		tpltId := util.GetTripletIdFromToken(token)
+		if triplet := pbh.LargeObjTplt.Get(tpltId); triplet != nil {
+			return triplet, util.GetBlobIdFromToken(token), nil
+		}
+	} else {
+		tpltId := util.GetTripletIdFromToken(token)
+		if triplet := pbh.OpenTplt.Get(tpltId); triplet != nil {
+			return triplet, util.GetBlobIdFromToken(token), nil
+		} else if triplet := pbh.ClosedTplt.Get(tpltId); triplet != nil {
+			return triplet, util.GetBlobIdFromToken(token), nil
+		}
+	}
+	return nil, "", notFoundError("locate", "blob not exist in this blob handler shard")
+}
+
+// Whether the triplet is held by this shard, without refreshing its recency.
+func (pbh *PhyBH) HasTriplet(tpltId string) bool {
+	return pbh.OpenTplt.Peek(tpltId) != nil ||
+		pbh.ClosedTplt.Peek(tpltId) != nil ||
+		pbh.LargeObjTplt.Peek(tpltId) != nil
+}
+
+func (pbh *PhyBH) IsOpenTriplet(tpltId string) bool {
+	return pbh.OpenTplt.Peek(tpltId) != nil
+}
+
+// Whether the blob of token is indexed by its triplet, without refreshing
+// the triplet recency.
+func (pbh *PhyBH) HasBlob(token string) bool {
+	if len(token) > len(definition.K_LARGE_OBJECT_PREFIX) &&
+		token[:len(definition.K_LARGE_OBJECT_PREFIX)] == definition.K_LARGE_OBJECT_PREFIX {
+		token = token[len(definition.K_LARGE_OBJECT_PREFIX):]
+	}
+	tpltId := util.GetTripletIdFromToken(token)
+	triplet := pbh.OpenTplt.Peek(tpltId)
+	if triplet == nil {
+		triplet = pbh.ClosedTplt.Peek(tpltId)
+	}
+	if triplet == nil {
+		triplet = pbh.LargeObjTplt.Peek(tpltId)
+	}
+	if triplet == nil {
+		return false
+	}
+	triplet.IdxHeader.RWLock.RLock()
+	defer triplet.IdxHeader.RWLock.RUnlock()
+	_, exist := triplet.IdxHeader.RefMap[util.GetBlobIdFromToken(token)]
+	return exist
+}
+
+func (pbh *PhyBH) openNewTplt(isLarge bool) (*Triplet, int64, error) {
 	uuid := util.GenerateTriId()
 	var newTplt Triplet
-	size := newTplt.New(pbh.ShardId, uuid, isLarge)
+	size, err := newTplt.New(pbh.ShardId, uuid, isLarge)
+	if err != nil {
+		ZapLogger.Error("open new triplet failed", zap.Any("id", uuid), zap.Any("err", err))
+		// Files created so far are dropped, no file points at them.
+		DeleteTripletFilesOnDisk(pbh.ShardId, uuid)
+		return nil, 0, err
+	}
 
 	ZapLogger.Info("Shard-Openning new triplet for taking writes",
 		zap.Any("shard", pbh.ShardId), zap.Any("id", newTplt.Id),
 		zap.Any("idx file", newTplt.IdxHeader.LocalName),
 		zap.Any("mf file", newTplt.MFHeader.LocalName),
 		zap.Any("bin file", newTplt.BinHeader.LocalName))
-	return &newTplt, size
+	return &newTplt, size, nil
 }
 
 // For debug
@@ -342,8 +481,12 @@ func (pbh *PhyBH) LoopHotSwap() {
 		dict := pbh.OpenTplt.dict
 		dict.Range(func(k, v interface{}) bool {
 			if v.(*Node).value.BinHeader.CurOff > definition.K_triplet_closing_threshold {
+				tplt, size, err := pbh.openNewTplt(false)
+				if err != nil {
+					// Keep taking writes in the full one, retried next round.
+					return true
+				}
 				idToClose = append(idToClose, k.(string))
-				tplt, size := pbh.openNewTplt(false)
 				atomic.AddInt64(&pbh.totalBytes, size)
 				newOpens = append(newOpens, tplt)
 			}
@@ -358,9 +501,14 @@ func (pbh *PhyBH) LoopHotSwap() {
 			// IdxHeader is the only one need to close, manifest may grow,
 			// binary follows IdxHeader's state.
 			ZapLogger.Info("close id", zap.Any("id", id))
-			pbh.ClosedTplt.Put(id, pbh.OpenTplt.Get(id))
-			pbh.OpenTplt.Get(id).IdxHeader.Close()
+			tplt := pbh.OpenTplt.Get(id)
+			pbh.ClosedTplt.Put(id, tplt)
 			pbh.OpenTplt.DeleteFromCache(id)
+			if err := tplt.IdxHeader.Close(); err != nil {
+				// The closed state is only lost on disk, the triplet comes
+				// back open after a restart.
+				ZapLogger.Error("close index failed", zap.Any("id", id), zap.Any("err", err))
+			}
 		}
 	}
 }
@@ -372,15 +520,19 @@ func (pbh *PhyBH) LoopHotSwap() {
 // to OSS or COS, but leaving the info in memory.
 // func (pbh *PhyBH) LoopMigration() {}
 
-func ScanLocalFS(shardId int) ([]string, int64) {
-	localfsPrefix := definition.BlobLocalPathPrefix
-	if localfsPrefix == "" {
-		localfsPrefix = "/var/lib/docker/.cache"
-	}
-	localFSDir := localfsPrefix
+// Directory of the triplet files, oss_blob_local_path_prefix or the
+// default persistence path.
+func BlobDir() string {
+	return definition.BlobDir()
+}
+
+func ScanLocalFS(shardId int) ([]string, int64, error) {
+	localFSDir := BlobDir()
 	totalSize := int64(0)
 	files, err := os.ReadDir(localFSDir)
-	Check(err)
+	if err != nil {
+		return nil, 0, ioError("scan", localFSDir, err)
+	}
 	regStr := fmt.Sprintf("idx_h_%d+_(.+).dat", shardId)
 	reIdxFile := regexp.MustCompile(regStr)
 	var triIds []string
@@ -393,12 +545,17 @@ func ScanLocalFS(shardId int) ([]string, int64) {
 		}
 	}
 	for i := 0; i < len(triIds); i++ {
-		binaryFilePath := fmt.Sprintf("%s/binary_%d_%s.dat", localfsPrefix, shardId, triIds[i])
-		idxFilePath := fmt.Sprintf("%s/idx_h_%d_%s.dat", localfsPrefix, shardId, triIds[i])
-		mfFilePath := fmt.Sprintf("%s/mf_h_%d_%s.dat", localfsPrefix, shardId, triIds[i])
-		totalSize += GetFileSize(binaryFilePath) + GetFileSize(idxFilePath) + GetFileSize(mfFilePath)
+		totalSize += GetTripletSizeOnDisk(shardId, triIds[i])
 	}
-	return triIds, totalSize
+	return triIds, totalSize, nil
+}
+
+func GetTripletSizeOnDisk(shardId int, triId string) int64 {
+	localfsPrefix := BlobDir()
+	binaryFilePath := fmt.Sprintf("%s/binary_%d_%s.dat", localfsPrefix, shardId, triId)
+	idxFilePath := fmt.Sprintf("%s/idx_h_%d_%s.dat", localfsPrefix, shardId, triId)
+	mfFilePath := fmt.Sprintf("%s/mf_h_%d_%s.dat", localfsPrefix, shardId, triId)
+	return GetFileSize(binaryFilePath) + GetFileSize(idxFilePath) + GetFileSize(mfFilePath)
 }
 
 func GetFileSize(path string) int64 {
@@ -428,13 +585,9 @@ func RemoveFile(path string) int64 {
 	return res
 }
 
-func DeleteTripletFilesOnDisk(tripleId string) int64 {
-	localfsPrefix := definition.BlobLocalPathPrefix
-	if localfsPrefix == "" {
-		localfsPrefix = "/var/lib/docker/.cache"
-	}
+func DeleteTripletFilesOnDisk(shardId int, tripleId string) int64 {
+	localfsPrefix := BlobDir()
 	res := int64(0)
-	shardId := dbops.ShardID
 	binName := fmt.Sprintf("%s/binary_%d_%s.dat", localfsPrefix, shardId, tripleId)
 	idxName := fmt.Sprintf("%s/idx_h_%d_%s.dat", localfsPrefix, shardId, tripleId)
 	mfName := fmt.Sprintf("%s/mf_h_%d_%s.dat", localfsPrefix, shardId, tripleId)
@@ -0,0 +1,121 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/common/definition"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Admission decides whether a missed object gets cached, so 1-hit wonders
+// such as a dataset sweep don't evict the hot objects. Pinned objects are
+// always admitted. Admission rules are checked first, then the object must
+// have missed F_admission_min_hits times within the window, then the size
+// limit. Misses are counted by a counting Bloom filter: no url is kept, a
+// few urls may share counters and get admitted earlier. Counters are kept
+// for 2 windows, the older one is dropped every window.
+
+var ErrNotAdmitted = errors.New("object not admitted into cache")
+
+// Counters per window, 1 byte each.
+const kAdmissionCounters = 1 << 20
+const kAdmissionHashes = 4
+
+type AdmissionFilter struct {
+	mtx       sync.Mutex
+	cur       []uint8
+	prev      []uint8
+	rotatedAt time.Time
+}
+
+func (af *AdmissionFilter) New() {
+	af.cur = make([]uint8, kAdmissionCounters)
+	af.prev = make([]uint8, kAdmissionCounters)
+	af.rotatedAt = time.Now()
+}
+
+// Counter indexes of url, by double hashing.
+func admissionIndexes(url string) [kAdmissionHashes]uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(url))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	var idx [kAdmissionHashes]uint32
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) % kAdmissionCounters
+	}
+	return idx
+}
+
+// Count a miss of url, returns the misses of url within the last 1 to 2
+// windows.
+func (af *AdmissionFilter) Record(url string) int64 {
+	af.mtx.Lock()
+	defer af.mtx.Unlock()
+	window := time.Duration(definition.F_admission_window_sec) * time.Second
+	if window > 0 && time.Since(af.rotatedAt) >= window {
+		if time.Since(af.rotatedAt) >= 2*window {
+			// No miss for 2 windows, both are outdated.
+			for i := range af.cur {
+				af.cur[i] = 0
+			}
+		}
+		af.cur, af.prev = af.prev, af.cur
+		for i := range af.cur {
+			af.cur[i] = 0
+		}
+		af.rotatedAt = time.Now()
+	}
+	minCur, minPrev := uint8(255), uint8(255)
+	for _, i := range admissionIndexes(url) {
+		if af.cur[i] < 255 {
+			af.cur[i]++
+		}
+		if af.cur[i] < minCur {
+			minCur = af.cur[i]
+		}
+		if af.prev[i] < minPrev {
+			minPrev = af.prev[i]
+		}
+	}
+	return int64(minCur) + int64(minPrev)
+}
+
+// Whether the missed object fid, read from url, gets cached. Rules and
+// misses go by fid, the cache key of url. The origin info of url is
+// returned too if it was looked up, to pass to AttachDownload.
+func (mgr *CacheManager) Admit(fid string, url string) (bool, *ObjectInfo) {
+	if mgr.IsPinned(fid) {
+		return true, nil
+	}
+	for _, rule := range definition.F_admission_rules {
+		if rule.Pattern.MatchString(fid) {
+			return rule.Admit, nil
+		}
+	}
+	if definition.F_admission_min_hits > 1 &&
+		mgr.admission.Record(fid) < definition.F_admission_min_hits {
+		ZapLogger.Info("not admitted, too few misses", zap.Any("fid", fid))
+		return false, nil
+	}
+	if definition.F_admission_max_size > 0 {
+		exist, info := CheckUrl(url)
+		if !exist {
+			return true, nil
+		}
+		if info.Size > definition.F_admission_max_size {
+			ZapLogger.Info("not admitted, too large", zap.Any("url", url), zap.Any("size", info.Size))
+			return false, nil
+		}
+		return true, &info
+	}
+	return true, nil
+}
@@ -0,0 +1,95 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/common/definition"
+)
+
+// Objects are cached under a key derived from their url, so urls of a same
+// object differing only by what changes at each request, e.g. the
+// signature and expiry of presigned urls, share 1 cache entry. The key is
+// the fid of the object in DB, the url it was last read with is kept as its
+// name and is what origin is fetched with.
+
+// Cache key of url. The first key rule whose pattern matches url gives the
+// key from its template. Otherwise the query parameters of
+// F_cache_key_strip_query are dropped and the host is lower cased with
+// F_cache_key_fold_host. Urls other than scheme://host/... are their key.
+func CacheKey(rawUrl string) string {
+	for _, rule := range definition.F_cache_key_rules {
+		if match := rule.Pattern.FindStringSubmatchIndex(rawUrl); match != nil {
+			return string(rule.Pattern.ExpandString(nil, rule.Key, rawUrl, match))
+		}
+	}
+	if len(definition.F_cache_key_strip_query) == 0 && !definition.F_cache_key_fold_host {
+		return rawUrl
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return rawUrl
+	}
+	if definition.F_cache_key_fold_host {
+		u.Host = strings.ToLower(u.Host)
+	}
+	if u.RawQuery != "" {
+		// Kept parameters stay as they were sent, in order.
+		var kept []string
+		for _, param := range strings.Split(u.RawQuery, "&") {
+			name, _, _ := strings.Cut(param, "=")
+			if name, err := url.QueryUnescape(name); err == nil && isStrippedParam(name) {
+				continue
+			}
+			kept = append(kept, param)
+		}
+		u.RawQuery = strings.Join(kept, "&")
+	}
+	u.ForceQuery = false
+	return u.String()
+}
+
+// Names are compared case insensitively, a name ending with * matches as
+// a prefix.
+func isStrippedParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, strip := range definition.F_cache_key_strip_query {
+		strip = strings.ToLower(strip)
+		if strings.HasSuffix(strip, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(strip, "*")) {
+				return true
+			}
+		} else if name == strip {
+			return true
+		}
+	}
+	return false
+}
+
+// Key prefix of a url prefix, scheme and host are normalized as CacheKey
+// does so the prefix matches the keys of the urls starting with it. Key
+// rules rewrite whole urls and can't apply to a prefix, with rules the
+// prefix must be given as a key prefix.
+func CacheKeyPrefix(prefix string) string {
+	if len(definition.F_cache_key_strip_query) == 0 && !definition.F_cache_key_fold_host {
+		return prefix
+	}
+	scheme, rest, ok := strings.Cut(prefix, "://")
+	if !ok || scheme == "" {
+		return prefix
+	}
+	host, path := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		host, path = rest[:i], rest[i:]
+	}
+	if definition.F_cache_key_fold_host {
+		// User info stays as is, as in url.URL.
+		i := strings.LastIndexByte(host, '@') + 1
+		host = host[:i] + strings.ToLower(host[i:])
+	}
+	return strings.ToLower(scheme) + "://" + host + path
+}
@@ -0,0 +1,36 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/common/definition"
+)
+
+// Pin prefixes must match the keys of the urls starting with them.
+func TestCacheKeyPrefix(t *testing.T) {
+	strip, fold := definition.F_cache_key_strip_query, definition.F_cache_key_fold_host
+	defer func() {
+		definition.F_cache_key_strip_query, definition.F_cache_key_fold_host = strip, fold
+	}()
+	definition.F_cache_key_strip_query = []string{"Signature"}
+	definition.F_cache_key_fold_host = true
+
+	for _, c := range []struct{ prefix, url string }{
+		{"HTTP://Bucket.Example.COM/Dir/", "HTTP://Bucket.Example.COM/Dir/a.bin?Signature=x"},
+		{"http://Bucket.Exam", "http://Bucket.Example.com/a.bin"},
+		{"http://User@Bucket.Example.com/", "http://User@Bucket.Example.com/a.bin"},
+	} {
+		prefix, key := CacheKeyPrefix(c.prefix), CacheKey(c.url)
+		if !strings.HasPrefix(key, prefix) {
+			t.Errorf("key %s doesn't start with %s", key, prefix)
+		}
+	}
+	if got := CacheKeyPrefix("bucket/Dir/"); got != "bucket/Dir/" {
+		t.Errorf("got %s", got)
+	}
+}
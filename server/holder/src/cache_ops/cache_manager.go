@@ -5,12 +5,8 @@
 package cache_ops
 
 import (
-	"bytes"
+	"errors"
 	"io"
-	"io/ioutil"
-	"net/http"
-	"os"
-	"strings"
 	"sync"
 	"time"
 
@@ -19,14 +15,13 @@ import (
 	"holder/src/file_handler"
 
 	"github.com/common/definition"
+	"github.com/common/util"
 	. "github.com/common/zaplog"
 	"go.uber.org/zap"
 )
 
 // TODO:
-// 1. Need GC db metadata loop
-// 2. Need optimize the OSS download
-// 3. Need improving the cache eviction algorithm
+// 1. Need optimize the OSS download
 type CacheManager struct {
 	wMtx sync.Mutex
 	// fileName->fid
@@ -34,25 +29,94 @@ type CacheManager struct {
 	writeItemMap map[string]string
 	wQueue       []string
 
-	pMtx         sync.Mutex
-	purgeItemMap map[string]time.Time
-	pQueue       []string
+	// Ranks cached objects for eviction.
+	objects    EvictionPolicy
+	policyName string
+	bMtx       sync.Mutex
+	// Blobs of evicted objects waiting for deletion, in eviction order.
+	bQueue []blobPurge
+	// Wakes up the watermark evictor.
+	evictKick chan struct{}
+	// Counts misses for admission.
+	admission AdmissionFilter
 
-	dbOpsFile *db_ops.DBOpsFile
+	pinMtx sync.Mutex
+	pins   []db_ops.Pin
+	// fid->cached object kept out of the eviction policy by a pin.
+	pinned map[string]cachedObject
+
+	pfMtx  sync.Mutex
+	pfCond *sync.Cond
+	// Urls of prefetch jobs waiting for a worker, in job order.
+	pfQueue []prefetchItem
+	pfJobs  map[string]*PrefetchJob
+	// Prefetches running, atomic.
+	prefetching int64
+
+	cMtx sync.Mutex
+	// Source and target triplets of the running compaction.
+	compacting []string
+
+	dMtx sync.Mutex
+	// fid->in-flight origin download, shared by all readers of the fid.
+	downloads map[string]*Download
+
+	// Serializes metadata GC rounds.
+	gcMtx sync.Mutex
+	// Orphan triplet id->when metadata GC first saw it orphan.
+	gcOrphans map[string]time.Time
+
+	dbOpsFile db_ops.MetadataStore
 	pbh       *blob.PhyBH
 }
 
-func (mgr *CacheManager) New(fdb *db_ops.DBOpsFile, bh *blob.PhyBH) {
+func (mgr *CacheManager) New(fdb db_ops.MetadataStore, bh *blob.PhyBH) {
 	mgr.writeItemMap = make(map[string]string)
-	mgr.purgeItemMap = make(map[string]time.Time)
 	mgr.wQueue = make([]string, 0)
-	mgr.pQueue = make([]string, 0)
+	mgr.downloads = make(map[string]*Download)
+	mgr.gcOrphans = make(map[string]time.Time)
+	mgr.evictKick = make(chan struct{}, 1)
+	mgr.admission.New()
+	mgr.pinned = make(map[string]cachedObject)
+	mgr.pfCond = sync.NewCond(&mgr.pfMtx)
+	mgr.pfJobs = make(map[string]*PrefetchJob)
+	mgr.policyName = definition.F_eviction_policy
+	if mgr.policyName == "" {
+		mgr.policyName = K_eviction_policy_lru
+	}
+	policy, err := NewEvictionPolicy(mgr.policyName)
+	if err != nil {
+		ZapLogger.Fatal("NewEvictionPolicy", zap.Any("err", err))
+	}
+	mgr.objects = policy
 	mgr.dbOpsFile = fdb
 	mgr.pbh = bh
+	mgr.loadPins()
+	mgr.loadObjects()
+	if err := mgr.recoverCompaction(); err != nil {
+		// Retried by the compaction loop before any new compaction.
+		ZapLogger.Error("recover compaction failed", zap.Any("err", err))
+	}
+
+	// Pending files left by a previous run are resumed from their
+	// checkpoints, or deleted along with their spools.
+	mgr.resumeDownloads()
 
 	// Dispatch background thread.
 	go mgr.loopBatchWrite()
 	go mgr.loopGarbageCollection()
+	go mgr.loopMetadataGC()
+	go mgr.loopCompaction()
+	go mgr.loopSaveEvictionState()
+	go mgr.loopWatermarkEviction()
+	go mgr.loopPins()
+	workers := definition.F_prefetch_workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := int64(0); i < workers; i++ {
+		go mgr.loopPrefetch()
+	}
 }
 
 func (mgr *CacheManager) EnqueueWriteReq(
@@ -67,23 +131,6 @@ func (mgr *CacheManager) EnqueueWriteReq(
 	mgr.wQueue = append(mgr.wQueue, fileName)
 }
 
-// Assuming with lock.
-func (mgr *CacheManager) EnqueueDeletionReq() {
-	mgr.pMtx.Lock()
-	defer mgr.pMtx.Unlock()
-	tpltId, err := mgr.pbh.GetTailNameForEvict()
-	if err != nil {
-		return
-	}
-	err = mgr.dbOpsFile.DeleteFileWithTripleIdInDB(tpltId)
-	if err != nil {
-		ZapLogger.Error("DELETE FILE IN DB ERROR", zap.Any("error", err))
-		return
-	}
-	mgr.purgeItemMap[tpltId] = time.Now()
-	mgr.pQueue = append(mgr.pQueue, tpltId)
-}
-
 func (mgr *CacheManager) loopBatchWrite() {
 	for {
 		time.Sleep(200 * time.Millisecond)
@@ -120,55 +167,128 @@ func (mgr *CacheManager) loopBatchWrite() {
 func (mgr *CacheManager) loopGarbageCollection() {
 	for {
 		time.Sleep(200 * time.Millisecond)
-		mgr.pMtx.Lock()
-		if len(mgr.purgeItemMap) == 0 {
-			mgr.pMtx.Unlock()
-			continue
-		}
-		wg := &sync.WaitGroup{}
-		for _, tpltId := range mgr.pQueue {
-			if time.Now().Sub(mgr.purgeItemMap[tpltId]).Milliseconds() <
-				definition.F_cache_purge_waiting_ms {
-				continue
-			}
-			wg.Add(1)
-			go func(id string) {
-				mgr.pbh.PurgeTriplet(id)
-				wg.Done()
-			}(tpltId)
-			delete(mgr.purgeItemMap, tpltId)
-		}
-		wg.Wait()
-		mgr.pMtx.Unlock()
+		mgr.purgeBlobs()
 	}
 }
 
+// Background job of the write queue. If a reader already triggered the
+// download of this file, attach to it rather than fetching again.
 func (mgr *CacheManager) dowloadAndWriteCache(
 	fileName string, fid string) {
-	exist, ossDataLen := CheckUrl(fileName)
+	_, state, err := mgr.dbOpsFile.ListFileAndStateFromDB(fid)
+	if err != nil || state != definition.F_BLOB_STATE_PENDING {
+		return
+	}
+	d, err := mgr.AttachDownload(fid, fileName, nil)
+	if err != nil {
+		ZapLogger.Error("AttachDownload failed", zap.Any("fid", fid), zap.Any("err", err))
+		return
+	}
+	defer d.Release()
+	d.Wait()
+}
+
+// Get the in-flight download of fid, or start one if none. stat, if not
+// nil, is the origin info of fileName just looked up, a new download then
+// doesn't look it up again. Caller owns a reference on the returned
+// download and must Release it.
+func (mgr *CacheManager) AttachDownload(fid string, fileName string, stat *ObjectInfo) (*Download, error) {
+	mgr.dMtx.Lock()
+	defer mgr.dMtx.Unlock()
+	if d, exist := mgr.downloads[fid]; exist && d.acquire() {
+		return d, nil
+	}
+	d := new(Download)
+	if err := d.New(fid, fileName); err != nil {
+		ZapLogger.Error("Download.New failed", zap.Any("fid", fid), zap.Any("err", err))
+		return nil, err
+	}
+	d.stat = stat
+	d.acquire()
+	mgr.downloads[fid] = d
+	go mgr.runDownload(d)
+	return d, nil
+}
+
+// Fetch the object from origin into the spool of d, then commit the spool
+// into a triplet and seal the file in DB.
+func (mgr *CacheManager) runDownload(d *Download) {
+	var err error
+	defer func() {
+		// Unlink before leaving the map, so a new download of the same
+		// fid never sees its spool file removed.
+		d.unlinkSpool()
+		mgr.dMtx.Lock()
+		delete(mgr.downloads, d.Fid)
+		mgr.dMtx.Unlock()
+		d.commit(err)
+		d.Release()
+	}()
+	exist, info := d.stat != nil, ObjectInfo{}
+	if exist {
+		info = *d.stat
+	} else {
+		exist, info = CheckUrl(d.Url)
+	}
 	if !exist {
+		err = errors.New("object not available at origin")
+		d.finish(err)
+		mgr.RollbackFileInDB(d.Fid)
 		return
 	}
+	// Reserve the space of the object, so writing it can't fail once it's
+	// downloaded. If there's no room yet, eviction makes some during the
+	// download. Released on failure, consumed by the write otherwise.
+	var reserved int64
+	if info.Size > 0 {
+		reserved = mgr.reserveSpace(info.Size, false)
+	}
+	defer func() { mgr.pbh.Unreserve(reserved) }()
 
-	// 1.Get from OSS
-	ossData := mgr.DownLoad(fileName, ossDataLen)
-	if ossData == nil {
+	// 1.Get from OSS, readers only see the end of the download once it's
+	// verified.
+	start := time.Now()
+	if err = fetchObject(d, info); err == nil {
+		err = verifyDownload(d, info)
+	}
+	d.finish(err)
+	if err = d.Wait(); err != nil {
+		ZapLogger.Error("DownLoad failed", zap.Any("url", d.Url), zap.Any("err", err))
+		mgr.RollbackFileInDB(d.Fid)
 		return
 	}
-	// 2. Write To Cache
-	token, err := mgr.WriteToCache(fileName, ossData)
+	ZapLogger.Info("Download finish",
+		zap.Any("download dataSize", d.written),
+		zap.Any("duration seconds", time.Now().Sub(start).Seconds()))
+	if reserved == 0 {
+		if reserved = mgr.reserveSpace(d.written, true); reserved == 0 {
+			// Readers were served from the spool, the object isn't cached.
+			ZapLogger.Warn("No space reserved, object not cached",
+				zap.Any("url", d.Url), zap.Any("size", d.written))
+			err = blob.ErrNoSpace
+			mgr.RollbackFileInDB(d.Fid)
+			return
+		}
+	}
 
+	// 2. Write To Cache
+	token, err := mgr.WriteToCache(d.Fid, d.spoolReader(), d.written, reserved)
+	reserved = 0
 	if err != nil {
-		mgr.RollbackFileInDB(fid)
-		if strings.Contains(err.Error(), "cache full") {
-			mgr.EnqueueDeletionReq()
+		mgr.RollbackFileInDB(d.Fid)
+		if errors.Is(err, blob.ErrNoSpace) {
+			if definition.F_eviction_high_watermark > 0 {
+				mgr.kickEviction()
+			} else {
+				mgr.EnqueueDeletionReq(d.written)
+			}
 			return
 		} else {
 			ZapLogger.Error("WriteToCache failed", zap.Any("err", err))
 			return
 		}
 	}
-	err = mgr.SealFileAtCache(fid, token, int32(len(ossData)))
+	err = mgr.SealFileAtCache(d.Fid, token, d.written, d.Validators)
 	// TODO: if the error is conflict, return
 	if err != nil {
 		// TODO: handle error
@@ -176,126 +296,136 @@ func (mgr *CacheManager) dowloadAndWriteCache(
 	}
 }
 
+const kReserveRetries = 5
+
+// Reserve the space to write an object of size, returns the reserved bytes
+// or 0 if there's no room. When full, objects are evicted to make room
+// and, with wait, the reservation is retried while their blobs get
+// deleted.
+func (mgr *CacheManager) reserveSpace(size int64, wait bool) int64 {
+	reserved, err := mgr.pbh.Reserve(size)
+	if err == nil {
+		// Reserved bytes count against the high watermark.
+		mgr.kickEviction()
+		return reserved
+	}
+	mgr.EnqueueDeletionReq(blob.PutAllocSize(size))
+	for i := 0; wait && i < kReserveRetries; i++ {
+		time.Sleep(2 * definition.F_cache_purge_waiting_ms * time.Millisecond)
+		if reserved, err = mgr.pbh.Reserve(size); err == nil {
+			return reserved
+		}
+	}
+	ZapLogger.Warn("Reserve failed", zap.Any("size", size), zap.Any("err", err))
+	return 0
+}
+
+// Write the stream of fid into a blob, reserved bytes returned by
+// PhyBH.Reserve are consumed.
 func (mgr *CacheManager) WriteToCache(
-	fid string, ossData []byte) (string, error) {
+	fid string, r io.Reader, size int64, reserved int64) (string, error) {
 	fw := file_handler.FileWriter{
-		Pbh:    mgr.pbh,
-		FileDb: mgr.dbOpsFile,
+		Pbh:      mgr.pbh,
+		FileDb:   mgr.dbOpsFile,
+		Reserved: reserved,
 	}
 	token := ""
 	var err error
-	if token, err = fw.WriteFileToCache(fid, ossData); err != nil {
+	if token, err = fw.WriteStreamToCache(fid, r, size); err != nil {
 		return "", err
 	}
 	return token, nil
 }
 
-func (mgr *CacheManager) SealFileAtCache(fid string, token string, size int32) error {
+func (mgr *CacheManager) SealFileAtCache(
+	fid string, token string, size int64, v Validators) error {
+	// A refetch after an ETag change replaces the blob of the file.
+	prevFm, _, _ := mgr.dbOpsFile.ListFileAndStateFromDB(fid)
 	err := mgr.dbOpsFile.CommitCacheFileInDB(
-		fid, token, size)
+		fid, token, size, v.Etag, v.MaxAge)
 	if err != nil {
 		ZapLogger.Error("Seal file failed", zap.Any("fid", fid))
 		return err
 	}
+	mgr.releaseBlobs(prevFm, token)
+	mgr.TouchObject(fid, token, size)
+	return nil
+}
+
+// Drop the cached copy of fid whose blob of token failed its checksum, so
+// the next read refetches it from origin. No-op if fid already moved to
+// another blob.
+func (mgr *CacheManager) InvalidateCorruptedFile(fid string, token string) error {
+	fm, state, err := mgr.dbOpsFile.ListFileAndStateFromDB(fid)
+	if err != nil {
+		return err
+	}
+	if state != definition.F_DB_STATE_READY || !hasToken(fm, token) {
+		return nil
+	}
+	err = mgr.dbOpsFile.DeleteFileWithFidAndOwnerInDB(fid, util.GetTripletIdFromToken(token))
+	if err != nil {
+		ZapLogger.Error("invalidate corrupted file failed", zap.Any("fid", fid), zap.Any("err", err))
+		return err
+	}
+	ZapLogger.Warn("Invalidated corrupted file", zap.Any("fid", fid), zap.Any("token", token))
+	mgr.removeObject(fid)
+	mgr.enqueueBlobPurge(token)
 	return nil
 }
 
 // rollback file meta in db, if write cache failed
 func (mgr *CacheManager) RollbackFileInDB(fid string) error {
+	prevFm, state, _ := mgr.dbOpsFile.ListFileAndStateFromDB(fid)
 	err := mgr.dbOpsFile.DeletePendingFileWithFIdInDB(fid)
 	if err != nil {
 		ZapLogger.Error("rollback file failed", zap.Any("fid", fid))
 		return err
 	}
+	// A failed refetch still holds the blob of the outdated copy.
+	if state == definition.F_DB_STATE_PENDING {
+		mgr.releaseBlobs(prevFm, "")
+	}
 	ZapLogger.Info("sucessfully rollback", zap.Any("fid", fid))
 	return nil
 }
 
 // Utility function
-func CheckUrl(url string) (bool, int64) {
-	//check url
-	if definition.F_local_mode {
-		stat, err := os.Stat(url)
-		if err == nil {
-			return true, stat.Size()
-		}
-		if os.IsNotExist(err) {
-			ZapLogger.Info("local file not found", zap.Any("file", url))
-			return false, 0
-		}
-		ZapLogger.Error("CheckUrl failed", zap.Any("err", err))
-		return false, 0
-
-	} else {
-		// TODO: http.Head with presign url maybe failed
-		resp, err := http.Head(url)
-		if err != nil {
-			// maybe timeout , cannot crash the server.
-			ZapLogger.Error("http.Head", zap.Any("err", err))
-			return false, 0
-		}
-		if resp.StatusCode == 404 {
-			ZapLogger.Error("url is not exist", zap.Any("url", url))
-			resp.Body.Close()
-			return false, 0
-		}
-		contentlength := resp.ContentLength
-		ZapLogger.Info("CheckUrl", zap.Any("url", url), zap.Any("size", contentlength))
-		if contentlength >= definition.F_CACHE_MAX_SIZE {
-			ZapLogger.Warn("url is too large", zap.Any("url", url),
-				zap.Any("cache size MB", definition.F_CACHE_MAX_SIZE/1024/1024))
-			resp.Body.Close()
-			return false, 0
-		}
-		resp.Body.Close()
-		return true, contentlength
+// Whether the object of url exists at origin and fits the cache, with its
+// size and validators.
+func CheckUrl(url string) (bool, ObjectInfo) {
+	origin, err := OriginOf(url)
+	if err != nil {
+		ZapLogger.Error("CheckUrl failed", zap.Any("url", url), zap.Any("err", err))
+		return false, ObjectInfo{}
+	}
+	info, err := origin.Stat(url)
+	if err != nil {
+		// maybe timeout , cannot crash the server.
+		ZapLogger.Error("CheckUrl failed", zap.Any("url", url), zap.Any("err", err))
+		return false, ObjectInfo{}
+	}
+	ZapLogger.Info("CheckUrl", zap.Any("url", url), zap.Any("size", info.Size))
+	if info.Size >= definition.F_CACHE_MAX_SIZE {
+		ZapLogger.Warn("url is too large", zap.Any("url", url),
+			zap.Any("cache size MB", definition.F_CACHE_MAX_SIZE/1024/1024))
+		return false, ObjectInfo{}
 	}
+	return true, info
 }
 
 // Utility function
-func (mgr *CacheManager) DownLoad(url string, ossDataLen int64) []byte {
-	// Get the data
-	if definition.F_local_mode { // only for test
-		data, err := ioutil.ReadFile(url)
-		if err != nil {
-			ZapLogger.Error("read local file failed", zap.Any("err", err))
-			return nil
-		}
-		if len(data) != int(ossDataLen) {
-			ZapLogger.Error("datalen is not equal to size",
-				zap.Any("dataLen", len(data)), zap.Any("size", ossDataLen))
-			return nil
-		}
-		return data
-
-	} else {
-		start := time.Now()
-		resp, err := http.Get(url)
-		if err != nil {
-			panic(err)
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode == 404 {
-			ZapLogger.Error("ossData not found", zap.Any("url", url))
-			return nil
-		}
-		var buf bytes.Buffer
-		_, err = io.Copy(&buf, resp.Body)
-		ossData := buf.Bytes()
-		if err != nil {
-			ZapLogger.Error("DownLoad failed", zap.Any("err", err))
-			if len(ossData) != int(ossDataLen) {
-				ZapLogger.Error("Download dataSize is not equal to inputdataLen",
-					zap.Any("download dataSize", len(ossData)), zap.Any("inputdataLen", ossDataLen))
-				return nil
-			}
-		}
-		duration := time.Now().Sub(start)
-		ZapLogger.Info("Download finish",
-			zap.Any("download dataSize", len(ossData)),
-			zap.Any("duration seconds", duration.Seconds()))
-		return ossData
+// Open the object body at origin with its validators, caller must close it.
+func OpenOrigin(url string) (io.ReadCloser, Validators, error) {
+	origin, err := OriginOf(url)
+	if err != nil {
+		return nil, Validators{}, err
+	}
+	resp, err := origin.Get(url, "", "")
+	if err != nil {
+		return nil, Validators{}, err
 	}
+	return resp.Body, resp.Validators, nil
 }
 
 // Utility function
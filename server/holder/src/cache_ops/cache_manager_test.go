@@ -0,0 +1,163 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	blob "holder/src/blob_handler"
+	db_ops "holder/src/db_ops"
+	"holder/src/file_handler"
+
+	"github.com/common/definition"
+	"github.com/common/util"
+)
+
+// Cache manager of a cache of maxSize bytes, over a bolt store in memory,
+// downloading from local files to a temporary blob directory. Its
+// background loops aren't started.
+func newTestManager(t *testing.T, maxSize int64) *CacheManager {
+	setupDownloads(t, 0, 1, 0)
+	localMode, cacheSize := definition.F_local_mode, definition.F_CACHE_MAX_SIZE
+	t.Cleanup(func() {
+		definition.F_local_mode, definition.F_CACHE_MAX_SIZE = localMode, cacheSize
+	})
+	definition.F_local_mode = true
+	definition.F_CACHE_MAX_SIZE = maxSize
+	bs := new(db_ops.BoltStore)
+	bs.New("")
+	t.Cleanup(func() { bs.Close() })
+	pbh := new(blob.PhyBH)
+	if err := pbh.New(0, bs); err != nil {
+		t.Fatal(err)
+	}
+	mgr := &CacheManager{dbOpsFile: bs, pbh: pbh,
+		downloads: make(map[string]*Download), evictKick: make(chan struct{}, 1),
+		pfJobs: make(map[string]*PrefetchJob)}
+	mgr.objects, _ = NewEvictionPolicy(K_eviction_policy_lru)
+	mgr.pfCond = sync.NewCond(&mgr.pfMtx)
+	return mgr
+}
+
+// Write a local object of size bytes, returns its path.
+func writeTestObject(t *testing.T, size int) string {
+	path := t.TempDir() + "/object"
+	if err := os.WriteFile(path, randomBytes(size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Take all the space of the cache, as downloads in flight would. Returns the
+// bytes reserved.
+func fillTestManager(mgr *CacheManager) int64 {
+	var held int64
+	for {
+		reserved, err := mgr.pbh.Reserve(1000)
+		if err != nil {
+			return held
+		}
+		held += reserved
+	}
+}
+
+// Readers are served from the spool, but the download reports the object
+// isn't cached and its file is rolled back.
+func TestDownloadWithoutSpace(t *testing.T) {
+	mgr := newTestManager(t, 1024*1024)
+	path := writeTestObject(t, 1000)
+	held := fillTestManager(mgr)
+	if err := mgr.dbOpsFile.CreateFileWithFidInDB("fid",
+		&definition.FileMeta{Name: path, MaxAge: -1}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := mgr.AttachDownload("fid", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Release()
+	if err := d.Wait(); err != nil {
+		t.Fatalf("download failed, %v", err)
+	}
+	if err := d.WaitCommitted(); !errors.Is(err, blob.ErrNoSpace) {
+		t.Fatalf("committed with %v", err)
+	}
+	if _, state, _ := mgr.dbOpsFile.ListFileAndStateFromDB("fid"); state != -1 {
+		t.Fatalf("file left in state %d", state)
+	}
+	if reserved := mgr.pbh.GetReservedBytes(); reserved != held {
+		t.Fatalf("%d bytes left reserved", reserved-held)
+	}
+}
+
+// Sizes above 2GiB are kept whole from the seal to the read. The blob is
+// put small, then grown sparse on disk.
+func TestSealAbove2GiB(t *testing.T) {
+	mgr := newTestManager(t, 1024*1024)
+	align := definition.F_4K_Align
+	defer func() { definition.F_4K_Align = align }()
+	definition.F_4K_Align = false
+	const size = int64(5)<<30 + 7
+
+	blbId := util.ShordGuidGenerator()
+	token, err := mgr.pbh.PutStream(blbId, bytes.NewReader(randomBytes(10)), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("%s/binary_0_%s.dat", blob.BlobDir(), util.GetTripletIdFromToken(token))
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := int64(bytes.Index(content, []byte(blbId)))
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint64(header, uint64(size))
+	_, err = f.WriteAt(header, off+definition.F_BLOBID_SIZE)
+	if err == nil {
+		err = f.Truncate(off + blob.K_blob_header_len + size)
+	}
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mgr.dbOpsFile.CreateFileWithFidInDB("large", &definition.FileMeta{Name: "/large", MaxAge: -1})
+	if err := mgr.SealFileAtCache("large", token, size, Validators{MaxAge: -1}); err != nil {
+		t.Fatal(err)
+	}
+	fm, _, err := mgr.dbOpsFile.ListFileAndOwnersFromDB("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := file_handler.FileReader{Pbh: mgr.pbh, FileDb: mgr.dbOpsFile}
+	br, err := fr.OpenFromCache("large", fm.RngCodeList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	tail := make([]byte, 7)
+	if n, err := br.ReadAt(tail, size-7); br.Size() != size || n != 7 ||
+		(err != nil && err != io.EOF) || !bytes.Equal(tail, make([]byte, 7)) {
+		t.Fatalf("blob of %d bytes, read %d at its tail, %v", br.Size(), n, err)
+	}
+
+	// And from the metadata at startup.
+	mgr.objects, _ = NewEvictionPolicy(K_eviction_policy_lru)
+	mgr.loadObjects()
+	if obj, _ := mgr.objects.PopVictim(); obj.fid != "large" || obj.size != size {
+		t.Fatalf("loaded %+v", obj)
+	}
+}
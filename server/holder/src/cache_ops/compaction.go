@@ -0,0 +1,219 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	blob "holder/src/blob_handler"
+	db_ops "holder/src/db_ops"
+
+	"github.com/common/definition"
+	range_code "github.com/common/range_code"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Deleted and replaced blobs keep their bytes in the binary file of their
+// triplet. The compactor periodically picks closed triplets whose live ratio
+// dropped below F_compact_live_ratio, most garbage first, and rewrites their
+// live blobs into a new triplet:
+//  1. copy the live blobs into a target, then seal and sync the target,
+//  2. journal the compaction,
+//  3. point the files at the copies, 1 file per DB transaction,
+//  4. purge the source once readers are done with it, drop the journal.
+// A crash before 2 leaves a target no file points at, deleted at startup.
+// A crash after 2 is rolled forward by recoverCompaction.
+
+// Periodically compact the closed triplets with the most garbage.
+func (mgr *CacheManager) loopCompaction() {
+	if definition.F_compact_interval_sec <= 0 {
+		ZapLogger.Info("compaction disabled")
+		return
+	}
+	for {
+		time.Sleep(time.Duration(definition.F_compact_interval_sec) * time.Second)
+		// The journal holds 1 compaction, finish the pending one first.
+		if err := mgr.recoverCompaction(); err != nil {
+			ZapLogger.Error("recover compaction failed", zap.Any("err", err))
+			continue
+		}
+		mgr.RunCompaction()
+	}
+}
+
+// Run 1 round of compaction, returns the number of compacted triplets.
+func (mgr *CacheManager) RunCompaction() int {
+	type candidate struct {
+		tplt      *blob.Triplet
+		liveRatio float64
+	}
+	var candidates []candidate
+	for _, tplt := range mgr.pbh.ClosedTriplets() {
+		if tplt.NumBlobs() == 0 {
+			continue
+		}
+		if ratio := tplt.LiveRatio(); ratio < definition.F_compact_live_ratio {
+			candidates = append(candidates, candidate{tplt: tplt, liveRatio: ratio})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].liveRatio < candidates[j].liveRatio
+	})
+	compacted := 0
+	for _, c := range candidates {
+		if err := mgr.compactTriplet(c.tplt); err != nil {
+			ZapLogger.Error("compaction failed", zap.Any("tpltId", c.tplt.Id), zap.Any("err", err))
+			continue
+		}
+		compacted++
+	}
+	return compacted
+}
+
+func (mgr *CacheManager) compactTriplet(src *blob.Triplet) error {
+	live, total := src.LiveBytes()
+	ZapLogger.Info("Compacting triplet", zap.Any("tpltId", src.Id),
+		zap.Any("live", live), zap.Any("total", total))
+	dst, err := mgr.pbh.OpenCompactionTarget()
+	if err != nil {
+		return err
+	}
+	mgr.setCompacting(src.Id, dst.Id)
+	defer mgr.setCompacting()
+
+	for _, token := range src.LiveTokens() {
+		if _, err := mgr.pbh.CopyBlob(token, dst); err != nil {
+			if !mgr.pbh.HasBlob(token) {
+				// Deleted meanwhile, nothing to relocate.
+				continue
+			}
+			if errors.Is(err, blob.ErrChecksumMismatch) {
+				// Not relocated, its file is dropped with src and gets
+				// refetched.
+				ZapLogger.Error("skip corrupted blob", zap.Any("token", token))
+				continue
+			}
+			mgr.pbh.PurgeTriplet(dst.Id)
+			return err
+		}
+	}
+	if err := mgr.pbh.SealCompactionTarget(dst); err != nil {
+		mgr.pbh.PurgeTriplet(dst.Id)
+		return err
+	}
+	if err := blob.WriteCompactionJournal(mgr.pbh.ShardId, src.Id, dst.Id); err != nil {
+		mgr.pbh.PurgeTriplet(dst.Id)
+		return err
+	}
+	if err := mgr.relocateFiles(src.Id, dst); err != nil {
+		// The journal stays, next startup rolls forward.
+		return err
+	}
+	// Readers may still be on the old tokens.
+	time.Sleep(time.Duration(definition.F_cache_purge_waiting_ms) * time.Millisecond)
+	mgr.finishCompaction(src.Id, dst)
+	ZapLogger.Info("Compacted triplet", zap.Any("src", src.Id), zap.Any("dst", dst.Id))
+	return nil
+}
+
+// Point the files owned by src at their copies in dst. Idempotent, files
+// already relocated are owned by dst.
+func (mgr *CacheManager) relocateFiles(srcId string, dst *blob.Triplet) error {
+	rows, err := mgr.dbOpsFile.ListFilesWithTripleIdFromDB(srcId)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if row.State != definition.F_DB_STATE_READY ||
+			row.Meta.RngCodeList == nil || row.Meta.RngCodeList.Len() != 1 {
+			continue
+		}
+		rngCode := row.Meta.RngCodeList.Front().Value.(range_code.RangeCode)
+		newToken := mgr.pbh.CompactedToken(rngCode.Token, dst)
+		if newToken == "" {
+			// Blob was already gone, metadata GC drops the file.
+			continue
+		}
+		err := mgr.dbOpsFile.UpdateFileTokenInDB(row.Fid, rngCode.Token, newToken)
+		if errors.Is(err, db_ops.ErrTokenChanged) {
+			// Evicted or refetched meanwhile, the copy is garbage.
+			mgr.pbh.DeleteBlob(newToken)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !mgr.objects.Retoken(row.Fid, rngCode.Token, newToken) {
+			// Evicted after the file was listed, its entry deletion missed
+			// the new owner. Keep it evictable.
+			mgr.TouchObject(row.Fid, newToken, rngCode.End-rngCode.Start)
+		}
+	}
+	return nil
+}
+
+// Purge the compacted source and drop the journal.
+func (mgr *CacheManager) finishCompaction(srcId string, dst *blob.Triplet) {
+	if mgr.pbh.HasTriplet(srcId) {
+		mgr.pbh.PurgeTriplet(srcId)
+	} else {
+		blob.DeleteTripletFilesOnDisk(mgr.pbh.ShardId, srcId)
+	}
+	if dst.NumBlobs() == 0 {
+		mgr.pbh.PurgeTriplet(dst.Id)
+	}
+	if err := blob.RemoveCompactionJournal(mgr.pbh.ShardId); err != nil {
+		ZapLogger.Error("remove compaction journal failed", zap.Any("err", err))
+	}
+}
+
+// Roll forward the compaction a previous run was doing when it stopped.
+// Called at startup, before serving, and again before each compaction round
+// if it failed. Until it succeeds, both triplets are kept and files point at
+// either of them.
+func (mgr *CacheManager) recoverCompaction() error {
+	journal, err := blob.ReadCompactionJournal(mgr.pbh.ShardId)
+	if err != nil {
+		return err
+	}
+	if journal == nil {
+		return nil
+	}
+	ZapLogger.Info("Recovering compaction", zap.Any("src", journal.Src), zap.Any("dst", journal.Dst))
+	dst := mgr.pbh.ClosedTplt.Peek(journal.Dst)
+	if dst == nil {
+		// No file pointed at the target yet, startup deleted it as an
+		// orphan. The source is untouched.
+		return blob.RemoveCompactionJournal(mgr.pbh.ShardId)
+	}
+	mgr.setCompacting(journal.Src, journal.Dst)
+	defer mgr.setCompacting()
+	if err := mgr.relocateFiles(journal.Src, dst); err != nil {
+		return err
+	}
+	mgr.finishCompaction(journal.Src, dst)
+	return nil
+}
+
+// Triplets being compacted, the source and the target. Called without
+// argument once done.
+func (mgr *CacheManager) setCompacting(tpltIds ...string) {
+	mgr.cMtx.Lock()
+	defer mgr.cMtx.Unlock()
+	mgr.compacting = tpltIds
+}
+
+func (mgr *CacheManager) isCompacting(tpltId string) bool {
+	mgr.cMtx.Lock()
+	defer mgr.cMtx.Unlock()
+	for _, id := range mgr.compacting {
+		if id == tpltId {
+			return true
+		}
+	}
+	return false
+}
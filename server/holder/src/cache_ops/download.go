@@ -0,0 +1,353 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"os"
+	"sync"
+
+	blob "holder/src/blob_handler"
+
+	"github.com/common/util"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Download is an in-flight fetch of one object from the origin. Origin
+// bytes are spooled to a local file as they arrive, so any number of
+// readers can follow the download while it's going on, and the spool is
+// then committed into a triplet once it's complete.
+// Lifecycle: created by AttachDownload, ready once origin answered (with
+// Size known, or -1 if origin didn't tell), done when all bytes are
+// spooled or an error happened, committed once the spool is sealed in a
+// triplet or given up.
+type Download struct {
+	Fid string
+	Url string
+	// Size told by origin, -1 if unknown.
+	Size int64
+	// Validators of the downloaded content.
+	Validators Validators
+	// Origin info looked up just before the download, nil if none.
+	stat *ObjectInfo
+
+	mtx  sync.Mutex
+	cond *sync.Cond
+	// Number of attached readers plus the downloader itself. The spool
+	// file is closed when it drops to 0.
+	refs      int
+	spoolName string
+	spool     *os.File
+	// Bytes spooled from the start, readers only read up to there. Parts
+	// fetched in parallel spool beyond, parts maps their start to how far
+	// they're spooled until written reaches them.
+	written   int64
+	parts     map[int64]int64
+	ready     bool
+	done      bool
+	err       error
+	committed bool
+	commitErr error
+
+	// CRC64 of spooled bytes [0, hashed), nil if not checked.
+	crcMtx sync.Mutex
+	crc    hash.Hash64
+	hashed int64
+
+	// Parts spooled for good, nil if the download can't be resumed.
+	ckptMtx sync.Mutex
+	ckpt    *DownloadCheckpoint
+}
+
+// Reader following the spool file of a download. It blocks until the
+// requested bytes are spooled and returns io.EOF once the download is done.
+type DownloadReader struct {
+	d   *Download
+	pos int64
+}
+
+func (d *Download) New(fid string, url string) error {
+	d.Fid = fid
+	d.Url = url
+	d.Size = -1
+	d.cond = sync.NewCond(&d.mtx)
+	d.refs = 1
+	spoolDir := GetSpoolDir()
+	if err := os.MkdirAll(spoolDir, 0755); err != nil {
+		return err
+	}
+	d.spoolName = fmt.Sprintf("%s/%s.part", spoolDir, util.GetStrMd5(fid))
+	// Not truncated, a spool left by a previous run may be resumed from its
+	// checkpoint.
+	f, err := os.OpenFile(d.spoolName, os.O_CREATE|os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+	d.spool = f
+	return nil
+}
+
+// Spool directory sits next to the triplet files.
+func GetSpoolDir() string {
+	return blob.BlobDir() + "/spool"
+}
+
+// Mark the origin has answered, size is the content length it announced.
+func (d *Download) setReady(size int64, v Validators) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.Size = size
+	d.Validators = v
+	d.ready = true
+	d.cond.Broadcast()
+}
+
+// Write appends origin bytes to the spool and wakes up readers.
+func (d *Download) Write(p []byte) (int, error) {
+	d.mtx.Lock()
+	off := d.written
+	d.mtx.Unlock()
+	n, err := d.spool.WriteAt(p, off)
+	d.crcMtx.Lock()
+	if d.crc != nil && d.hashed == off {
+		d.crc.Write(p[:n])
+		d.hashed += int64(n)
+	}
+	d.crcMtx.Unlock()
+	d.mtx.Lock()
+	d.written += int64(n)
+	d.cond.Broadcast()
+	d.mtx.Unlock()
+	return n, err
+}
+
+// Bytes [start, end) of a part are spooled.
+func (d *Download) spooledPart(start int64, end int64) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if start > d.written {
+		if d.parts == nil {
+			d.parts = make(map[int64]int64)
+		}
+		d.parts[start] = end
+		return
+	}
+	if end > d.written {
+		d.written = end
+	}
+	for {
+		partEnd, exist := d.parts[d.written]
+		if !exist {
+			break
+		}
+		delete(d.parts, d.written)
+		if partEnd > d.written {
+			d.written = partEnd
+		}
+	}
+	d.cond.Broadcast()
+}
+
+// Writer of a part of a download from its start on, pos is where it's
+// spooled up to.
+type partWriter struct {
+	d     *Download
+	start int64
+	pos   int64
+}
+
+func (pw *partWriter) Write(p []byte) (int, error) {
+	n, err := pw.d.spool.WriteAt(p, pw.pos)
+	pw.pos += int64(n)
+	pw.d.spooledPart(pw.start, pw.pos)
+	// Parts spooled meanwhile are hashed by who is hashing.
+	if pw.d.crcMtx.TryLock() {
+		pw.d.hashSpooledLocked()
+		pw.d.crcMtx.Unlock()
+	}
+	return n, err
+}
+
+// Compute the CRC64 of the spool as it's spooled.
+func (d *Download) startCrc64() {
+	d.crcMtx.Lock()
+	defer d.crcMtx.Unlock()
+	d.crc = crc64.New(crc64Table)
+	d.hashed = 0
+}
+
+// Hash the bytes spooled from the start since the last call. Bytes are
+// read back while they're likely still in the page cache.
+func (d *Download) hashSpooledLocked() error {
+	if d.crc == nil {
+		return nil
+	}
+	for written := d.Written(); d.hashed < written; written = d.Written() {
+		n, err := io.Copy(d.crc, io.NewSectionReader(d.spool, d.hashed, written-d.hashed))
+		d.hashed += n
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CRC64 of the whole spool, only valid once the download succeeded.
+func (d *Download) spooledCrc64() (uint64, error) {
+	d.crcMtx.Lock()
+	defer d.crcMtx.Unlock()
+	if d.crc == nil {
+		return 0, errors.New("crc64 of download not computed")
+	}
+	if err := d.hashSpooledLocked(); err != nil {
+		return 0, err
+	}
+	return d.crc.Sum64(), nil
+}
+
+// Finish the download, err is nil if all origin bytes are spooled.
+func (d *Download) finish(err error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if err == nil && d.Size >= 0 && d.written != d.Size {
+		err = fmt.Errorf("download size mismatch, expect %d, got %d", d.Size, d.written)
+	}
+	d.err = err
+	d.ready = true
+	d.done = true
+	d.cond.Broadcast()
+}
+
+// Block until origin answered, returns the error if it failed before
+// sending any byte.
+func (d *Download) WaitReady() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for !d.ready {
+		d.cond.Wait()
+	}
+	if d.done && d.written == 0 {
+		return d.err
+	}
+	return nil
+}
+
+// Block until the download is done.
+func (d *Download) Wait() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for !d.done {
+		d.cond.Wait()
+	}
+	return d.err
+}
+
+// Mark the download is sealed in cache, or err why it isn't.
+func (d *Download) commit(err error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.commitErr = err
+	d.committed = true
+	d.cond.Broadcast()
+}
+
+// Block until the download is sealed in cache, returns the error if it
+// isn't.
+func (d *Download) WaitCommitted() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for !d.committed {
+		d.cond.Wait()
+	}
+	return d.commitErr
+}
+
+// Bytes spooled so far.
+func (d *Download) Written() int64 {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.written
+}
+
+// Spooled content, only valid once the download succeeded.
+func (d *Download) spoolReader() io.Reader {
+	return io.NewSectionReader(d.spool, 0, d.written)
+}
+
+// Unlink the spool file and its checkpoint. Attached readers keep reading
+// from the opened fd.
+func (d *Download) unlinkSpool() {
+	for _, name := range []string{d.spoolName, checkpointPath(d.Fid)} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			ZapLogger.Error("remove spool file failed",
+				zap.Any("file", name), zap.Any("err", err))
+		}
+	}
+}
+
+// Returns false if the download is already released by everyone.
+func (d *Download) acquire() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.refs == 0 {
+		return false
+	}
+	d.refs++
+	return true
+}
+
+func (d *Download) Release() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.refs--
+	if d.refs == 0 {
+		d.spool.Close()
+	}
+}
+
+// A reader on the download, caller must have acquired a reference which
+// is released by closing the reader.
+func (d *Download) NewReader() *DownloadReader {
+	return &DownloadReader{d: d}
+}
+
+func (dr *DownloadReader) Read(p []byte) (int, error) {
+	d := dr.d
+	d.mtx.Lock()
+	for dr.pos >= d.written && !d.done {
+		d.cond.Wait()
+	}
+	avail := d.written - dr.pos
+	done, dErr := d.done, d.err
+	d.mtx.Unlock()
+	if avail <= 0 {
+		if dErr != nil {
+			return 0, dErr
+		}
+		if done {
+			return 0, io.EOF
+		}
+		return 0, errors.New("download reader in invalid state")
+	}
+	if int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	n, err := d.spool.ReadAt(p, dr.pos)
+	dr.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (dr *DownloadReader) Close() error {
+	dr.d.Release()
+	return nil
+}
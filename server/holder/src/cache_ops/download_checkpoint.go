@@ -0,0 +1,199 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/common/definition"
+	"github.com/common/util"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Downloads in parts survive restarts. Each part spooled is recorded in a
+// checkpoint next to the spool file, with the etag of the object, once the
+// spool is synced. At startup, pending files having a checkpoint are
+// resumed: the parts recorded are kept as long as origin still has the
+// object of the same etag and size, only the others are fetched. Pending
+// files without checkpoint are deleted with their spools, as their
+// downloads restart from scratch anyway.
+
+// Progress of a download in parts, bytes of each range sit at the same
+// offsets of the spool file.
+type DownloadCheckpoint struct {
+	Fid  string `json:"fid"`
+	Url  string `json:"url"`
+	Etag string `json:"etag"`
+	Size int64  `json:"size"`
+	// Spooled byte ranges [start, end].
+	Ranges [][2]int64 `json:"ranges"`
+}
+
+const kCheckpointSuffix = ".ckpt"
+
+func checkpointPath(fid string) string {
+	return fmt.Sprintf("%s/%s%s", GetSpoolDir(), util.GetStrMd5(fid), kCheckpointSuffix)
+}
+
+func loadCheckpoint(path string) (*DownloadCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ckpt := new(DownloadCheckpoint)
+	if err := json.Unmarshal(data, ckpt); err != nil {
+		return nil, err
+	}
+	return ckpt, nil
+}
+
+// Start checkpointing a download in parts of the object of info. Parts a
+// previous run spooled for the same object are kept, the spool is emptied
+// otherwise. Downloads of objects without etag can't be told to be the same
+// object, they aren't checkpointed.
+func (d *Download) startCheckpoint(info ObjectInfo) {
+	d.ckptMtx.Lock()
+	defer d.ckptMtx.Unlock()
+	etag := info.Validators.Etag
+	ckpt, err := loadCheckpoint(checkpointPath(d.Fid))
+	if err == nil && etag != "" && ckpt.Etag == etag && ckpt.Size == info.Size {
+		var resumed int64
+		for _, r := range ckpt.Ranges {
+			d.spooledPart(r[0], r[1]+1)
+			resumed += r[1] + 1 - r[0]
+		}
+		ZapLogger.Info("resume download", zap.Any("fid", d.Fid), zap.Any("url", d.Url),
+			zap.Any("resumed bytes", resumed), zap.Any("size", info.Size))
+		ckpt.Url = d.Url
+		d.ckpt = ckpt
+		return
+	} else if err == nil {
+		ZapLogger.Info("object changed at origin, download restarts", zap.Any("fid", d.Fid),
+			zap.Any("etag", ckpt.Etag), zap.Any("origin etag", etag))
+	}
+	d.dropCheckpointLocked()
+	if etag != "" {
+		d.ckpt = &DownloadCheckpoint{Fid: d.Fid, Url: d.Url, Etag: etag, Size: info.Size}
+	}
+}
+
+// The spool of a download not in parts starts from scratch.
+func (d *Download) dropCheckpoint() {
+	d.ckptMtx.Lock()
+	defer d.ckptMtx.Unlock()
+	d.dropCheckpointLocked()
+}
+
+func (d *Download) dropCheckpointLocked() {
+	d.ckpt = nil
+	if err := os.Remove(checkpointPath(d.Fid)); err != nil && !os.IsNotExist(err) {
+		ZapLogger.Error("remove checkpoint failed", zap.Any("fid", d.Fid), zap.Any("err", err))
+	}
+	if err := d.spool.Truncate(0); err != nil {
+		ZapLogger.Error("truncate spool failed", zap.Any("fid", d.Fid), zap.Any("err", err))
+	}
+}
+
+// Whether bytes [start, end] were spooled by a previous run.
+func (d *Download) checkpointed(start int64, end int64) bool {
+	d.ckptMtx.Lock()
+	defer d.ckptMtx.Unlock()
+	if d.ckpt == nil {
+		return false
+	}
+	for _, r := range d.ckpt.Ranges {
+		if r[0] <= start && end <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Record bytes [start, end] are spooled. A failure only costs refetching
+// the part after a restart.
+func (d *Download) checkpointPart(start int64, end int64) {
+	d.ckptMtx.Lock()
+	defer d.ckptMtx.Unlock()
+	if d.ckpt == nil {
+		return
+	}
+	d.ckpt.Ranges = append(d.ckpt.Ranges, [2]int64{start, end})
+	// The checkpoint never claims bytes not on disk yet.
+	if err := d.spool.Sync(); err != nil {
+		ZapLogger.Error("sync spool failed", zap.Any("fid", d.Fid), zap.Any("err", err))
+		return
+	}
+	data, err := json.Marshal(d.ckpt)
+	if err != nil {
+		return
+	}
+	path := checkpointPath(d.Fid)
+	if err = os.WriteFile(path+".tmp", data, 0644); err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		ZapLogger.Error("save checkpoint failed", zap.Any("fid", d.Fid), zap.Any("err", err))
+	}
+}
+
+// Resume the pending files whose download left a checkpoint, delete the
+// other pending files and clean the spool directory from what isn't
+// resumed.
+func (mgr *CacheManager) resumeDownloads() {
+	for _, ckpt := range mgr.cleanPendingDownloads() {
+		ZapLogger.Info("resume pending file", zap.Any("fid", ckpt.Fid),
+			zap.Any("url", ckpt.Url), zap.Any("parts", len(ckpt.Ranges)))
+		go mgr.dowloadAndWriteCache(ckpt.Url, ckpt.Fid)
+	}
+}
+
+// Checkpoints of the pending files to resume, the other pending files and
+// spool files are deleted.
+func (mgr *CacheManager) cleanPendingDownloads() []*DownloadCheckpoint {
+	spoolDir := GetSpoolDir()
+	entries, err := os.ReadDir(spoolDir)
+	if err != nil && !os.IsNotExist(err) {
+		ZapLogger.Error("read spool dir failed", zap.Any("err", err))
+	}
+	var resumed []*DownloadCheckpoint
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), kCheckpointSuffix) {
+			continue
+		}
+		ckpt, err := loadCheckpoint(spoolDir + "/" + entry.Name())
+		if err != nil {
+			ZapLogger.Warn("invalid checkpoint", zap.Any("file", entry.Name()), zap.Any("err", err))
+			continue
+		}
+		_, state, err := mgr.dbOpsFile.ListFileAndStateFromDB(ckpt.Fid)
+		if err == nil && state == definition.F_DB_STATE_PENDING {
+			resumed = append(resumed, ckpt)
+		}
+	}
+
+	keep := make([]string, 0, len(resumed))
+	kept := make(map[string]struct{})
+	for _, ckpt := range resumed {
+		keep = append(keep, ckpt.Fid)
+		md5 := util.GetStrMd5(ckpt.Fid)
+		kept[md5+".part"] = struct{}{}
+		kept[md5+kCheckpointSuffix] = struct{}{}
+	}
+	ZapLogger.Info("DELETE PENDING FILES IN DB", zap.Any("resumed", len(keep)))
+	mgr.dbOpsFile.DeleteAllPendingFileInDB(keep)
+	for _, entry := range entries {
+		if _, exist := kept[entry.Name()]; exist {
+			continue
+		}
+		if err := os.RemoveAll(spoolDir + "/" + entry.Name()); err != nil {
+			ZapLogger.Error("clean spool dir failed", zap.Any("err", err))
+		}
+	}
+	return resumed
+}
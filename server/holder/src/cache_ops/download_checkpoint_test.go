@@ -0,0 +1,178 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	db_ops "holder/src/db_ops"
+	"holder/src/file_handler"
+
+	"github.com/common/definition"
+	"github.com/common/util"
+)
+
+// Checkpoint parts [0, 1023] and [2048, 3071] of the object of info for
+// fid, as a previous run would have.
+func checkpointTestParts(t *testing.T, fid string, url string, data []byte, info ObjectInfo) {
+	d := newTestDownload(t, fid)
+	d.Url = url
+	d.startCheckpoint(info)
+	for _, start := range []int64{0, 2048} {
+		d.spool.WriteAt(data[start:start+1024], start)
+		d.checkpointPart(start, start+1023)
+	}
+}
+
+func TestCheckpointResumedOnSameObject(t *testing.T) {
+	setupDownloads(t, 1024, 1, 0)
+	data := randomBytes(4 * 1024)
+	info := ObjectInfo{Size: int64(len(data)), Validators: Validators{Etag: `"v1"`},
+		Ranges: true}
+	checkpointTestParts(t, "obj", "mem://obj", data, info)
+	st, err := os.Stat(checkpointPath("obj"))
+	if err != nil || st.Mode().Perm() != 0644 {
+		t.Fatalf("checkpoint %v, %v", st, err)
+	}
+
+	d := newTestDownload(t, "obj")
+	d.startCheckpoint(info)
+	if !d.checkpointed(0, 1023) || !d.checkpointed(2048, 3071) || d.checkpointed(1024, 2047) ||
+		d.Written() != 1024 {
+		t.Fatalf("not resumed, %d bytes spooled", d.Written())
+	}
+
+	for _, changed := range []ObjectInfo{
+		{Size: info.Size, Validators: Validators{Etag: `"v2"`}, Ranges: true},
+		{Size: info.Size + 1, Validators: info.Validators, Ranges: true},
+		{Size: info.Size, Ranges: true},
+	} {
+		checkpointTestParts(t, "obj", "mem://obj", data, info)
+		d := newTestDownload(t, "obj")
+		d.startCheckpoint(changed)
+		if d.checkpointed(0, 1023) || d.Written() != 0 {
+			t.Fatalf("%+v: resumed %d bytes", changed, d.Written())
+		}
+		if st, _ := d.spool.Stat(); st.Size() != 0 {
+			t.Fatalf("%+v: spool not emptied", changed)
+		}
+	}
+}
+
+// Only the parts missing from the checkpoint are fetched.
+func TestFetchPartsSkipsCheckpointed(t *testing.T) {
+	setupDownloads(t, 1024, 2, 0)
+	mo := &memOrigin{data: randomBytes(4*1024 + 7), etag: `"v1"`}
+	info, _ := mo.Stat("mem://obj")
+	checkpointTestParts(t, "obj", "mem://obj", mo.data, info)
+
+	d := newTestDownload(t, "obj")
+	d.startCheckpoint(info)
+	if err := fetchParts(d, mo, info); err != nil {
+		t.Fatal(err)
+	}
+	for _, rng := range mo.ranges {
+		if rng == "bytes=0-1023" || rng == "bytes=2048-3071" {
+			t.Fatalf("fetched checkpointed %s", rng)
+		}
+	}
+	if len(mo.ranges) != 3 || !bytes.Equal(spooled(t, d), mo.data) {
+		t.Fatalf("fetched %v", mo.ranges)
+	}
+	ckpt, err := loadCheckpoint(checkpointPath("obj"))
+	if err != nil || len(ckpt.Ranges) != 5 {
+		t.Fatalf("checkpoint %+v, %v", ckpt, err)
+	}
+}
+
+// At startup, pending files with a checkpoint resume and the others are
+// deleted, with the spool files of neither.
+func TestCleanPendingDownloads(t *testing.T) {
+	setupDownloads(t, 1024, 2, 0)
+	data := randomBytes(4 * 1024)
+	info := ObjectInfo{Size: int64(len(data)), Validators: Validators{Etag: `"v1"`},
+		Ranges: true}
+	bs := new(db_ops.BoltStore)
+	bs.New("")
+	defer bs.Close()
+	for _, fid := range []string{"resumed", "stale"} {
+		bs.CreateFileWithFidInDB(fid, &definition.FileMeta{Name: "mem://" + fid, MaxAge: -1})
+	}
+	checkpointTestParts(t, "resumed", "mem://resumed", data, info)
+	stale := newTestDownload(t, "stale")
+	stale.Write(data[:100])
+	// Checkpoint of a file no longer pending.
+	checkpointTestParts(t, "gone", "mem://gone", data, info)
+	os.WriteFile(GetSpoolDir()+"/stray", data, 0644)
+
+	mgr := &CacheManager{dbOpsFile: bs}
+	resumed := mgr.cleanPendingDownloads()
+	if len(resumed) != 1 || resumed[0].Fid != "resumed" || resumed[0].Url != "mem://resumed" ||
+		len(resumed[0].Ranges) != 2 {
+		t.Fatalf("resumed %+v", resumed)
+	}
+	if _, state, _ := bs.ListFileAndStateFromDB("resumed"); state != definition.F_DB_STATE_PENDING {
+		t.Fatalf("resumed file in state %d", state)
+	}
+	if _, state, _ := bs.ListFileAndStateFromDB("stale"); state == definition.F_DB_STATE_PENDING {
+		t.Fatal("pending file without checkpoint kept")
+	}
+	entries, _ := os.ReadDir(GetSpoolDir())
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	md5 := util.GetStrMd5("resumed")
+	if fmt.Sprint(names) != fmt.Sprint([]string{md5 + kCheckpointSuffix, md5 + ".part"}) {
+		t.Fatalf("spool dir holds %v", names)
+	}
+}
+
+// A resumed download is sealed whole, and read back from cache.
+func TestResumedDownloadReadable(t *testing.T) {
+	mgr := newTestManager(t, 1024*1024)
+	definition.F_download_part_size = 1024
+	definition.F_download_parallel = 2
+	path := writeTestObject(t, 4*1024+100)
+	data, _ := os.ReadFile(path)
+	info, err := localOrigin.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr.dbOpsFile.CreateFileWithFidInDB("resumed", &definition.FileMeta{Name: path, MaxAge: -1})
+	checkpointTestParts(t, "resumed", path, data, info)
+
+	resumed := mgr.cleanPendingDownloads()
+	if len(resumed) != 1 {
+		t.Fatalf("resumed %+v", resumed)
+	}
+	d, err := mgr.AttachDownload(resumed[0].Fid, resumed[0].Url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Release()
+	if err := d.WaitCommitted(); err != nil {
+		t.Fatal(err)
+	}
+
+	fm, _, err := mgr.dbOpsFile.ListFileAndOwnersFromDB("resumed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := file_handler.FileReader{Pbh: mgr.pbh, FileDb: mgr.dbOpsFile}
+	br, err := fr.OpenFromCache("resumed", fm.RngCodeList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	got, err := io.ReadAll(io.NewSectionReader(br, 0, br.Size()))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes from cache, %v", len(got), err)
+	}
+}
@@ -0,0 +1,165 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/common/definition"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Large objects are downloaded as F_download_parallel concurrent ranged
+// reads of F_download_part_size bytes, each spooled at its offset so no
+// part is held in memory. Parts are handed out in order, readers of the
+// download follow as soon as the bytes before them are all spooled. A
+// failed part is retried from where it stopped, every part is read on
+// condition of the etag Stat told, a changed object fails the download.
+// The CRC64 of the spool is computed in 1 pass as it's spooled in order. Parts spooled
+// are checkpointed so the download resumes after a restart, see
+// download_checkpoint.go.
+
+// Spool the object of info into d, in parts if it's large.
+func fetchObject(d *Download, info ObjectInfo) error {
+	origin, err := OriginOf(d.Url)
+	if err != nil {
+		return err
+	}
+	if info.Crc64 != "" {
+		d.startCrc64()
+	}
+	if downloadInParts(info) {
+		d.setReady(info.Size, info.Validators)
+		d.startCheckpoint(info)
+		return fetchParts(d, origin, info)
+	}
+	d.dropCheckpoint()
+	resp, err := origin.Get(d.Url, "", info.Validators.Etag)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	d.setReady(info.Size, resp.Validators)
+	_, err = io.Copy(d, resp.Body)
+	return err
+}
+
+// Check the spooled object against the size, etag and CRC64 CheckUrl told.
+func verifyDownload(d *Download, info ObjectInfo) error {
+	if written := d.Written(); info.Size >= 0 && written != info.Size {
+		return fmt.Errorf("download size mismatch, expect %d, got %d", info.Size, written)
+	}
+	if etag := info.Validators.Etag; etag != "" && d.Validators.Etag != "" &&
+		d.Validators.Etag != etag {
+		return ErrOriginChanged
+	}
+	if info.Crc64 != "" {
+		sum, err := d.spooledCrc64()
+		if err != nil {
+			return err
+		}
+		return matchCrc64(sum, info.Crc64)
+	}
+	return nil
+}
+
+// Whether the object of info is downloaded in parts.
+func downloadInParts(info ObjectInfo) bool {
+	return info.Ranges && definition.F_download_part_size > 0 &&
+		info.Size > definition.F_download_part_size
+}
+
+// Spool the object of info into d in parts.
+func fetchParts(d *Download, origin Origin, info ObjectInfo) error {
+	partSize := definition.F_download_part_size
+	starts := make(chan int64)
+	stop := make(chan struct{})
+	go func() {
+		defer close(starts)
+		for start := int64(0); start < info.Size; start += partSize {
+			select {
+			case starts <- start:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	workers := definition.F_download_parallel
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := int64(0); i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range starts {
+				end := start + partSize - 1
+				if end > info.Size-1 {
+					end = info.Size - 1
+				}
+				if d.checkpointed(start, end) {
+					continue
+				}
+				if err := fetchPart(d, origin, start, end, info.Validators.Etag); err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(stop)
+					})
+					return
+				}
+				d.checkpointPart(start, end)
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// Spool bytes [start, end] of the object, retried from where it stopped.
+func fetchPart(d *Download, origin Origin, start int64, end int64, etag string) error {
+	pw := &partWriter{d: d, start: start, pos: start}
+	var err error
+	for attempt := int64(0); attempt <= definition.F_download_part_retries; attempt++ {
+		if attempt > 0 {
+			ZapLogger.Warn("retry download part", zap.Any("url", d.Url),
+				zap.Any("start", start), zap.Any("pos", pw.pos), zap.Any("end", end),
+				zap.Any("attempt", attempt), zap.Any("err", err))
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		err = fetchRange(origin, d.Url, pw, end, etag)
+		if err == nil || errors.Is(err, ErrOriginChanged) || errors.Is(err, ErrOriginNotFound) {
+			return err
+		}
+	}
+	return err
+}
+
+func fetchRange(origin Origin, url string, pw *partWriter, end int64, etag string) error {
+	resp, err := origin.Get(url, fmt.Sprintf("bytes=%d-%d", pw.pos, end), etag)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// A whole object answered to a conditional range is another object.
+	if !resp.Partial {
+		return fmt.Errorf("%w: range %d-%d not honored", ErrOriginChanged, pw.pos, end)
+	}
+	if _, err := io.Copy(pw, io.LimitReader(resp.Body, end+1-pw.pos)); err != nil {
+		return err
+	}
+	if pw.pos != end+1 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
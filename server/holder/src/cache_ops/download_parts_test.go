@@ -0,0 +1,284 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/common/definition"
+)
+
+// Spool downloads to a temporary directory in parts of partSize, all
+// restored once the test is done.
+func setupDownloads(t *testing.T, partSize int64, parallel int64, retries int64) {
+	prefix := definition.BlobLocalPathPrefix
+	size, par, ret := definition.F_download_part_size, definition.F_download_parallel,
+		definition.F_download_part_retries
+	t.Cleanup(func() {
+		definition.BlobLocalPathPrefix = prefix
+		definition.F_download_part_size, definition.F_download_parallel,
+			definition.F_download_part_retries = size, par, ret
+	})
+	definition.BlobLocalPathPrefix = t.TempDir()
+	definition.F_download_part_size = partSize
+	definition.F_download_parallel = parallel
+	definition.F_download_part_retries = retries
+}
+
+func newTestDownload(t *testing.T, fid string) *Download {
+	d := new(Download)
+	if err := d.New(fid, "mem://"+fid); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Release)
+	return d
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+var errCut = errors.New("connection cut")
+
+// Origin of 1 object in memory, answering single ranges.
+type memOrigin struct {
+	data []byte
+	etag string
+	// Called before answering the range from start, returns how many bytes
+	// are sent before the body fails, -1 sends them all.
+	hook func(start int64) int64
+
+	mtx    sync.Mutex
+	ranges []string
+}
+
+func (mo *memOrigin) Stat(url string) (ObjectInfo, error) {
+	return ObjectInfo{Size: int64(len(mo.data)), Validators: Validators{Etag: mo.etag},
+		Ranges: true}, nil
+}
+
+func (mo *memOrigin) Get(url string, rng string, etag string) (*OriginResponse, error) {
+	mo.mtx.Lock()
+	mo.ranges = append(mo.ranges, rng)
+	mo.mtx.Unlock()
+	if etag != "" && etag != mo.etag {
+		return nil, ErrOriginChanged
+	}
+	start, end, _, err := parseByteRange(rng, int64(len(mo.data)))
+	if err != nil {
+		return nil, err
+	}
+	body := io.Reader(bytes.NewReader(mo.data[start : end+1]))
+	if mo.hook != nil {
+		if sent := mo.hook(start); sent >= 0 {
+			body = io.MultiReader(bytes.NewReader(mo.data[start:start+sent]),
+				iotest.ErrReader(errCut))
+		}
+	}
+	return &OriginResponse{Body: io.NopCloser(body), Size: end + 1 - start, Partial: true,
+		Validators: Validators{Etag: mo.etag}}, nil
+}
+
+func (mo *memOrigin) Revalidate(url string, etag string) (bool, Validators, error) {
+	return etag == mo.etag, Validators{Etag: mo.etag}, nil
+}
+
+func spooled(t *testing.T, d *Download) []byte {
+	data, err := io.ReadAll(d.spoolReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// The first part is answered last, readers see nothing until it's spooled
+// and then the whole object.
+func TestFetchPartsOutOfOrder(t *testing.T) {
+	setupDownloads(t, 1024, 5, 0)
+	d := newTestDownload(t, "out-of-order")
+	mo := &memOrigin{data: randomBytes(5*1024 + 7), etag: `"v1"`}
+	var beforeFirst int64 = -1
+	mo.hook = func(start int64) int64 {
+		if start != 0 {
+			return -1
+		}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			d.mtx.Lock()
+			others := len(d.parts)
+			d.mtx.Unlock()
+			if others == 5 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		beforeFirst = d.Written()
+		return -1
+	}
+	info, _ := mo.Stat(d.Url)
+	d.startCrc64()
+	d.setReady(info.Size, info.Validators)
+	d.acquire()
+	read := make(chan []byte)
+	go func() {
+		reader := d.NewReader()
+		defer reader.Close()
+		data, _ := io.ReadAll(reader)
+		read <- data
+	}()
+
+	err := fetchParts(d, mo, info)
+	d.finish(err)
+	if err != nil || beforeFirst != 0 {
+		t.Fatalf("got %v, %d bytes readable before the first part", err, beforeFirst)
+	}
+	if got := <-read; !bytes.Equal(got, mo.data) {
+		t.Fatalf("reader got %d bytes", len(got))
+	}
+	if !bytes.Equal(spooled(t, d), mo.data) {
+		t.Fatal("spool differs from the object")
+	}
+	sum, err := d.spooledCrc64()
+	if err != nil || sum != crc64.Checksum(mo.data, crc64Table) {
+		t.Fatalf("crc64 %d, %v", sum, err)
+	}
+}
+
+// A part cut short is requested again from where it stopped.
+func TestFetchPartRetry(t *testing.T) {
+	setupDownloads(t, 1024, 1, 1)
+	d := newTestDownload(t, "retry")
+	mo := &memOrigin{data: randomBytes(2048), etag: `"v1"`}
+	cut := true
+	mo.hook = func(start int64) int64 {
+		if cut {
+			cut = false
+			return 100
+		}
+		return -1
+	}
+	if err := fetchPart(d, mo, 1024, 2047, mo.etag); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bytes=1024-2047", "bytes=1124-2047"}; fmt.Sprint(mo.ranges) !=
+		fmt.Sprint(want) {
+		t.Fatalf("requested %v", mo.ranges)
+	}
+	got := make([]byte, 1024)
+	if _, err := d.spool.ReadAt(got, 1024); err != nil || !bytes.Equal(got, mo.data[1024:]) {
+		t.Fatalf("part differs from the object, %v", err)
+	}
+
+	// Retries exhausted.
+	mo.hook = func(start int64) int64 { return 10 }
+	if err := fetchPart(d, mo, 0, 1023, mo.etag); !errors.Is(err, errCut) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// Parts are read on condition of the etag, a changed object or a range
+// answered whole fails the download.
+func TestFetchPartsOriginChanged(t *testing.T) {
+	setupDownloads(t, 1024, 2, 3)
+	data := randomBytes(3 * 1024)
+	etag, ranges := `"v1"`, true
+	var ifMatch []string
+	var mtx sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		ifMatch = append(ifMatch, r.Header.Get("If-Match"))
+		mtx.Unlock()
+		w.Header().Set("ETag", etag)
+		if !ranges {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data)
+			return
+		}
+		// Answers 412 when If-Match doesn't match.
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+	info := ObjectInfo{Size: int64(len(data)), Validators: Validators{Etag: `"v1"`},
+		Ranges: true}
+
+	d := newTestDownload(t, "unchanged")
+	d.Url = srv.URL + "/obj"
+	if err := fetchParts(d, NewHttpOrigin(), info); err != nil ||
+		!bytes.Equal(spooled(t, d), data) {
+		t.Fatalf("got %v", err)
+	}
+	for _, h := range ifMatch {
+		if h != `"v1"` {
+			t.Fatalf("sent If-Match %q", h)
+		}
+	}
+
+	etag = `"v2"`
+	d = newTestDownload(t, "changed")
+	d.Url = srv.URL + "/obj"
+	if err := fetchParts(d, NewHttpOrigin(), info); !errors.Is(err, ErrOriginChanged) {
+		t.Fatalf("changed etag: got %v", err)
+	}
+
+	etag, ranges = `"v1"`, false
+	d = newTestDownload(t, "whole")
+	d.Url = srv.URL + "/obj"
+	if err := fetchParts(d, NewHttpOrigin(), info); !errors.Is(err, ErrOriginChanged) {
+		t.Fatalf("whole object answered: got %v", err)
+	}
+}
+
+func TestVerifyDownload(t *testing.T) {
+	setupDownloads(t, 0, 1, 0)
+	data := randomBytes(10000)
+	info := ObjectInfo{Size: int64(len(data)), Validators: Validators{Etag: `"v1"`},
+		Crc64: strconv.FormatUint(crc64.Checksum(data, crc64Table), 10)}
+	download := func(fid string, data []byte) *Download {
+		d := newTestDownload(t, fid)
+		d.startCrc64()
+		d.setReady(info.Size, info.Validators)
+		// Written in uneven writes, as bodies are copied.
+		for p := data; len(p) > 0; {
+			n := 1 + rand.Intn(3000)
+			if n > len(p) {
+				n = len(p)
+			}
+			d.Write(p[:n])
+			p = p[n:]
+		}
+		return d
+	}
+
+	if err := verifyDownload(download("ok", data), info); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyDownload(download("short", data[:len(data)-1]), info); err == nil {
+		t.Fatal("size mismatch not detected")
+	}
+	corrupted := append([]byte(nil), data...)
+	corrupted[5000] ^= 0xff
+	if err := verifyDownload(download("crc", corrupted), info); !errors.Is(err,
+		ErrOriginCrcMismatch) {
+		t.Fatalf("crc64 mismatch: got %v", err)
+	}
+	d := download("etag", data)
+	d.Validators.Etag = `"v2"`
+	if err := verifyDownload(d, info); !errors.Is(err, ErrOriginChanged) {
+		t.Fatalf("etag mismatch: got %v", err)
+	}
+}
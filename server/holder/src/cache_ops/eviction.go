@@ -0,0 +1,191 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"time"
+
+	blob "holder/src/blob_handler"
+
+	"github.com/common/definition"
+	range_code "github.com/common/range_code"
+	"github.com/common/util"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Objects are evicted 1 by 1 in the order of the eviction policy, so hot
+// objects survive even if they share a triplet with cold ones. Evicting an object
+// deletes its file entry at once, its blob is deleted after
+// F_cache_purge_waiting_ms so readers which already looked up the entry
+// can finish. Blobs replaced by a refetch are deleted the same way. Space
+// is reclaimed when the triplet of the blob is purged or compacted.
+
+type cachedObject struct {
+	fid   string
+	token string
+	size  int64
+}
+
+// A blob waiting for its deletion.
+type blobPurge struct {
+	token string
+	at    time.Time
+}
+
+// Called on every cache hit and when a file is cached.
+func (mgr *CacheManager) TouchObject(fid string, token string, size int64) {
+	if mgr.touchPinned(fid, token, size) {
+		return
+	}
+	mgr.objects.Touch(fid, token, size)
+}
+
+// Rebuild the eviction policy at startup: its saved state is restored over
+// the ready files of DB, files cached after the state was saved are
+// touched on top. Without saved state, files are touched in fid order.
+// Pinned files are left out of the eviction policy.
+func (mgr *CacheManager) loadObjects() {
+	live := make(map[string]cachedObject)
+	var fids []string
+	afterFid := ""
+	for {
+		rows, err := mgr.dbOpsFile.ListFilesFromDB(afterFid, kMetaGcPageSize)
+		if err != nil {
+			ZapLogger.Error("loadObjects failed", zap.Any("err", err))
+			return
+		}
+		for _, row := range rows {
+			if row.State != definition.F_DB_STATE_READY ||
+				row.Meta.RngCodeList == nil || row.Meta.RngCodeList.Len() == 0 {
+				continue
+			}
+			rngCode := row.Meta.RngCodeList.Front().Value.(range_code.RangeCode)
+			size := rngCode.End - rngCode.Start
+			if mgr.touchPinned(row.Fid, rngCode.Token, size) {
+				continue
+			}
+			live[row.Fid] = cachedObject{fid: row.Fid, token: rngCode.Token, size: size}
+			fids = append(fids, row.Fid)
+		}
+		if len(rows) < kMetaGcPageSize {
+			break
+		}
+		afterFid = rows[len(rows)-1].Fid
+	}
+	restored := mgr.loadEvictionState(live)
+	for _, fid := range fids {
+		if !mgr.objects.Has(fid) {
+			mgr.objects.Touch(fid, live[fid].token, live[fid].size)
+		}
+	}
+	ZapLogger.Info("loadObjects finished", zap.Any("policy", mgr.policyName),
+		zap.Any("restored", restored), zap.Any("objects", mgr.objects.Len()),
+		zap.Any("pinned", len(mgr.pinned)))
+}
+
+// Evict objects in the order of the eviction policy until at least
+// needBytes of blobs are deleted, 1 object at least.
+func (mgr *CacheManager) EnqueueDeletionReq(needBytes int64) {
+	mgr.evict(needBytes)
+}
+
+// Same as EnqueueDeletionReq, returns the bytes evicted.
+func (mgr *CacheManager) evict(needBytes int64) int64 {
+	freed := int64(0)
+	for freed < needBytes || freed == 0 {
+		obj, ok := mgr.objects.PopVictim()
+		if !ok {
+			ZapLogger.Warn("nothing left to evict", zap.Any("needBytes", needBytes))
+			return freed
+		}
+		err := mgr.dbOpsFile.DeleteFileWithFidAndOwnerInDB(
+			obj.fid, util.GetTripletIdFromToken(obj.token))
+		if err != nil {
+			ZapLogger.Error("DELETE FILE IN DB ERROR", zap.Any("fid", obj.fid), zap.Any("error", err))
+			mgr.objects.Touch(obj.fid, obj.token, obj.size)
+			return freed
+		}
+		ZapLogger.Info("Evicted object", zap.Any("fid", obj.fid),
+			zap.Any("token", obj.token), zap.Any("size", obj.size))
+		mgr.enqueueBlobPurge(obj.token)
+		freed += obj.size
+	}
+	return freed
+}
+
+// Delete the blobs of fm, but the one of keepToken, once readers are done
+// with them.
+func (mgr *CacheManager) releaseBlobs(fm *definition.FileMeta, keepToken string) {
+	if fm == nil || fm.RngCodeList == nil {
+		return
+	}
+	for e := fm.RngCodeList.Front(); e != nil; e = e.Next() {
+		token := e.Value.(range_code.RangeCode).Token
+		if token != "" && token != keepToken {
+			mgr.enqueueBlobPurge(token)
+		}
+	}
+}
+
+func hasToken(fm *definition.FileMeta, token string) bool {
+	if fm == nil || fm.RngCodeList == nil {
+		return false
+	}
+	for e := fm.RngCodeList.Front(); e != nil; e = e.Next() {
+		if e.Value.(range_code.RangeCode).Token == token {
+			return true
+		}
+	}
+	return false
+}
+
+func (mgr *CacheManager) enqueueBlobPurge(token string) {
+	mgr.bMtx.Lock()
+	defer mgr.bMtx.Unlock()
+	mgr.bQueue = append(mgr.bQueue, blobPurge{token: token, at: time.Now()})
+}
+
+// Delete blobs whose waiting is over, then reclaim the space of their
+// triplets.
+func (mgr *CacheManager) purgeBlobs() {
+	mgr.bMtx.Lock()
+	var due []blobPurge
+	for len(mgr.bQueue) > 0 && time.Now().Sub(mgr.bQueue[0].at).Milliseconds() >=
+		definition.F_cache_purge_waiting_ms {
+		due = append(due, mgr.bQueue[0])
+		mgr.bQueue = mgr.bQueue[1:]
+	}
+	mgr.bMtx.Unlock()
+
+	touched := make(map[string]*blob.Triplet)
+	for _, bp := range due {
+		tplt, err := mgr.pbh.DeleteBlob(bp.token)
+		if err != nil {
+			ZapLogger.Warn("DeleteBlob failed", zap.Any("token", bp.token), zap.Any("err", err))
+		}
+		if tplt != nil {
+			touched[tplt.Id] = tplt
+		}
+	}
+	for _, tplt := range touched {
+		mgr.reclaimTriplet(tplt)
+	}
+}
+
+// Purge the triplet if none of its blobs is alive. Open triplets are left
+// alone, partially live closed ones are left to the compactor.
+func (mgr *CacheManager) reclaimTriplet(tplt *blob.Triplet) {
+	if mgr.isCompacting(tplt.Id) {
+		return
+	}
+	if !mgr.pbh.IsLargeTriplet(tplt.Id) && !mgr.pbh.IsClosedTriplet(tplt.Id) {
+		return
+	}
+	if tplt.NumBlobs() == 0 {
+		ZapLogger.Info("Purge triplet with no live blob", zap.Any("tpltId", tplt.Id))
+		mgr.pbh.PurgeTriplet(tplt.Id)
+	}
+}
@@ -0,0 +1,240 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+)
+
+// Adaptive replacement cache, counted in bytes. Objects accessed once sit
+// in t1, objects accessed again move to t2, both in recency order. Evicted
+// objects leave a ghost in b1 or b2 without their content. A hit on a
+// ghost of b1 means t1 was too small, the target bytes p of t1 grows; a hit
+// on a ghost of b2 shrinks it. Evictions take t1 while it's above p, else
+// t2. Ghosts take at most as many bytes as cached objects.
+
+const (
+	kArcT1 = iota
+	kArcT2
+	kArcB1
+	kArcB2
+)
+
+type arcEntry struct {
+	obj  cachedObject
+	list int
+	elem *list.Element
+}
+
+type ObjectArc struct {
+	mtx   sync.Mutex
+	lists [4]*list.List
+	bytes [4]int64
+	items map[string]*arcEntry
+	// Target bytes of t1.
+	p int64
+}
+
+func (arc *ObjectArc) New() {
+	for i := range arc.lists {
+		arc.lists[i] = list.New()
+	}
+	arc.items = make(map[string]*arcEntry)
+}
+
+func (arc *ObjectArc) residentBytes() int64 {
+	return arc.bytes[kArcT1] + arc.bytes[kArcT2]
+}
+
+func (arc *ObjectArc) unlink(e *arcEntry) {
+	arc.lists[e.list].Remove(e.elem)
+	arc.bytes[e.list] -= e.obj.size
+}
+
+// Push e as the most recent of list l.
+func (arc *ObjectArc) pushFront(e *arcEntry, l int) {
+	e.list = l
+	e.elem = arc.lists[l].PushFront(e)
+	arc.bytes[l] += e.obj.size
+}
+
+func (arc *ObjectArc) Touch(fid string, token string, size int64) {
+	arc.mtx.Lock()
+	defer arc.mtx.Unlock()
+	obj := cachedObject{fid: fid, token: token, size: size}
+	e, exist := arc.items[fid]
+	if !exist {
+		e = &arcEntry{obj: obj}
+		arc.items[fid] = e
+		arc.pushFront(e, kArcT1)
+		arc.trimGhosts()
+		return
+	}
+	switch e.list {
+	case kArcB1:
+		delta := size
+		if arc.bytes[kArcB1] > 0 && arc.bytes[kArcB2] > arc.bytes[kArcB1] {
+			delta = size * arc.bytes[kArcB2] / arc.bytes[kArcB1]
+		}
+		arc.p += delta
+		if limit := arc.residentBytes() + size; arc.p > limit {
+			arc.p = limit
+		}
+	case kArcB2:
+		delta := size
+		if arc.bytes[kArcB2] > 0 && arc.bytes[kArcB1] > arc.bytes[kArcB2] {
+			delta = size * arc.bytes[kArcB1] / arc.bytes[kArcB2]
+		}
+		arc.p -= delta
+		if arc.p < 0 {
+			arc.p = 0
+		}
+	}
+	arc.unlink(e)
+	e.obj = obj
+	arc.pushFront(e, kArcT2)
+	arc.trimGhosts()
+}
+
+// Drop the oldest ghosts until ghosts take no more bytes than cached
+// objects.
+func (arc *ObjectArc) trimGhosts() {
+	for arc.bytes[kArcB1]+arc.bytes[kArcB2] > arc.residentBytes() {
+		l := kArcB2
+		if arc.bytes[kArcB1] > arc.bytes[kArcB2] {
+			l = kArcB1
+		}
+		e := arc.lists[l].Back().Value.(*arcEntry)
+		arc.unlink(e)
+		delete(arc.items, e.obj.fid)
+	}
+}
+
+func (arc *ObjectArc) Retoken(fid string, oldToken string, newToken string) bool {
+	arc.mtx.Lock()
+	defer arc.mtx.Unlock()
+	e, exist := arc.items[fid]
+	if !exist || e.list > kArcT2 {
+		return false
+	}
+	if e.obj.token == oldToken {
+		e.obj.token = newToken
+	}
+	return true
+}
+
+// Pop the least recent object of t1 if t1 is above its target, else the
+// one of t2. It's left as a ghost.
+func (arc *ObjectArc) PopVictim() (cachedObject, bool) {
+	arc.mtx.Lock()
+	defer arc.mtx.Unlock()
+	from, to := kArcT2, kArcB2
+	if arc.lists[kArcT1].Len() > 0 &&
+		(arc.bytes[kArcT1] > arc.p || arc.lists[kArcT2].Len() == 0) {
+		from, to = kArcT1, kArcB1
+	}
+	back := arc.lists[from].Back()
+	if back == nil {
+		return cachedObject{}, false
+	}
+	e := back.Value.(*arcEntry)
+	obj := e.obj
+	arc.unlink(e)
+	e.obj.token = ""
+	arc.pushFront(e, to)
+	arc.trimGhosts()
+	return obj, true
+}
+
+// Forget fid, ghost included.
+func (arc *ObjectArc) Remove(fid string) {
+	arc.mtx.Lock()
+	defer arc.mtx.Unlock()
+	if e, exist := arc.items[fid]; exist {
+		arc.unlink(e)
+		delete(arc.items, fid)
+		arc.trimGhosts()
+	}
+}
+
+func (arc *ObjectArc) Has(fid string) bool {
+	arc.mtx.Lock()
+	defer arc.mtx.Unlock()
+	e, exist := arc.items[fid]
+	return exist && e.list <= kArcT2
+}
+
+func (arc *ObjectArc) Len() int {
+	arc.mtx.Lock()
+	defer arc.mtx.Unlock()
+	return arc.lists[kArcT1].Len() + arc.lists[kArcT2].Len()
+}
+
+type arcGhostState struct {
+	Fid  string `json:"fid"`
+	Size int64  `json:"size"`
+}
+
+// Lists are saved from the least to the most recent.
+type objectArcState struct {
+	P  int64           `json:"p"`
+	T1 []string        `json:"t1"`
+	T2 []string        `json:"t2"`
+	B1 []arcGhostState `json:"b1"`
+	B2 []arcGhostState `json:"b2"`
+}
+
+func (arc *ObjectArc) MarshalState() ([]byte, error) {
+	arc.mtx.Lock()
+	defer arc.mtx.Unlock()
+	state := objectArcState{P: arc.p}
+	for l, fids := range []*[]string{&state.T1, &state.T2} {
+		for e := arc.lists[l].Back(); e != nil; e = e.Prev() {
+			*fids = append(*fids, e.Value.(*arcEntry).obj.fid)
+		}
+	}
+	for l, ghosts := range map[int]*[]arcGhostState{kArcB1: &state.B1, kArcB2: &state.B2} {
+		for e := arc.lists[l].Back(); e != nil; e = e.Prev() {
+			obj := e.Value.(*arcEntry).obj
+			*ghosts = append(*ghosts, arcGhostState{Fid: obj.fid, Size: obj.size})
+		}
+	}
+	return json.Marshal(state)
+}
+
+func (arc *ObjectArc) UnmarshalState(data []byte, live map[string]cachedObject) error {
+	var state objectArcState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	arc.mtx.Lock()
+	defer arc.mtx.Unlock()
+	arc.p = state.P
+	for l, fids := range [][]string{state.T1, state.T2} {
+		for _, fid := range fids {
+			obj, ok := live[fid]
+			if _, exist := arc.items[fid]; !ok || exist {
+				continue
+			}
+			e := &arcEntry{obj: obj}
+			arc.items[fid] = e
+			arc.pushFront(e, l)
+		}
+	}
+	for l, ghosts := range map[int][]arcGhostState{kArcB1: state.B1, kArcB2: state.B2} {
+		for _, g := range ghosts {
+			if _, exist := arc.items[g.Fid]; exist {
+				continue
+			}
+			e := &arcEntry{obj: cachedObject{fid: g.Fid, size: g.Size}}
+			arc.items[g.Fid] = e
+			arc.pushFront(e, l)
+		}
+	}
+	arc.trimGhosts()
+	return nil
+}
@@ -0,0 +1,216 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"container/heap"
+	"encoding/json"
+	"sync"
+)
+
+// LFU and GDSF both evict the object of lowest priority, they only differ
+// in how the priority is computed. Priorities start from the inflation L,
+// the priority of the last evicted object, so objects accessed long ago
+// age out against recent ones (dynamic aging):
+//   - LFU: L + freq
+//   - GDSF: L + freq * K_gdsf_unit_size / size
+//
+// Ties are broken by access order.
+
+// Sizes are counted in this unit by GDSF, so the priorities of objects of
+// different sizes stay comparable with the inflation.
+const K_gdsf_unit_size = 1024 * 1024
+
+type heapEntry struct {
+	obj      cachedObject
+	freq     int64
+	priority float64
+	tick     uint64
+	index    int
+}
+
+type entryHeap []*heapEntry
+
+func (h entryHeap) Len() int { return len(h) }
+
+func (h entryHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	e := x.(*heapEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// ObjectHeap evicts the object of lowest priority, see above.
+type ObjectHeap struct {
+	mtx       sync.Mutex
+	h         entryHeap
+	items     map[string]*heapEntry
+	inflation float64
+	tick      uint64
+	sizeAware bool
+}
+
+func newObjectLfu() *ObjectHeap {
+	oh := new(ObjectHeap)
+	oh.New(false)
+	return oh
+}
+
+func newObjectGdsf() *ObjectHeap {
+	oh := new(ObjectHeap)
+	oh.New(true)
+	return oh
+}
+
+// With sizeAware the priority is the one of GDSF, else the one of LFU.
+func (oh *ObjectHeap) New(sizeAware bool) {
+	oh.items = make(map[string]*heapEntry)
+	oh.sizeAware = sizeAware
+}
+
+func (oh *ObjectHeap) priority(freq int64, size int64) float64 {
+	if !oh.sizeAware {
+		return oh.inflation + float64(freq)
+	}
+	if size <= 0 {
+		size = 1
+	}
+	return oh.inflation + float64(freq)*K_gdsf_unit_size/float64(size)
+}
+
+func (oh *ObjectHeap) Touch(fid string, token string, size int64) {
+	oh.mtx.Lock()
+	defer oh.mtx.Unlock()
+	oh.tick++
+	obj := cachedObject{fid: fid, token: token, size: size}
+	if e, exist := oh.items[fid]; exist {
+		e.obj = obj
+		e.freq++
+		e.priority = oh.priority(e.freq, size)
+		e.tick = oh.tick
+		heap.Fix(&oh.h, e.index)
+		return
+	}
+	e := &heapEntry{obj: obj, freq: 1, priority: oh.priority(1, size), tick: oh.tick}
+	heap.Push(&oh.h, e)
+	oh.items[fid] = e
+}
+
+func (oh *ObjectHeap) Retoken(fid string, oldToken string, newToken string) bool {
+	oh.mtx.Lock()
+	defer oh.mtx.Unlock()
+	e, exist := oh.items[fid]
+	if !exist {
+		return false
+	}
+	if e.obj.token == oldToken {
+		e.obj.token = newToken
+	}
+	return true
+}
+
+// Pop the object of lowest priority, its priority becomes the inflation.
+func (oh *ObjectHeap) PopVictim() (cachedObject, bool) {
+	oh.mtx.Lock()
+	defer oh.mtx.Unlock()
+	if oh.h.Len() == 0 {
+		return cachedObject{}, false
+	}
+	e := heap.Pop(&oh.h).(*heapEntry)
+	delete(oh.items, e.obj.fid)
+	oh.inflation = e.priority
+	return e.obj, true
+}
+
+func (oh *ObjectHeap) Remove(fid string) {
+	oh.mtx.Lock()
+	defer oh.mtx.Unlock()
+	if e, exist := oh.items[fid]; exist {
+		heap.Remove(&oh.h, e.index)
+		delete(oh.items, fid)
+	}
+}
+
+func (oh *ObjectHeap) Has(fid string) bool {
+	oh.mtx.Lock()
+	defer oh.mtx.Unlock()
+	_, exist := oh.items[fid]
+	return exist
+}
+
+func (oh *ObjectHeap) Len() int {
+	oh.mtx.Lock()
+	defer oh.mtx.Unlock()
+	return oh.h.Len()
+}
+
+type heapEntryState struct {
+	Fid      string  `json:"fid"`
+	Freq     int64   `json:"freq"`
+	Priority float64 `json:"priority"`
+	Tick     uint64  `json:"tick"`
+}
+
+type objectHeapState struct {
+	Inflation float64          `json:"inflation"`
+	Tick      uint64           `json:"tick"`
+	Entries   []heapEntryState `json:"entries"`
+}
+
+func (oh *ObjectHeap) MarshalState() ([]byte, error) {
+	oh.mtx.Lock()
+	defer oh.mtx.Unlock()
+	state := objectHeapState{Inflation: oh.inflation, Tick: oh.tick,
+		Entries: make([]heapEntryState, 0, oh.h.Len())}
+	for _, e := range oh.h {
+		state.Entries = append(state.Entries, heapEntryState{
+			Fid: e.obj.fid, Freq: e.freq, Priority: e.priority, Tick: e.tick})
+	}
+	return json.Marshal(state)
+}
+
+func (oh *ObjectHeap) UnmarshalState(data []byte, live map[string]cachedObject) error {
+	var state objectHeapState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	oh.mtx.Lock()
+	defer oh.mtx.Unlock()
+	oh.inflation = state.Inflation
+	oh.tick = state.Tick
+	for _, es := range state.Entries {
+		obj, ok := live[es.Fid]
+		if !ok {
+			continue
+		}
+		if _, exist := oh.items[es.Fid]; exist {
+			continue
+		}
+		e := &heapEntry{obj: obj, freq: es.Freq, priority: es.Priority, tick: es.Tick}
+		heap.Push(&oh.h, e)
+		oh.items[es.Fid] = e
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+)
+
+// ObjectLru tracks the access recency of cached objects by fid.
+type ObjectLru struct {
+	mtx   sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func (ol *ObjectLru) New() {
+	ol.ll = list.New()
+	ol.items = make(map[string]*list.Element)
+}
+
+// Mark fid as most recently used, token is the blob it points at.
+func (ol *ObjectLru) Touch(fid string, token string, size int64) {
+	ol.mtx.Lock()
+	defer ol.mtx.Unlock()
+	if e, exist := ol.items[fid]; exist {
+		e.Value = cachedObject{fid: fid, token: token, size: size}
+		ol.ll.MoveToFront(e)
+		return
+	}
+	ol.items[fid] = ol.ll.PushFront(cachedObject{fid: fid, token: token, size: size})
+}
+
+// Update the blob fid points at, keeping its recency. Returns false if fid
+// isn't tracked.
+func (ol *ObjectLru) Retoken(fid string, oldToken string, newToken string) bool {
+	ol.mtx.Lock()
+	defer ol.mtx.Unlock()
+	e, exist := ol.items[fid]
+	if !exist {
+		return false
+	}
+	if e.Value.(cachedObject).token == oldToken {
+		obj := e.Value.(cachedObject)
+		obj.token = newToken
+		e.Value = obj
+	}
+	return true
+}
+
+// Pop the least recently used object.
+func (ol *ObjectLru) PopVictim() (cachedObject, bool) {
+	ol.mtx.Lock()
+	defer ol.mtx.Unlock()
+	e := ol.ll.Back()
+	if e == nil {
+		return cachedObject{}, false
+	}
+	ol.ll.Remove(e)
+	delete(ol.items, e.Value.(cachedObject).fid)
+	return e.Value.(cachedObject), true
+}
+
+func (ol *ObjectLru) Remove(fid string) {
+	ol.mtx.Lock()
+	defer ol.mtx.Unlock()
+	if e, exist := ol.items[fid]; exist {
+		ol.ll.Remove(e)
+		delete(ol.items, fid)
+	}
+}
+
+func (ol *ObjectLru) Len() int {
+	ol.mtx.Lock()
+	defer ol.mtx.Unlock()
+	return ol.ll.Len()
+}
+
+func (ol *ObjectLru) Has(fid string) bool {
+	ol.mtx.Lock()
+	defer ol.mtx.Unlock()
+	_, exist := ol.items[fid]
+	return exist
+}
+
+// Fids from the least to the most recently used.
+func (ol *ObjectLru) MarshalState() ([]byte, error) {
+	ol.mtx.Lock()
+	defer ol.mtx.Unlock()
+	fids := make([]string, 0, ol.ll.Len())
+	for e := ol.ll.Back(); e != nil; e = e.Prev() {
+		fids = append(fids, e.Value.(cachedObject).fid)
+	}
+	return json.Marshal(fids)
+}
+
+func (ol *ObjectLru) UnmarshalState(data []byte, live map[string]cachedObject) error {
+	var fids []string
+	if err := json.Unmarshal(data, &fids); err != nil {
+		return err
+	}
+	for _, fid := range fids {
+		if obj, ok := live[fid]; ok {
+			ol.Touch(fid, obj.token, obj.size)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	blob "holder/src/blob_handler"
+
+	"github.com/common/definition"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// The cache manager asks its eviction policy which object to evict next.
+// The policy is picked by name from the eviction config:
+//   - lru: least recently used.
+//   - lfu: least frequently used, with dynamic aging so objects hot long
+//     ago don't stay forever.
+//   - arc: adaptive replacement, objects seen once and objects seen again
+//     are kept apart, so 1-shot scans don't flush the hot working set.
+//   - gdsf: greedy dual size frequency, like lfu but large objects go
+//     first, more objects stay cached for the same bytes.
+//
+// The state of the policy is saved to a file next to the triplets every
+// F_eviction_save_interval_sec and on shutdown, and restored at startup.
+
+const K_eviction_policy_lru = "lru"
+const K_eviction_policy_lfu = "lfu"
+const K_eviction_policy_arc = "arc"
+const K_eviction_policy_gdsf = "gdsf"
+
+// EvictionPolicy orders cached objects by fid for eviction. Safe for
+// concurrent use.
+type EvictionPolicy interface {
+	// Record an access to fid, token is the blob it points at.
+	Touch(fid string, token string, size int64)
+	// Update the blob fid points at, keeping its rank. Returns false if
+	// fid isn't tracked.
+	Retoken(fid string, oldToken string, newToken string) bool
+	// Pop the object to evict next.
+	PopVictim() (cachedObject, bool)
+	Remove(fid string)
+	Has(fid string) bool
+	Len() int
+	// Encode the state of the policy.
+	MarshalState() ([]byte, error)
+	// Restore a state encoded by MarshalState. Objects missing from live
+	// are dropped, the others take their token and size from live.
+	UnmarshalState(data []byte, live map[string]cachedObject) error
+}
+
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "", K_eviction_policy_lru:
+		ol := new(ObjectLru)
+		ol.New()
+		return ol, nil
+	case K_eviction_policy_lfu:
+		return newObjectLfu(), nil
+	case K_eviction_policy_arc:
+		arc := new(ObjectArc)
+		arc.New()
+		return arc, nil
+	case K_eviction_policy_gdsf:
+		return newObjectGdsf(), nil
+	}
+	return nil, fmt.Errorf("unsupported eviction policy %q", name)
+}
+
+// Content of the eviction state file.
+type EvictionState struct {
+	Policy string          `json:"policy"`
+	State  json.RawMessage `json:"state"`
+}
+
+func evictionStatePath(shardId int) string {
+	return fmt.Sprintf("%s/eviction_%d.json", blob.BlobDir(), shardId)
+}
+
+// Save the state of the eviction policy, so a restart doesn't lose it.
+func (mgr *CacheManager) SaveEvictionState() error {
+	state, err := mgr.objects.MarshalState()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(EvictionState{Policy: mgr.policyName, State: state})
+	if err != nil {
+		return err
+	}
+	path := evictionStatePath(mgr.pbh.ShardId)
+	if err = os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Restore the saved state of the eviction policy over the live objects.
+// Returns false if there's none to restore, or it's of another policy.
+func (mgr *CacheManager) loadEvictionState(live map[string]cachedObject) bool {
+	data, err := os.ReadFile(evictionStatePath(mgr.pbh.ShardId))
+	if os.IsNotExist(err) {
+		return false
+	} else if err != nil {
+		ZapLogger.Error("read eviction state failed", zap.Any("err", err))
+		return false
+	}
+	var saved EvictionState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		ZapLogger.Error("decode eviction state failed", zap.Any("err", err))
+		return false
+	}
+	if saved.Policy != mgr.policyName {
+		ZapLogger.Info("eviction policy changed, saved state dropped",
+			zap.Any("saved", saved.Policy), zap.Any("policy", mgr.policyName))
+		return false
+	}
+	if err := mgr.objects.UnmarshalState(saved.State, live); err != nil {
+		ZapLogger.Error("restore eviction state failed", zap.Any("err", err))
+		return false
+	}
+	return true
+}
+
+func (mgr *CacheManager) loopSaveEvictionState() {
+	if definition.F_eviction_save_interval_sec <= 0 {
+		ZapLogger.Info("eviction state saving disabled")
+		return
+	}
+	for {
+		time.Sleep(time.Duration(definition.F_eviction_save_interval_sec) * time.Second)
+		if err := mgr.SaveEvictionState(); err != nil {
+			ZapLogger.Error("save eviction state failed", zap.Any("err", err))
+		}
+	}
+}
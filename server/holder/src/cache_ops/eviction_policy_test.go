@@ -0,0 +1,183 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"fmt"
+	"testing"
+
+	blob "holder/src/blob_handler"
+)
+
+func newTestPolicy(t *testing.T, name string) EvictionPolicy {
+	policy, err := NewEvictionPolicy(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+// Touch each fid in turn, with size bytes.
+func touchAll(policy EvictionPolicy, size int64, fids ...string) {
+	for _, fid := range fids {
+		policy.Touch(fid, "tok_"+fid, size)
+	}
+}
+
+// Fids in eviction order, popping them all.
+func victims(policy EvictionPolicy) string {
+	var fids []string
+	for {
+		obj, ok := policy.PopVictim()
+		if !ok {
+			return fmt.Sprint(fids)
+		}
+		fids = append(fids, obj.fid)
+	}
+}
+
+func TestLruOrder(t *testing.T) {
+	lru := newTestPolicy(t, K_eviction_policy_lru)
+	touchAll(lru, 100, "a", "b", "c", "a")
+	if !lru.Retoken("b", "tok_b", "moved") || lru.Retoken("x", "tok_x", "moved") {
+		t.Fatal("retoken of tracked and untracked fids")
+	}
+	obj, _ := lru.PopVictim()
+	if obj.fid != "b" || obj.token != "moved" {
+		t.Fatalf("popped %+v", obj)
+	}
+	if got := victims(lru); got != "[c a]" {
+		t.Fatalf("evicted %s", got)
+	}
+}
+
+func TestLfuOrder(t *testing.T) {
+	lfu := newTestPolicy(t, K_eviction_policy_lfu)
+	touchAll(lfu, 100, "a", "b", "b", "b", "c", "c")
+	if got := victims(lfu); got != "[a c b]" {
+		t.Fatalf("evicted %s", got)
+	}
+
+	// b and c were hot long ago, e touched once since b was evicted: aging
+	// ranks e above c.
+	touchAll(lfu, 100, "b", "b", "b", "c", "c", "c")
+	if obj, _ := lfu.PopVictim(); obj.fid != "b" {
+		t.Fatalf("popped %s", obj.fid)
+	}
+	touchAll(lfu, 100, "e")
+	if got := victims(lfu); got != "[c e]" {
+		t.Fatalf("evicted %s", got)
+	}
+}
+
+// Large objects go first, unless accessed more often.
+func TestGdsfOrder(t *testing.T) {
+	gdsf := newTestPolicy(t, K_eviction_policy_gdsf)
+	touchAll(gdsf, K_gdsf_unit_size, "medium")
+	touchAll(gdsf, 4*K_gdsf_unit_size, "large")
+	touchAll(gdsf, K_gdsf_unit_size/2, "small")
+	if got := victims(gdsf); got != "[large medium small]" {
+		t.Fatalf("evicted %s", got)
+	}
+	touchAll(gdsf, 4*K_gdsf_unit_size, "large", "large", "large", "large", "large")
+	touchAll(gdsf, K_gdsf_unit_size, "medium")
+	if got := victims(gdsf); got != "[medium large]" {
+		t.Fatalf("evicted %s", got)
+	}
+}
+
+// Objects seen twice outlive a scan of objects seen once, and a hit on the
+// ghost of an evicted object brings it back as seen twice.
+func TestArcOrderAndGhosts(t *testing.T) {
+	policy := newTestPolicy(t, K_eviction_policy_arc)
+	arc := policy.(*ObjectArc)
+	touchAll(arc, 100, "a", "b", "a")
+	if obj, _ := arc.PopVictim(); obj.fid != "b" {
+		t.Fatalf("popped %s", obj.fid)
+	}
+	if arc.Has("b") || arc.Len() != 1 || arc.lists[kArcB1].Len() != 1 {
+		t.Fatal("b not left as a ghost")
+	}
+	if arc.Retoken("b", "tok_b", "moved") {
+		t.Fatal("ghost retokened")
+	}
+	touchAll(arc, 100, "b")
+	if !arc.Has("b") || arc.lists[kArcT2].Len() != 2 || arc.p != 100 {
+		t.Fatalf("ghost hit: t2 holds %d, p %d", arc.lists[kArcT2].Len(), arc.p)
+	}
+
+	// The scan is evicted down to the target of t1, 1 object.
+	touchAll(arc, 100, "x1", "x2", "x3")
+	if got := victims(arc); got != "[x1 x2 a b x3]" {
+		t.Fatalf("evicted %s", got)
+	}
+	// Ghosts take no more bytes than cached objects.
+	if arc.bytes[kArcB1]+arc.bytes[kArcB2] != 0 {
+		t.Fatalf("%d bytes of ghosts left", arc.bytes[kArcB1]+arc.bytes[kArcB2])
+	}
+	touchAll(arc, 100, "c", "d")
+	arc.Remove("c")
+	if arc.Has("c") || arc.Len() != 1 {
+		t.Fatal("c not removed")
+	}
+}
+
+// The saved state restores the same order, without the objects no longer
+// cached.
+func TestEvictionStateRoundTrip(t *testing.T) {
+	setupDownloads(t, 0, 1, 0)
+	for _, name := range []string{K_eviction_policy_lru, K_eviction_policy_lfu,
+		K_eviction_policy_arc, K_eviction_policy_gdsf} {
+		newMgr := func(policyName string) *CacheManager {
+			return &CacheManager{objects: newTestPolicy(t, name), policyName: policyName,
+				pbh: &blob.PhyBH{ShardId: 3}}
+		}
+		fill := func(policy EvictionPolicy) {
+			touchAll(policy, 100, "a", "b", "c", "d", "b", "a", "b")
+			touchAll(policy, 300, "e")
+			// Evicted, left as a ghost by arc.
+			policy.PopVictim()
+		}
+		live := make(map[string]cachedObject)
+		for _, fid := range []string{"a", "b", "c", "d"} {
+			live[fid] = cachedObject{fid: fid, token: "tok_" + fid, size: 100}
+		}
+		live["e"] = cachedObject{fid: "e", token: "tok_e", size: 300}
+
+		saved := newMgr(name)
+		fill(saved.objects)
+		if err := saved.SaveEvictionState(); err != nil {
+			t.Fatal(err)
+		}
+		restored := newMgr(name)
+		if !restored.loadEvictionState(live) {
+			t.Fatalf("%s: state not restored", name)
+		}
+		want, _ := saved.objects.MarshalState()
+		got, _ := restored.objects.MarshalState()
+		if string(got) != string(want) {
+			t.Fatalf("%s: restored %s, saved %s", name, got, want)
+		}
+		if obj, _ := restored.objects.PopVictim(); obj.token != "tok_"+obj.fid ||
+			obj.size != live[obj.fid].size {
+			t.Fatalf("%s: restored %+v", name, obj)
+		}
+
+		// d is no longer cached.
+		delete(live, "d")
+		restored = newMgr(name)
+		restored.loadEvictionState(live)
+		expected := newTestPolicy(t, name)
+		fill(expected)
+		expected.Remove("d")
+		if got, want := victims(restored.objects), victims(expected); got != want {
+			t.Fatalf("%s: without d evicted %s, want %s", name, got, want)
+		}
+
+		if newMgr("other").loadEvictionState(live) {
+			t.Fatalf("%s: state of another policy restored", name)
+		}
+	}
+}
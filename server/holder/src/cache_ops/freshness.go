@@ -0,0 +1,85 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/common/definition"
+)
+
+// Validators of an OSS object, used to tell if the cached copy is stale.
+type Validators struct {
+	Etag string
+	// Freshness lifetime in seconds from Cache-Control: max-age, -1 if absent.
+	MaxAge int64
+}
+
+func ValidatorsFromHeader(h http.Header) Validators {
+	return Validators{
+		Etag:   h.Get("Etag"),
+		MaxAge: parseMaxAge(h.Get("Cache-Control")),
+	}
+}
+
+// Local files are validated by modification time and size.
+func ValidatorsFromFileInfo(info os.FileInfo) Validators {
+	return Validators{
+		Etag:   fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size()),
+		MaxAge: -1,
+	}
+}
+
+func parseMaxAge(cacheControl string) int64 {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		if directive == "no-cache" || directive == "no-store" {
+			return 0
+		}
+		if strings.HasPrefix(directive, "max-age=") {
+			maxAge, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64)
+			if err == nil && maxAge >= 0 {
+				return maxAge
+			}
+		}
+	}
+	return -1
+}
+
+// Ttl in seconds of the cached copy of url.
+func GetTtl(url string, maxAge int64) int64 {
+	for _, rule := range definition.F_ttl_rules {
+		if rule.Pattern.MatchString(url) {
+			return rule.TtlSec
+		}
+	}
+	if definition.F_honor_cache_control && maxAge >= 0 {
+		return maxAge
+	}
+	return definition.F_default_ttl_sec
+}
+
+// A fresh cache hit can be served without validating against OSS.
+func IsFresh(fm *definition.FileMeta, url string, now time.Time) bool {
+	if fm.ValidatedAt == 0 {
+		return false
+	}
+	return now.Unix()-fm.ValidatedAt < GetTtl(url, fm.MaxAge)
+}
+
+// Validate the cached etag of url against its origin. Returns whether the
+// cached copy is still valid, and the current validators of url.
+func Revalidate(url string, etag string) (bool, Validators, error) {
+	origin, err := OriginOf(url)
+	if err != nil {
+		return false, Validators{}, err
+	}
+	return origin.Revalidate(url, etag)
+}
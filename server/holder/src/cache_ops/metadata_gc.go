@@ -0,0 +1,231 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"time"
+
+	blob "holder/src/blob_handler"
+	db_ops "holder/src/db_ops"
+
+	"github.com/common/definition"
+	range_code "github.com/common/range_code"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Rows fetched from DB per page.
+const kMetaGcPageSize = 100
+
+// What a metadata GC round found, and deleted unless in dry run mode.
+type MetaGcReport struct {
+	DryRun      bool
+	RowsScanned int
+	// Pending rows whose download died.
+	StalePending int
+	// Ready rows whose owner triplet isn't held by this shard.
+	MissingTriplet int
+	// Ready rows whose blob isn't indexed by its triplet.
+	MissingBlob int
+	// Triplets on disk with no row pointing at them.
+	OrphanTriplets int
+	OrphanBytes    int64
+	// Deletions failed, retried by next round.
+	Errors   int
+	Duration time.Duration
+}
+
+// Periodically reconcile DB rows with triplets on disk in both directions.
+// Startup only cleans pending rows once in resumeDownloads and orphan
+// triplets once in PhyBH.New, this keeps doing it while the service runs.
+func (mgr *CacheManager) loopMetadataGC() {
+	if definition.F_meta_gc_interval_sec <= 0 {
+		ZapLogger.Info("metadata GC disabled")
+		return
+	}
+	for {
+		time.Sleep(time.Duration(definition.F_meta_gc_interval_sec) * time.Second)
+		report := mgr.RunMetadataGC(definition.F_meta_gc_dry_run)
+		ZapLogger.Info("metadata GC round finished", zap.Any("report", report))
+	}
+}
+
+// Run 1 round of metadata GC. In dry run mode nothing is deleted, the
+// report tells what would be.
+func (mgr *CacheManager) RunMetadataGC(dryRun bool) MetaGcReport {
+	start := time.Now()
+	report := MetaGcReport{DryRun: dryRun}
+	mgr.gcMtx.Lock()
+	defer mgr.gcMtx.Unlock()
+
+	mgr.gcRows(&report)
+	mgr.gcOrphanTriplets(&report)
+
+	report.Duration = time.Now().Sub(start)
+	return report
+}
+
+// Rows pointing at missing triplets or blobs, and pending rows whose
+// download died.
+func (mgr *CacheManager) gcRows(report *MetaGcReport) {
+	pendingBefore := time.Now().Unix() - definition.F_meta_gc_pending_timeout_sec
+	afterFid := ""
+	for {
+		pageStart := time.Now()
+		rows, err := mgr.dbOpsFile.ListFilesFromDB(afterFid, kMetaGcPageSize)
+		if err != nil {
+			ZapLogger.Error("metadata GC list files failed", zap.Any("err", err))
+			report.Errors++
+			return
+		}
+		for i := range rows {
+			mgr.gcRow(&rows[i], pendingBefore, report)
+		}
+		report.RowsScanned += len(rows)
+		if len(rows) < kMetaGcPageSize {
+			return
+		}
+		afterFid = rows[len(rows)-1].Fid
+		throttle(pageStart, len(rows))
+	}
+}
+
+func (mgr *CacheManager) gcRow(row *db_ops.FileRow, pendingBefore int64, report *MetaGcReport) {
+	switch row.State {
+	case definition.F_DB_STATE_PENDING:
+		if definition.F_meta_gc_pending_timeout_sec <= 0 ||
+			row.UpdatedAt >= pendingBefore || mgr.isInFlight(row.Fid) {
+			return
+		}
+		report.StalePending++
+		ZapLogger.Info("metadata GC stale pending file",
+			zap.Any("fid", row.Fid), zap.Any("updatedAt", row.UpdatedAt),
+			zap.Any("dryRun", report.DryRun))
+		if !report.DryRun {
+			if err := mgr.dbOpsFile.DeleteStalePendingFileInDB(row.Fid, pendingBefore); err != nil {
+				report.Errors++
+			} else {
+				mgr.releaseBlobs(row.Meta, "")
+			}
+		}
+	case definition.F_DB_STATE_READY:
+		reason := ""
+		if !mgr.pbh.HasTriplet(row.Owners) {
+			report.MissingTriplet++
+			reason = "triplet missing"
+		} else if !hasAllBlobs(mgr.pbh, row.Meta) {
+			report.MissingBlob++
+			reason = "blob missing"
+		} else {
+			return
+		}
+		ZapLogger.Info("metadata GC dangling file", zap.Any("fid", row.Fid),
+			zap.Any("owners", row.Owners), zap.Any("reason", reason),
+			zap.Any("dryRun", report.DryRun))
+		if !report.DryRun {
+			if err := mgr.dbOpsFile.DeleteFileWithFidAndOwnerInDB(row.Fid, row.Owners); err != nil {
+				report.Errors++
+			}
+		}
+	}
+}
+
+func hasAllBlobs(pbh *blob.PhyBH, fm *definition.FileMeta) bool {
+	if fm.RngCodeList == nil || fm.RngCodeList.Len() == 0 {
+		return false
+	}
+	for e := fm.RngCodeList.Front(); e != nil; e = e.Next() {
+		if !pbh.HasBlob(e.Value.(range_code.RangeCode).Token) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the file is being downloaded, or queued for download.
+func (mgr *CacheManager) isInFlight(fid string) bool {
+	mgr.dMtx.Lock()
+	_, downloading := mgr.downloads[fid]
+	mgr.dMtx.Unlock()
+	if downloading {
+		return true
+	}
+	mgr.wMtx.Lock()
+	defer mgr.wMtx.Unlock()
+	for _, queuedFid := range mgr.writeItemMap {
+		if queuedFid == fid {
+			return true
+		}
+	}
+	return false
+}
+
+// Triplets on disk no row points at. A triplet is written before the rows
+// of its blobs are committed, so it must be seen orphan by 2 rounds at
+// least pending timeout apart before being deleted. Open triplets are
+// never deleted, they take writes.
+func (mgr *CacheManager) gcOrphanTriplets(report *MetaGcReport) {
+	owners, err := mgr.dbOpsFile.ListTripleIdOfAllFiles()
+	if err != nil {
+		ZapLogger.Error("metadata GC list triplets failed", zap.Any("err", err))
+		report.Errors++
+		return
+	}
+	owned := make(map[string]struct{})
+	for _, id := range owners {
+		owned[id] = struct{}{}
+	}
+	onDisk, _, err := blob.ScanLocalFS(mgr.pbh.ShardId)
+	if err != nil {
+		ZapLogger.Error("metadata GC scan triplets failed", zap.Any("err", err))
+		report.Errors++
+		return
+	}
+
+	now := time.Now()
+	grace := time.Duration(definition.F_meta_gc_pending_timeout_sec) * time.Second
+	orphans := make(map[string]time.Time)
+	for _, id := range onDisk {
+		if _, ok := owned[id]; ok || mgr.pbh.IsOpenTriplet(id) ||
+			mgr.isCompacting(id) {
+			continue
+		}
+		firstSeen, seen := mgr.gcOrphans[id]
+		if !seen {
+			firstSeen = now
+		}
+		orphans[id] = firstSeen
+		if now.Sub(firstSeen) < grace || !seen {
+			continue
+		}
+		report.OrphanTriplets++
+		size := blob.GetTripletSizeOnDisk(mgr.pbh.ShardId, id)
+		report.OrphanBytes += size
+		ZapLogger.Info("metadata GC orphan triplet", zap.Any("tripId", id),
+			zap.Any("size", size), zap.Any("dryRun", report.DryRun))
+		if report.DryRun {
+			continue
+		}
+		if mgr.pbh.HasTriplet(id) {
+			mgr.pbh.PurgeTriplet(id)
+		} else {
+			blob.DeleteTripletFilesOnDisk(mgr.pbh.ShardId, id)
+		}
+		delete(orphans, id)
+	}
+	mgr.gcOrphans = orphans
+}
+
+// Sleep so that no more than F_meta_gc_rows_per_sec rows are handled per
+// second, given n rows were handled since start.
+func throttle(start time.Time, n int) {
+	if definition.F_meta_gc_rows_per_sec <= 0 {
+		return
+	}
+	budget := time.Duration(n) * time.Second / time.Duration(definition.F_meta_gc_rows_per_sec)
+	if elapsed := time.Now().Sub(start); elapsed < budget {
+		time.Sleep(budget - elapsed)
+	}
+}
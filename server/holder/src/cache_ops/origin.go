@@ -0,0 +1,164 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"errors"
+	"hash/crc64"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/common/definition"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Origin is where cached objects come from. Objects are named by their
+// cache key, which picks the origin: s3://bucket/key is read from the S3
+// compatible store of oss_s3_config, oss://bucket/object from the Aliyun
+// OSS of oss_aliyun_config, other keys are local paths in local mode and
+// plain http(s) urls otherwise.
+
+var ErrOriginNotFound = errors.New("object not found at origin")
+var ErrOriginRangeNotSatisfiable = errors.New("range not satisfiable at origin")
+var ErrOriginCrcMismatch = errors.New("crc64 mismatch with origin")
+var ErrOriginChanged = errors.New("object changed at origin during download")
+
+type Origin interface {
+	// Size of the object and its validators.
+	Stat(url string) (ObjectInfo, error)
+	// Read the object, rng is the value of a Range header, "" reads it
+	// whole. Origins may ignore rng and answer the whole object. etag, if
+	// not "", is required to match the object's, ErrOriginChanged otherwise.
+	Get(url string, rng string, etag string) (*OriginResponse, error)
+	// Whether the cached copy of etag is still valid, and the current
+	// validators of the object.
+	Revalidate(url string, etag string) (bool, Validators, error)
+}
+
+type ObjectInfo struct {
+	// -1 if origin didn't tell.
+	Size       int64
+	Validators Validators
+	// CRC64 ECMA of the object in decimal, as OSS tells it, "" if unknown.
+	Crc64 string
+	// Whether origin honors ranged reads of the object.
+	Ranges bool
+}
+
+// Answer of origin to a read, caller must close Body.
+type OriginResponse struct {
+	Body io.ReadCloser
+	// Bytes of Body, -1 if unknown.
+	Size int64
+	// Whether Body holds the requested range rather than the whole object.
+	Partial      bool
+	ContentRange string
+	ContentType  string
+	Validators   Validators
+}
+
+const kS3Scheme = "s3://"
+
+// Header of the CRC64 of OSS objects, answered for plain http reads too.
+const kCrc64Header = "X-Oss-Hash-Crc64ecma"
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+var localOrigin = new(LocalOrigin)
+var httpOrigin = NewHttpOrigin()
+
+// Created on first use, once config is loaded.
+var s3Origin *S3Origin
+var s3OriginOnce sync.Once
+var aliyunOrigin *AliyunOrigin
+var aliyunOriginErr error
+var aliyunOriginOnce sync.Once
+
+// Origin of the object of url.
+func OriginOf(url string) (Origin, error) {
+	if strings.HasPrefix(url, kS3Scheme) {
+		if definition.F_s3_endpoint == "" {
+			return nil, errors.New("s3 origin not configured")
+		}
+		s3OriginOnce.Do(func() { s3Origin = NewS3Origin() })
+		return s3Origin, nil
+	}
+	if strings.HasPrefix(url, kAliyunScheme) {
+		if definition.F_aliyun_endpoint == "" {
+			return nil, errors.New("aliyun oss origin not configured")
+		}
+		aliyunOriginOnce.Do(func() { aliyunOrigin, aliyunOriginErr = NewAliyunOrigin() })
+		if aliyunOriginErr != nil {
+			return nil, aliyunOriginErr
+		}
+		return aliyunOrigin, nil
+	}
+	if definition.F_local_mode {
+		return localOrigin, nil
+	}
+	return httpOrigin, nil
+}
+
+// Bounds of a single byte range of an object of size, ok is false if rng
+// isn't a single range.
+func parseByteRange(rng string, size int64) (start int64, end int64, ok bool, err error) {
+	spec := strings.TrimPrefix(strings.TrimSpace(rng), "bytes=")
+	if spec == rng || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	dash := strings.IndexByte(spec, '-')
+	if dash < 0 {
+		return 0, 0, false, nil
+	}
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+	if first == "" {
+		// Suffix range, the last bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, 0, false, nil
+		}
+		if n <= 0 || size == 0 {
+			return 0, 0, true, ErrOriginRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, nil
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false, nil
+	}
+	end = size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false, nil
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, true, ErrOriginRangeNotSatisfiable
+	}
+	return start, end, true, nil
+}
+
+// Weak etags can't condition reads, If-Match compares etags strongly.
+func isStrongEtag(etag string) bool {
+	return etag != "" && !strings.HasPrefix(etag, "W/")
+}
+
+// Check CRC64 sum against expect, as ObjectInfo.Crc64.
+func matchCrc64(sum uint64, expect string) error {
+	if got := strconv.FormatUint(sum, 10); got != expect {
+		ZapLogger.Error("crc64 mismatch", zap.Any("expect", expect), zap.Any("got", got))
+		return ErrOriginCrcMismatch
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/common/definition"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+const kAliyunScheme = "oss://"
+
+// AliyunOrigin reads oss://bucket/object objects from Aliyun OSS with the
+// SDK client, authenticated by an AccessKey, or STS credentials when a
+// security token is set. Stat tells the CRC64 OSS keeps for the object,
+// downloads are checked against it before they're sealed in a triplet.
+type AliyunOrigin struct {
+	client *oss.Client
+
+	mtx     sync.Mutex
+	buckets map[string]*oss.Bucket
+}
+
+func NewAliyunOrigin() (*AliyunOrigin, error) {
+	options := []oss.ClientOption{
+		// Checked by the download, also for reads in parts.
+		oss.EnableCRC(false),
+	}
+	if definition.F_aliyun_security_token != "" {
+		options = append(options, oss.SecurityToken(definition.F_aliyun_security_token))
+	}
+	client, err := oss.New(definition.F_aliyun_endpoint, definition.F_aliyun_access_key_id,
+		definition.F_aliyun_access_key_secret, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &AliyunOrigin{client: client, buckets: make(map[string]*oss.Bucket)}, nil
+}
+
+// Bucket and object key of oss://bucket/object.
+func (ao *AliyunOrigin) locate(url string) (*oss.Bucket, string, error) {
+	name, key, found := strings.Cut(strings.TrimPrefix(url, kAliyunScheme), "/")
+	if !found || name == "" || key == "" {
+		return nil, "", errors.New("invalid oss url " + url)
+	}
+	ao.mtx.Lock()
+	defer ao.mtx.Unlock()
+	bucket, exist := ao.buckets[name]
+	if !exist {
+		var err error
+		if bucket, err = ao.client.Bucket(name); err != nil {
+			return nil, "", err
+		}
+		ao.buckets[name] = bucket
+	}
+	return bucket, key, nil
+}
+
+func aliyunError(err error) error {
+	var se oss.ServiceError
+	if errors.As(err, &se) {
+		switch se.StatusCode {
+		case http.StatusNotFound:
+			return ErrOriginNotFound
+		case http.StatusRequestedRangeNotSatisfiable:
+			return ErrOriginRangeNotSatisfiable
+		case http.StatusPreconditionFailed:
+			return ErrOriginChanged
+		}
+	}
+	return err
+}
+
+func (ao *AliyunOrigin) stat(url string) (http.Header, error) {
+	bucket, key, err := ao.locate(url)
+	if err != nil {
+		return nil, err
+	}
+	header, err := bucket.GetObjectDetailedMeta(key)
+	if err != nil {
+		ZapLogger.Error("stat at aliyun oss failed", zap.Any("url", url), zap.Any("err", err))
+		return nil, aliyunError(err)
+	}
+	return header, nil
+}
+
+func (ao *AliyunOrigin) Stat(url string) (ObjectInfo, error) {
+	header, err := ao.stat(url)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		size = -1
+	}
+	return ObjectInfo{
+		Size:       size,
+		Validators: ValidatorsFromHeader(header),
+		Crc64:      header.Get(oss.HTTPHeaderOssCRC64),
+		Ranges:     true,
+	}, nil
+}
+
+func (ao *AliyunOrigin) Get(url string, rng string, etag string) (*OriginResponse, error) {
+	bucket, key, err := ao.locate(url)
+	if err != nil {
+		return nil, err
+	}
+	var options []oss.Option
+	if rng != "" {
+		options = append(options, oss.NormalizedRange(strings.TrimPrefix(strings.TrimSpace(rng), "bytes=")))
+	}
+	if isStrongEtag(etag) {
+		options = append(options, oss.IfMatch(etag))
+	}
+	result, err := bucket.DoGetObject(&oss.GetObjectRequest{ObjectKey: key}, options)
+	if err != nil {
+		return nil, aliyunError(err)
+	}
+	resp := result.Response
+	size, err := strconv.ParseInt(resp.Headers.Get("Content-Length"), 10, 64)
+	if err != nil {
+		size = -1
+	}
+	return &OriginResponse{
+		Body:         resp,
+		Size:         size,
+		Partial:      resp.StatusCode == http.StatusPartialContent,
+		ContentRange: resp.Headers.Get("Content-Range"),
+		ContentType:  resp.Headers.Get("Content-Type"),
+		Validators:   ValidatorsFromHeader(resp.Headers),
+	}, nil
+}
+
+func (ao *AliyunOrigin) Revalidate(url string, etag string) (bool, Validators, error) {
+	header, err := ao.stat(url)
+	if err != nil {
+		return false, Validators{}, err
+	}
+	v := ValidatorsFromHeader(header)
+	return etag != "" && v.Etag == etag, v, nil
+}
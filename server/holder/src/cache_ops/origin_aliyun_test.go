@@ -0,0 +1,195 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/common/definition"
+)
+
+// Aliyun OSS endpoint serving oss://bkt/obj, with its CRC64 header. Errors
+// come with an XML body, as OSS sends them.
+type aliyunTestServer struct {
+	*httptest.Server
+	data []byte
+	etag string
+	crc  uint64
+
+	mtx sync.Mutex
+	// Range and If-Match headers of the last GET.
+	rng     string
+	ifMatch string
+}
+
+func newAliyunTestServer(t *testing.T, data []byte) *aliyunTestServer {
+	ts := &aliyunTestServer{data: data, etag: `"e1"`, crc: crc64.Checksum(data, crc64Table)}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			writeOssError(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		if r.URL.Path != "/bkt/obj" {
+			writeOssError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		ts.mtx.Lock()
+		etag, crc := ts.etag, ts.crc
+		if r.Method == http.MethodGet {
+			ts.rng, ts.ifMatch = r.Header.Get("Range"), r.Header.Get("If-Match")
+		}
+		ts.mtx.Unlock()
+		rec := httptest.NewRecorder()
+		rec.Header().Set("ETag", etag)
+		rec.Header().Set("X-Oss-Hash-Crc64ecma", strconv.FormatUint(crc, 10))
+		// Answers 412 when If-Match doesn't match and 416 past the end.
+		http.ServeContent(rec, r, "", time.Time{}, bytes.NewReader(data))
+		if rec.Code >= 400 {
+			writeOssError(w, rec.Code, http.StatusText(rec.Code))
+			return
+		}
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func writeOssError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>%s</Code><Message>%s</Message><RequestId>1</RequestId></Error>`,
+		code, http.StatusText(status))
+}
+
+func newTestAliyunOrigin(t *testing.T, endpoint string) *AliyunOrigin {
+	saved := []*string{&definition.F_aliyun_endpoint, &definition.F_aliyun_access_key_id,
+		&definition.F_aliyun_access_key_secret, &definition.F_aliyun_security_token}
+	values := make([]string, len(saved))
+	for i, p := range saved {
+		values[i] = *p
+	}
+	t.Cleanup(func() {
+		for i, p := range saved {
+			*p = values[i]
+		}
+	})
+	definition.F_aliyun_endpoint = endpoint
+	definition.F_aliyun_access_key_id = "ak"
+	definition.F_aliyun_access_key_secret = "sk"
+	definition.F_aliyun_security_token = "sts"
+	ao, err := NewAliyunOrigin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ao
+}
+
+func TestAliyunOriginStat(t *testing.T) {
+	ts := newAliyunTestServer(t, randomBytes(10000))
+	ao := newTestAliyunOrigin(t, ts.URL)
+	info, err := ao.Stat("oss://bkt/obj")
+	if err != nil || info.Size != 10000 || info.Validators.Etag != `"e1"` || !info.Ranges ||
+		info.Crc64 != strconv.FormatUint(ts.crc, 10) {
+		t.Fatalf("got %+v, %v", info, err)
+	}
+	if _, err := ao.Stat("oss://bkt/missing"); !errors.Is(err, ErrOriginNotFound) {
+		t.Fatalf("missing object: got %v", err)
+	}
+	if _, err := ao.Stat("oss://bkt"); err == nil {
+		t.Fatal("url without object stated")
+	}
+	if ok, v, err := ao.Revalidate("oss://bkt/obj", `"e1"`); !ok || v.Etag != `"e1"` || err != nil {
+		t.Fatalf("revalidate: got %v, %+v, %v", ok, v, err)
+	}
+}
+
+// Ranges and etags become the Range and If-Match of the GET, their
+// failures map to the errors of the origin.
+func TestAliyunOriginGet(t *testing.T) {
+	ts := newAliyunTestServer(t, randomBytes(10000))
+	ao := newTestAliyunOrigin(t, ts.URL)
+	resp, err := ao.Get("oss://bkt/obj", "bytes=100-199", `"e1"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !bytes.Equal(got, ts.data[100:200]) || !resp.Partial || resp.Size != 100 ||
+		resp.ContentRange != "bytes 100-199/10000" || resp.Validators.Etag != `"e1"` {
+		t.Fatalf("got %d bytes, %+v, %v", len(got), resp, err)
+	}
+	if ts.rng != "bytes=100-199" || ts.ifMatch != `"e1"` {
+		t.Fatalf("sent Range %q, If-Match %q", ts.rng, ts.ifMatch)
+	}
+
+	// Weak etags aren't sent.
+	resp, err = ao.Get("oss://bkt/obj", "", `W/"e1"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(got, ts.data) || resp.Partial || ts.rng != "" || ts.ifMatch != "" {
+		t.Fatalf("got %d bytes, sent Range %q, If-Match %q", len(got), ts.rng, ts.ifMatch)
+	}
+
+	for _, c := range []struct {
+		url, rng, etag string
+		want           error
+	}{
+		{"oss://bkt/obj", "", `"e2"`, ErrOriginChanged},
+		{"oss://bkt/obj", "bytes=20000-20099", "", ErrOriginRangeNotSatisfiable},
+		{"oss://bkt/missing", "", "", ErrOriginNotFound},
+	} {
+		if _, err := ao.Get(c.url, c.rng, c.etag); !errors.Is(err, c.want) {
+			t.Fatalf("%+v: got %v", c, err)
+		}
+	}
+}
+
+// Downloads are checked against the CRC64 OSS tells.
+func TestAliyunOriginCrc64(t *testing.T) {
+	setupDownloads(t, 4096, 2, 0)
+	ts := newAliyunTestServer(t, randomBytes(10000))
+	ao := newTestAliyunOrigin(t, ts.URL)
+	info, err := ao.Stat("oss://bkt/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDownload(t, "crc")
+	d.Url = "oss://bkt/obj"
+	d.startCrc64()
+	if err := fetchParts(d, ao, info); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyDownload(d, info); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.mtx.Lock()
+	ts.crc++
+	ts.mtx.Unlock()
+	if info, err = ao.Stat("oss://bkt/obj"); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyDownload(d, info); !errors.Is(err, ErrOriginCrcMismatch) {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"errors"
+	"net/http"
+
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// HttpOrigin reads objects with plain http(s) requests. Origins speaking
+// http with their own urls or authentication, e.g. S3, plug in hooks.
+type HttpOrigin struct {
+	client *http.Client
+	// Url requested for the object of url, nil requests url as is.
+	resolve func(url string) (string, error)
+	// Signs the request right before it's sent, nil sends it unsigned.
+	sign func(req *http.Request)
+}
+
+func NewHttpOrigin() *HttpOrigin {
+	return &HttpOrigin{client: http.DefaultClient}
+}
+
+func (ho *HttpOrigin) do(method string, url string, header http.Header) (*http.Response, error) {
+	target := url
+	if ho.resolve != nil {
+		var err error
+		if target, err = ho.resolve(url); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if ho.sign != nil {
+		ho.sign(req)
+	}
+	resp, err := ho.client.Do(req)
+	if err != nil {
+		ZapLogger.Error("origin request failed", zap.Any("method", method),
+			zap.Any("url", url), zap.Any("err", err))
+		return nil, err
+	}
+	return resp, nil
+}
+
+func statusError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return ErrOriginNotFound
+	case http.StatusRequestedRangeNotSatisfiable:
+		return ErrOriginRangeNotSatisfiable
+	case http.StatusPreconditionFailed:
+		return ErrOriginChanged
+	}
+	return errors.New("origin status " + resp.Status)
+}
+
+func (ho *HttpOrigin) Stat(url string) (ObjectInfo, error) {
+	// TODO: http.Head with presign url maybe failed
+	resp, err := ho.do(http.MethodHead, url, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		ZapLogger.Error("stat at origin failed", zap.Any("url", url),
+			zap.Any("status", resp.StatusCode))
+		return ObjectInfo{}, statusError(resp)
+	}
+	return ObjectInfo{
+		Size:       resp.ContentLength,
+		Validators: ValidatorsFromHeader(resp.Header),
+		Crc64:      resp.Header.Get(kCrc64Header),
+		Ranges:     resp.Header.Get("Accept-Ranges") == "bytes",
+	}, nil
+}
+
+func (ho *HttpOrigin) Get(url string, rng string, etag string) (*OriginResponse, error) {
+	header := make(http.Header)
+	if rng != "" {
+		header.Set("Range", rng)
+	}
+	if isStrongEtag(etag) {
+		header.Set("If-Match", etag)
+	}
+	resp, err := ho.do(http.MethodGet, url, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		ZapLogger.Error("ossData not found", zap.Any("url", url),
+			zap.Any("status", resp.StatusCode))
+		resp.Body.Close()
+		return nil, statusError(resp)
+	}
+	v := ValidatorsFromHeader(resp.Header)
+	if etag != "" && v.Etag != "" && v.Etag != etag {
+		resp.Body.Close()
+		return nil, ErrOriginChanged
+	}
+	return &OriginResponse{
+		Body:         resp.Body,
+		Size:         resp.ContentLength,
+		Partial:      resp.StatusCode == http.StatusPartialContent,
+		ContentRange: resp.Header.Get("Content-Range"),
+		ContentType:  resp.Header.Get("Content-Type"),
+		Validators:   v,
+	}, nil
+}
+
+// Validate with a conditional request, so no body is transferred when the
+// object didn't change. Without etag to condition on, only the headers are
+// asked for.
+func (ho *HttpOrigin) Revalidate(url string, etag string) (bool, Validators, error) {
+	method := http.MethodHead
+	header := make(http.Header)
+	if etag != "" {
+		method = http.MethodGet
+		header.Set("If-None-Match", etag)
+	}
+	resp, err := ho.do(method, url, header)
+	if err != nil {
+		ZapLogger.Error("Revalidate", zap.Any("url", url), zap.Any("err", err))
+		return false, Validators{}, err
+	}
+	// Body is never read, closing aborts the transfer if any.
+	resp.Body.Close()
+	v := ValidatorsFromHeader(resp.Header)
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if v.Etag == "" {
+			v.Etag = etag
+		}
+		return true, v, nil
+	case http.StatusOK:
+		return etag != "" && v.Etag == etag, v, nil
+	}
+	return false, v, statusError(resp)
+}
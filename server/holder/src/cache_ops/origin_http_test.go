@@ -0,0 +1,85 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Origin serving an object with etag "v2", conditional requests are
+// answered the way http servers do. The last request is kept in last.
+func newEtagServer(t *testing.T, status *int, last **http.Request) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*last = r
+		if *status != http.StatusOK {
+			w.WriteHeader(*status)
+			return
+		}
+		w.Header().Set("ETag", `"v2"`)
+		if r.Header.Get("If-None-Match") == `"v2"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("content"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHttpOriginRevalidate(t *testing.T) {
+	status := http.StatusOK
+	var last *http.Request
+	srv := newEtagServer(t, &status, &last)
+	ho := NewHttpOrigin()
+
+	// 304, the cached etag is still the one at origin.
+	valid, v, err := ho.Revalidate(srv.URL+"/a", `"v2"`)
+	if err != nil || !valid || v.Etag != `"v2"` {
+		t.Fatalf("not modified: %v, %+v, %v", valid, v, err)
+	}
+	if last.Method != http.MethodGet || last.Header.Get("If-None-Match") != `"v2"` {
+		t.Fatalf("not modified: sent %s %v", last.Method, last.Header)
+	}
+
+	// 200 with a changed etag, the new validators are returned.
+	valid, v, err = ho.Revalidate(srv.URL+"/a", `"v1"`)
+	if err != nil || valid || v.Etag != `"v2"` {
+		t.Fatalf("changed: %v, %+v, %v", valid, v, err)
+	}
+
+	// Without etag only the headers are asked for, and never validate.
+	valid, v, err = ho.Revalidate(srv.URL+"/a", "")
+	if err != nil || valid || v.Etag != `"v2"` || last.Method != http.MethodHead {
+		t.Fatalf("no etag: %v, %+v, %v, sent %s", valid, v, err, last.Method)
+	}
+
+	for _, status = range []int{http.StatusNotFound, http.StatusGone} {
+		if _, _, err := ho.Revalidate(srv.URL+"/a", `"v2"`); !errors.Is(err, ErrOriginNotFound) {
+			t.Fatalf("status %d: %v", status, err)
+		}
+	}
+	status = http.StatusInternalServerError
+	if valid, _, err := ho.Revalidate(srv.URL+"/a", `"v2"`); err == nil || valid {
+		t.Fatalf("status %d: %v, %v", status, valid, err)
+	}
+}
+
+// Servers ignoring If-None-Match answer 200 with the same etag, which still
+// validates.
+func TestHttpOriginRevalidateUnconditional(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v2"`)
+		w.Write([]byte("content"))
+	}))
+	defer srv.Close()
+
+	valid, v, err := NewHttpOrigin().Revalidate(srv.URL+"/a", `"v2"`)
+	if err != nil || !valid || v.Etag != `"v2"` {
+		t.Fatalf("got %v, %+v, %v", valid, v, err)
+	}
+}
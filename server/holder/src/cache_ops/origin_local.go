@@ -0,0 +1,85 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// LocalOrigin reads objects from local files, only for test. Files are
+// validated by modification time and size.
+type LocalOrigin struct{}
+
+func (lo *LocalOrigin) Stat(url string) (ObjectInfo, error) {
+	info, err := os.Stat(url)
+	if os.IsNotExist(err) {
+		ZapLogger.Info("local file not found", zap.Any("file", url))
+		return ObjectInfo{}, ErrOriginNotFound
+	} else if err != nil {
+		ZapLogger.Error("stat local file failed", zap.Any("file", url), zap.Any("err", err))
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: info.Size(), Validators: ValidatorsFromFileInfo(info), Ranges: true}, nil
+}
+
+// Only single ranges are honored.
+func (lo *LocalOrigin) Get(url string, rng string, etag string) (*OriginResponse, error) {
+	f, err := os.Open(url)
+	if os.IsNotExist(err) {
+		return nil, ErrOriginNotFound
+	} else if err != nil {
+		ZapLogger.Error("open local file failed", zap.Any("err", err))
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	res := &OriginResponse{Body: f, Size: info.Size(), Validators: ValidatorsFromFileInfo(info)}
+	if etag != "" && res.Validators.Etag != etag {
+		f.Close()
+		return nil, ErrOriginChanged
+	}
+	if rng == "" {
+		return res, nil
+	}
+	start, end, ok, err := parseByteRange(rng, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !ok {
+		return res, nil
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, end-start+1), f}
+	res.Size = end - start + 1
+	res.Partial = true
+	res.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, info.Size())
+	return res, nil
+}
+
+func (lo *LocalOrigin) Revalidate(url string, etag string) (bool, Validators, error) {
+	info, err := os.Stat(url)
+	if os.IsNotExist(err) {
+		return false, Validators{}, ErrOriginNotFound
+	} else if err != nil {
+		return false, Validators{}, err
+	}
+	v := ValidatorsFromFileInfo(info)
+	return v.Etag == etag, v, nil
+}
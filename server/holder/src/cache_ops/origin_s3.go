@@ -0,0 +1,157 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/common/definition"
+)
+
+// S3Origin reads s3://bucket/key objects from an S3 compatible store, e.g.
+// AWS S3 or MinIO, with requests signed by AWS signature version 4 so
+// private buckets need no presigned url. Buckets are addressed in the path
+// of the endpoint with F_s3_path_style, as MinIO wants, else as a
+// subdomain of it.
+type S3Origin struct {
+	HttpOrigin
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	// Temporary credentials come with a session token.
+	sessionToken string
+	pathStyle    bool
+}
+
+// Hash of the empty payload of GET and HEAD requests.
+const kEmptyPayloadSha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func NewS3Origin() *S3Origin {
+	so := &S3Origin{
+		region:       definition.F_s3_region,
+		accessKey:    definition.F_s3_access_key_id,
+		secretKey:    definition.F_s3_secret_access_key,
+		sessionToken: definition.F_s3_session_token,
+		pathStyle:    definition.F_s3_path_style,
+	}
+	if so.region == "" {
+		so.region = "us-east-1"
+	}
+	endpoint := definition.F_s3_endpoint
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	so.endpoint, _ = url.Parse(endpoint)
+	so.HttpOrigin = HttpOrigin{client: http.DefaultClient, resolve: so.resolve, sign: so.sign}
+	return so
+}
+
+// Url of s3://bucket/key at the endpoint.
+func (so *S3Origin) resolve(key string) (string, error) {
+	bucket, object, found := strings.Cut(strings.TrimPrefix(key, kS3Scheme), "/")
+	if !found || bucket == "" || object == "" {
+		return "", errors.New("invalid s3 url " + key)
+	}
+	if so.endpoint == nil || so.endpoint.Host == "" {
+		return "", errors.New("invalid s3 endpoint " + definition.F_s3_endpoint)
+	}
+	u := url.URL{Scheme: so.endpoint.Scheme, Host: so.endpoint.Host}
+	path := strings.TrimSuffix(so.endpoint.Path, "/")
+	if so.pathStyle {
+		path += "/" + bucket
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	u.Path = path + "/" + object
+	u.RawPath = s3EscapePath(u.Path)
+	return u.String(), nil
+}
+
+func (so *S3Origin) sign(req *http.Request) {
+	if so.accessKey == "" {
+		// Public bucket.
+		return
+	}
+	if so.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", so.sessionToken)
+	}
+	signV4(req, so.accessKey, so.secretKey, so.region, "s3", time.Now())
+}
+
+// Escape each segment of path as S3 expects, everything but unreserved
+// characters.
+func s3EscapePath(path string) string {
+	var sb strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+	}
+	return sb.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign req, which has no body, with AWS signature version 4. All headers
+// of req are signed.
+func signV4(req *http.Request, accessKey string, secretKey string, region string,
+	service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", kEmptyPayloadSha256)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		kEmptyPayloadSha256,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSha256([]byte("AWS4"+secretKey), date)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, service)
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
@@ -0,0 +1,275 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	db_ops "holder/src/db_ops"
+
+	"github.com/common/definition"
+	range_code "github.com/common/range_code"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Objects can be pinned by cache key or key prefix, with an optional
+// expiry. Pinning a url also fetches its object if it isn't cached.
+// Pinned objects are kept out of the eviction policy so they're never
+// evicted, whatever triplet they sit in. Pins are stored in the metadata
+// store and expired ones are dropped by loopPins. Bytes of pinned objects
+// get room on top of F_CACHE_MAX_SIZE up to F_pin_max_size, pinned bytes
+// beyond it count against the max size and are reported.
+
+const kPinCheckInterval = time.Minute
+
+// Pinned bytes and the pins, for the admin endpoint.
+type PinStats struct {
+	Pins        []db_ops.Pin `json:"pins"`
+	Objects     int          `json:"objects"`
+	PinnedBytes int64        `json:"pinned_bytes"`
+	MaxBytes    int64        `json:"max_pinned_bytes"`
+	// The excess counts against F_CACHE_MAX_SIZE.
+	OverCapacity bool `json:"over_capacity"`
+}
+
+func (mgr *CacheManager) loadPins() {
+	pins, err := mgr.dbOpsFile.ListPinsFromDB()
+	if err != nil {
+		ZapLogger.Error("loadPins failed", zap.Any("err", err))
+		return
+	}
+	mgr.pinMtx.Lock()
+	mgr.pins = pins
+	mgr.pinMtx.Unlock()
+	ZapLogger.Info("loadPins finished", zap.Any("pins", len(pins)))
+}
+
+func pinMatches(pin db_ops.Pin, fid string, now int64) bool {
+	if pin.ExpiresAt > 0 && pin.ExpiresAt <= now {
+		return false
+	}
+	if pin.Prefix {
+		return strings.HasPrefix(fid, pin.Key)
+	}
+	return fid == pin.Key
+}
+
+func (mgr *CacheManager) isPinnedLocked(fid string) bool {
+	now := time.Now().Unix()
+	for _, pin := range mgr.pins {
+		if pinMatches(pin, fid, now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (mgr *CacheManager) IsPinned(fid string) bool {
+	mgr.pinMtx.Lock()
+	defer mgr.pinMtx.Unlock()
+	return mgr.isPinnedLocked(fid)
+}
+
+// Pin the object of cache key, or all objects whose key starts with it if
+// prefix. ttlSec 0 never expires. Pinning again updates the expiry.
+func (mgr *CacheManager) Pin(key string, prefix bool, ttlSec int64) error {
+	if key == "" {
+		return errors.New("empty pin key")
+	}
+	pin := db_ops.Pin{Key: key, Prefix: prefix}
+	if ttlSec > 0 {
+		pin.ExpiresAt = time.Now().Unix() + ttlSec
+	}
+	if err := mgr.dbOpsFile.PutPinInDB(pin); err != nil {
+		return err
+	}
+	mgr.pinMtx.Lock()
+	mgr.pins = append(removePin(mgr.pins, key, prefix), pin)
+	mgr.pinMtx.Unlock()
+	ZapLogger.Info("Pinned", zap.Any("pin", pin))
+	return mgr.refreshPinned()
+}
+
+// Pin the object of url and queue its fetch, see Pin. Returns the prefetch
+// job fetching it.
+func (mgr *CacheManager) PinUrl(url string, ttlSec int64) (PrefetchJob, error) {
+	if err := mgr.Pin(CacheKey(url), false, ttlSec); err != nil {
+		return PrefetchJob{}, err
+	}
+	return mgr.Prefetch([]string{url})
+}
+
+func (mgr *CacheManager) Unpin(key string, prefix bool) error {
+	if err := mgr.dbOpsFile.DeletePinInDB(key, prefix); err != nil {
+		return err
+	}
+	mgr.pinMtx.Lock()
+	mgr.pins = removePin(mgr.pins, key, prefix)
+	mgr.pinMtx.Unlock()
+	ZapLogger.Info("Unpinned", zap.Any("key", key), zap.Any("prefix", prefix))
+	return mgr.refreshPinned()
+}
+
+func removePin(pins []db_ops.Pin, key string, prefix bool) []db_ops.Pin {
+	res := make([]db_ops.Pin, 0, len(pins))
+	for _, pin := range pins {
+		if pin.Key != key || pin.Prefix != prefix {
+			res = append(res, pin)
+		}
+	}
+	return res
+}
+
+func (mgr *CacheManager) GetPinStats() PinStats {
+	mgr.pinMtx.Lock()
+	defer mgr.pinMtx.Unlock()
+	pinnedBytes := mgr.pinnedBytesLocked()
+	return PinStats{
+		Pins:         append([]db_ops.Pin{}, mgr.pins...),
+		Objects:      len(mgr.pinned),
+		PinnedBytes:  pinnedBytes,
+		MaxBytes:     definition.F_pin_max_size,
+		OverCapacity: pinnedBytes > definition.F_pin_max_size,
+	}
+}
+
+// Keep the cached object out of the eviction policy if it's pinned,
+// returns false if it isn't.
+func (mgr *CacheManager) touchPinned(fid string, token string, size int64) bool {
+	mgr.pinMtx.Lock()
+	defer mgr.pinMtx.Unlock()
+	if !mgr.isPinnedLocked(fid) {
+		return false
+	}
+	mgr.pinned[fid] = cachedObject{fid: fid, token: token, size: size}
+	mgr.pbh.SetPinnedBytes(mgr.pinnedBytesLocked())
+	return true
+}
+
+// Forget the object, pinned or not.
+func (mgr *CacheManager) removeObject(fid string) {
+	mgr.objects.Remove(fid)
+	mgr.pinMtx.Lock()
+	defer mgr.pinMtx.Unlock()
+	if _, exist := mgr.pinned[fid]; exist {
+		delete(mgr.pinned, fid)
+		mgr.pbh.SetPinnedBytes(mgr.pinnedBytesLocked())
+	}
+}
+
+func (mgr *CacheManager) pinnedBytesLocked() int64 {
+	total := int64(0)
+	for _, obj := range mgr.pinned {
+		total += obj.size
+	}
+	return total
+}
+
+// Move the cached objects matching the pins out of the eviction policy,
+// and those no longer matching back in.
+func (mgr *CacheManager) refreshPinned() error {
+	mgr.pinMtx.Lock()
+	pins := append([]db_ops.Pin{}, mgr.pins...)
+	mgr.pinMtx.Unlock()
+
+	matched := make(map[string]cachedObject)
+	if len(pins) > 0 {
+		now := time.Now().Unix()
+		afterFid := ""
+		for {
+			rows, err := mgr.dbOpsFile.ListFilesFromDB(afterFid, kMetaGcPageSize)
+			if err != nil {
+				return err
+			}
+			for _, row := range rows {
+				if row.State != definition.F_DB_STATE_READY ||
+					row.Meta.RngCodeList == nil || row.Meta.RngCodeList.Len() == 0 {
+					continue
+				}
+				for _, pin := range pins {
+					if pinMatches(pin, row.Fid, now) {
+						rngCode := row.Meta.RngCodeList.Front().Value.(range_code.RangeCode)
+						matched[row.Fid] = cachedObject{fid: row.Fid, token: rngCode.Token,
+							size: rngCode.End - rngCode.Start}
+						break
+					}
+				}
+			}
+			if len(rows) < kMetaGcPageSize {
+				break
+			}
+			afterFid = rows[len(rows)-1].Fid
+		}
+	}
+
+	mgr.pinMtx.Lock()
+	defer mgr.pinMtx.Unlock()
+	pinned := make(map[string]cachedObject)
+	for fid, obj := range matched {
+		if cur, exist := mgr.pinned[fid]; exist {
+			// Touched during the scan, its token is the latest.
+			pinned[fid] = cur
+		} else if mgr.objects.Has(fid) {
+			pinned[fid] = obj
+		}
+		// Otherwise evicted or dropped since the scan.
+	}
+	for fid, obj := range mgr.pinned {
+		if _, exist := pinned[fid]; exist {
+			continue
+		}
+		if mgr.isPinnedLocked(fid) {
+			// Cached during the scan.
+			pinned[fid] = obj
+			continue
+		}
+		mgr.objects.Touch(obj.fid, obj.token, obj.size)
+	}
+	for fid := range pinned {
+		mgr.objects.Remove(fid)
+	}
+	mgr.pinned = pinned
+	pinnedBytes := mgr.pinnedBytesLocked()
+	mgr.pbh.SetPinnedBytes(pinnedBytes)
+	ZapLogger.Info("refreshPinned finished", zap.Any("pins", len(mgr.pins)),
+		zap.Any("objects", len(mgr.pinned)), zap.Any("pinnedBytes", pinnedBytes))
+	mgr.reportPinnedLocked(pinnedBytes)
+	return nil
+}
+
+func (mgr *CacheManager) reportPinnedLocked(pinnedBytes int64) {
+	if pinnedBytes > definition.F_pin_max_size {
+		ZapLogger.Warn("pinned bytes exceed their capacity, the excess counts against the cache size",
+			zap.Any("pinnedBytes", pinnedBytes), zap.Any("F_pin_max_size", definition.F_pin_max_size))
+	}
+}
+
+// Drop expired pins and report pinned bytes above their capacity.
+func (mgr *CacheManager) loopPins() {
+	for {
+		time.Sleep(kPinCheckInterval)
+
+		now := time.Now().Unix()
+		mgr.pinMtx.Lock()
+		var expired []db_ops.Pin
+		for _, pin := range mgr.pins {
+			if pin.ExpiresAt > 0 && pin.ExpiresAt <= now {
+				expired = append(expired, pin)
+			}
+		}
+		mgr.pinMtx.Unlock()
+		for _, pin := range expired {
+			if err := mgr.Unpin(pin.Key, pin.Prefix); err != nil {
+				ZapLogger.Error("drop expired pin failed", zap.Any("pin", pin), zap.Any("err", err))
+			}
+		}
+		mgr.pinMtx.Lock()
+		mgr.reportPinnedLocked(mgr.pinnedBytesLocked())
+		mgr.pinMtx.Unlock()
+	}
+}
@@ -0,0 +1,228 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/common/definition"
+	"github.com/common/util"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Prefetch jobs warm the cache ahead of reads, e.g. to stage the inputs of
+// a training job. Their urls are fetched by F_prefetch_workers workers
+// which yield to the downloads of reads: a worker doesn't start a url
+// while F_prefetch_yield_downloads or more of them are running. Prefetched
+// objects skip admission. A job is kept F_prefetch_job_ttl_sec after it's
+// finished so its progress can be polled, expired jobs are dropped when
+// jobs are queued or polled.
+
+// Urls failed kept by a job, the others are only counted.
+const kPrefetchMaxErrors = 16
+
+// Progress of a prefetch job.
+type PrefetchJob struct {
+	Id    string `json:"id"`
+	Total int64  `json:"total"`
+	// Urls cached, by the job or already.
+	Done   int64 `json:"done"`
+	Cached int64 `json:"already_cached"`
+	Failed int64 `json:"failed"`
+	// Bytes downloaded by the job.
+	Bytes int64 `json:"bytes"`
+	// Unix seconds, FinishedAt is 0 while the job is running.
+	CreatedAt  int64    `json:"created_at"`
+	FinishedAt int64    `json:"finished_at"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+type prefetchItem struct {
+	job *PrefetchJob
+	url string
+}
+
+// Read a list of urls, 1 per line. Blank lines and lines starting with #
+// are skipped.
+func ReadPrefetchList(r io.Reader) ([]string, error) {
+	var urls []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+// Read the list of urls of a manifest stored at origin.
+func LoadPrefetchManifest(url string) ([]string, error) {
+	body, _, err := OpenOrigin(url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ReadPrefetchList(body)
+}
+
+// Queue the urls behind those of earlier jobs, returns the new job.
+func (mgr *CacheManager) Prefetch(urls []string) (PrefetchJob, error) {
+	if len(urls) == 0 {
+		return PrefetchJob{}, errors.New("no url to prefetch")
+	}
+	now := time.Now().Unix()
+	job := &PrefetchJob{Id: util.ShordGuidGenerator(), Total: int64(len(urls)), CreatedAt: now}
+	mgr.pfMtx.Lock()
+	defer mgr.pfMtx.Unlock()
+	mgr.dropExpiredJobsLocked(now)
+	mgr.pfJobs[job.Id] = job
+	for _, url := range urls {
+		mgr.pfQueue = append(mgr.pfQueue, prefetchItem{job: job, url: url})
+	}
+	mgr.pfCond.Broadcast()
+	ZapLogger.Info("Prefetch job queued", zap.Any("job", job.Id), zap.Any("urls", len(urls)),
+		zap.Any("queued", len(mgr.pfQueue)))
+	return copyJob(job), nil
+}
+
+// Drop the jobs finished more than F_prefetch_job_ttl_sec before now.
+func (mgr *CacheManager) dropExpiredJobsLocked(now int64) {
+	for id, j := range mgr.pfJobs {
+		if j.FinishedAt > 0 && now-j.FinishedAt > definition.F_prefetch_job_ttl_sec {
+			delete(mgr.pfJobs, id)
+		}
+	}
+}
+
+func copyJob(job *PrefetchJob) PrefetchJob {
+	res := *job
+	res.Errors = append([]string{}, job.Errors...)
+	return res
+}
+
+func (mgr *CacheManager) GetPrefetchJob(id string) (PrefetchJob, bool) {
+	mgr.pfMtx.Lock()
+	defer mgr.pfMtx.Unlock()
+	mgr.dropExpiredJobsLocked(time.Now().Unix())
+	job, exist := mgr.pfJobs[id]
+	if !exist {
+		return PrefetchJob{}, false
+	}
+	return copyJob(job), true
+}
+
+func (mgr *CacheManager) ListPrefetchJobs() []PrefetchJob {
+	mgr.pfMtx.Lock()
+	defer mgr.pfMtx.Unlock()
+	mgr.dropExpiredJobsLocked(time.Now().Unix())
+	res := make([]PrefetchJob, 0, len(mgr.pfJobs))
+	for _, job := range mgr.pfJobs {
+		res = append(res, copyJob(job))
+	}
+	return res
+}
+
+func (mgr *CacheManager) loopPrefetch() {
+	for {
+		mgr.pfMtx.Lock()
+		for len(mgr.pfQueue) == 0 {
+			mgr.pfCond.Wait()
+		}
+		item := mgr.pfQueue[0]
+		mgr.pfQueue = mgr.pfQueue[1:]
+		mgr.pfMtx.Unlock()
+		mgr.runPrefetchItem(item)
+	}
+}
+
+// Prefetch the url of item once reads leave room, and count it in its job.
+func (mgr *CacheManager) runPrefetchItem(item prefetchItem) {
+	mgr.yieldToReads()
+	atomic.AddInt64(&mgr.prefetching, 1)
+	size, cached, err := mgr.prefetchOne(item.url)
+	atomic.AddInt64(&mgr.prefetching, -1)
+
+	mgr.pfMtx.Lock()
+	defer mgr.pfMtx.Unlock()
+	job := item.job
+	if err != nil {
+		ZapLogger.Warn("Prefetch failed", zap.Any("job", job.Id),
+			zap.Any("url", item.url), zap.Any("err", err))
+		job.Failed++
+		if len(job.Errors) < kPrefetchMaxErrors {
+			job.Errors = append(job.Errors, item.url+": "+err.Error())
+		}
+	} else {
+		job.Done++
+		job.Bytes += size
+		if cached {
+			job.Cached++
+		}
+	}
+	if job.Done+job.Failed == job.Total {
+		job.FinishedAt = time.Now().Unix()
+		ZapLogger.Info("Prefetch job finished", zap.Any("job", *job))
+	}
+}
+
+// Wait while reads have F_prefetch_yield_downloads downloads running.
+func (mgr *CacheManager) yieldToReads() {
+	if definition.F_prefetch_yield_downloads <= 0 {
+		return
+	}
+	for {
+		mgr.dMtx.Lock()
+		reads := int64(len(mgr.downloads)) - atomic.LoadInt64(&mgr.prefetching)
+		mgr.dMtx.Unlock()
+		if reads < definition.F_prefetch_yield_downloads {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// Cache the object of url, returns the bytes downloaded, or cached true if
+// it was already in cache.
+func (mgr *CacheManager) prefetchOne(url string) (int64, bool, error) {
+	fid := CacheKey(url)
+	_, state, err := mgr.dbOpsFile.ListFileAndStateFromDB(fid)
+	if err != nil {
+		return 0, false, err
+	}
+	if state == -1 {
+		fm := definition.FileMeta{Name: url, MaxAge: -1}
+		if cErr := mgr.dbOpsFile.CreateFileWithFidInDB(fid, &fm); cErr != nil {
+			// A read may have created it meanwhile.
+			_, state, err = mgr.dbOpsFile.ListFileAndStateFromDB(fid)
+			if err != nil {
+				return 0, false, err
+			}
+			if state == -1 {
+				return 0, false, cErr
+			}
+		}
+	}
+	if state == definition.F_DB_STATE_READY {
+		return 0, true, nil
+	}
+	d, err := mgr.AttachDownload(fid, url, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer d.Release()
+	if err := d.WaitCommitted(); err != nil {
+		return 0, false, err
+	}
+	return d.Written(), false, nil
+}
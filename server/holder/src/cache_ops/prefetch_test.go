@@ -0,0 +1,116 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/common/definition"
+	"github.com/common/util"
+)
+
+// Run the queued items of the prefetch jobs.
+func runPrefetchQueue(mgr *CacheManager) {
+	mgr.pfMtx.Lock()
+	queue := mgr.pfQueue
+	mgr.pfQueue = nil
+	mgr.pfMtx.Unlock()
+	for _, item := range queue {
+		mgr.runPrefetchItem(item)
+	}
+}
+
+// Urls already cached count as done, the ones not cached, for lack of
+// space or missing at origin, as failed.
+func TestPrefetchJobProgress(t *testing.T) {
+	mgr := newTestManager(t, 1024*1024)
+	cached := writeTestObject(t, 100)
+	mgr.dbOpsFile.CreateFileWithFidInDB(CacheKey(cached),
+		&definition.FileMeta{Name: cached, MaxAge: -1})
+	mgr.dbOpsFile.CommitCacheFileInDB(CacheKey(cached),
+		util.GenerateBlobToken("t1", "blb"), 100, "", -1)
+	noSpace := writeTestObject(t, 1000)
+	fillTestManager(mgr)
+
+	queued, err := mgr.Prefetch([]string{cached, noSpace, "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runPrefetchQueue(mgr)
+	job, ok := mgr.GetPrefetchJob(queued.Id)
+	if !ok || job.Done != 1 || job.Cached != 1 || job.Failed != 2 || job.FinishedAt == 0 {
+		t.Fatalf("job %+v", job)
+	}
+	if len(job.Errors) != 2 || !strings.HasPrefix(job.Errors[0], noSpace+": ") ||
+		!strings.HasPrefix(job.Errors[1], "/missing: ") {
+		t.Fatalf("errors %q", job.Errors)
+	}
+	if _, state, _ := mgr.dbOpsFile.ListFileAndStateFromDB(CacheKey(noSpace)); state != -1 {
+		t.Fatalf("file not cached left in state %d", state)
+	}
+}
+
+// Finished jobs are dropped once their ttl is over, even if no job is
+// queued since.
+func TestPrefetchJobExpired(t *testing.T) {
+	mgr := newTestManager(t, 1024*1024)
+	ttl := definition.F_prefetch_job_ttl_sec
+	defer func() { definition.F_prefetch_job_ttl_sec = ttl }()
+	definition.F_prefetch_job_ttl_sec = 60
+
+	finished, _ := mgr.Prefetch([]string{"/a"})
+	running, _ := mgr.Prefetch([]string{"/b"})
+	mgr.pfMtx.Lock()
+	mgr.pfJobs[finished.Id].FinishedAt = time.Now().Unix() - 30
+	mgr.pfMtx.Unlock()
+	if _, ok := mgr.GetPrefetchJob(finished.Id); !ok {
+		t.Fatal("job dropped before its ttl")
+	}
+
+	mgr.pfMtx.Lock()
+	mgr.pfJobs[finished.Id].FinishedAt = time.Now().Unix() - 61
+	mgr.pfMtx.Unlock()
+	if _, ok := mgr.GetPrefetchJob(finished.Id); ok {
+		t.Fatal("expired job polled")
+	}
+	if jobs := mgr.ListPrefetchJobs(); len(jobs) != 1 || jobs[0].Id != running.Id {
+		t.Fatalf("jobs %+v", jobs)
+	}
+}
+
+// Prefetches wait while reads run F_prefetch_yield_downloads downloads,
+// their own downloads don't count.
+func TestPrefetchYieldsToReads(t *testing.T) {
+	mgr := newTestManager(t, 1024*1024)
+	yield := definition.F_prefetch_yield_downloads
+	defer func() { definition.F_prefetch_yield_downloads = yield }()
+	definition.F_prefetch_yield_downloads = 1
+
+	mgr.downloads["read"] = new(Download)
+	mgr.downloads["prefetch"] = new(Download)
+	atomic.AddInt64(&mgr.prefetching, 1)
+	yielded := make(chan struct{})
+	go func() {
+		mgr.yieldToReads()
+		close(yielded)
+	}()
+	select {
+	case <-yielded:
+		t.Fatal("prefetch didn't yield to a read")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	mgr.dMtx.Lock()
+	delete(mgr.downloads, "read")
+	mgr.dMtx.Unlock()
+	select {
+	case <-yielded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("prefetch still waiting with no read")
+	}
+}
@@ -0,0 +1,87 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package cache_ops
+
+import (
+	"time"
+
+	"github.com/common/definition"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// The watermark evictor keeps the cache between its low and high
+// watermarks, so space is there before downloads need it. Once used bytes,
+// reserved ones included, go above the high watermark, objects are evicted
+// until used bytes would get down to the low watermark. Pinned bytes given
+// room on top of the max size aren't counted. Evicting only deletes blobs,
+// their bytes are reclaimed when their triplet is purged or compacted. So
+// only the bytes purges and compactions won't reclaim, counting blobs
+// waiting for their deletion, are evicted: compaction leaves the triplets
+// with a high live ratio alone.
+
+const kWatermarkCheckInterval = time.Second
+
+func (mgr *CacheManager) loopWatermarkEviction() {
+	if definition.F_eviction_high_watermark <= 0 {
+		ZapLogger.Info("watermark eviction disabled")
+		return
+	}
+	ticker := time.NewTicker(kWatermarkCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-mgr.evictKick:
+		}
+		mgr.RunWatermarkEviction()
+	}
+}
+
+// Wake up the watermark evictor without waiting for its next check.
+func (mgr *CacheManager) kickEviction() {
+	select {
+	case mgr.evictKick <- struct{}{}:
+	default:
+	}
+}
+
+// Evict objects if the cache is above its high watermark, returns the
+// bytes evicted.
+func (mgr *CacheManager) RunWatermarkEviction() int64 {
+	maxSize := float64(definition.F_CACHE_MAX_SIZE)
+	high := int64(definition.F_eviction_high_watermark * maxSize)
+	low := int64(definition.F_eviction_low_watermark * maxSize)
+	used := mgr.pbh.GetTotalBytes() + mgr.pbh.GetReservedBytes() - mgr.pbh.GetPinnedBytes()
+	if used <= high {
+		return 0
+	}
+	liveRatio := 0.0
+	if definition.F_compact_interval_sec > 0 {
+		liveRatio = definition.F_compact_live_ratio
+	}
+	reclaimable := mgr.pbh.GetReclaimableBytes(liveRatio, mgr.pendingPurges())
+	if used-reclaimable <= low {
+		ZapLogger.Info("above high watermark, left to purges and compaction",
+			zap.Any("used", used), zap.Any("reclaimable", reclaimable))
+		return 0
+	}
+	freed := mgr.evict(used - reclaimable - low)
+	ZapLogger.Info("Watermark eviction", zap.Any("used", used),
+		zap.Any("reclaimable", reclaimable), zap.Any("high", high),
+		zap.Any("low", low), zap.Any("freed", freed))
+	return freed
+}
+
+// Tokens of the blobs waiting for their deletion.
+func (mgr *CacheManager) pendingPurges() []string {
+	mgr.bMtx.Lock()
+	defer mgr.bMtx.Unlock()
+	tokens := make([]string, 0, len(mgr.bQueue))
+	for _, bp := range mgr.bQueue {
+		tokens = append(tokens, bp.token)
+	}
+	return tokens
+}
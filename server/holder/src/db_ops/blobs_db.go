@@ -63,7 +63,7 @@ func (opsBlb *DBOpsBlobSeg) GetConn() *sql.DB {
 // we turn token into the final token which contains both triplet id and blob
 // id and also modify its state to ready.
 func (opsBlb *DBOpsBlobSeg) CreateBlobSegInDB(
-	rng []int32,
+	rng []int64,
 	fileId string,
 	// User shall create blob id before passing in as token.
 	partialToken string) error {
@@ -154,7 +154,7 @@ func (opsBlb *DBOpsBlobSeg) ListBlobSegsByFidFromDB(fid string) (*[]definition.B
 // change blob state, update blob child_name field from range+blb_id to
 // range+triplet+blb_id.
 func (opsBlb *DBOpsBlobSeg) CommitBlobInDB(
-	rng []int32, fid string, fullToken string) error {
+	rng []int64, fid string, fullToken string) error {
 	// Prepare ctx for executing query.
 	var ctx context.Context
 	ctx, stop := context.WithCancel(context.Background())
@@ -0,0 +1,571 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package db_ops
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	definition "github.com/common/definition"
+	range_code "github.com/common/range_code"
+	"github.com/common/util"
+	. "github.com/common/zaplog"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// Bucket of file entries, fid->boltFileRow.
+var kBoltFilesBucket = []byte("oss_files")
+
+// Secondary index of file entries by owner, owners+"\x00"+fid->nil.
+var kBoltOwnersBucket = []byte("oss_files_owners")
+
+// Bucket of pins, pinKey(key, prefix)->Pin.
+var kBoltPinsBucket = []byte("oss_pins")
+
+// BoltStore is the embedded file-backed MetadataStore, a single-node cache
+// can run with it instead of a MySQL server. It mirrors the oss_files table,
+// each row is stored as a JSON document keyed by fid.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// A row of oss_files.
+type boltFileRow struct {
+	FileMeta  DBFileMeta
+	Owners    string
+	State     int
+	CreatedAt int64
+	UpdatedAt int64
+}
+
+func (bs *BoltStore) New(path string) {
+	path = boltPath(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		ZapLogger.Fatal("create bolt db dir", zap.Any("path", path), zap.Any("err", err))
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		ZapLogger.Fatal("open bolt db", zap.Any("path", path), zap.Any("err", err))
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(kBoltFilesBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(kBoltOwnersBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(kBoltPinsBucket)
+		return err
+	})
+	if err != nil {
+		ZapLogger.Fatal("create bolt buckets", zap.Any("path", path), zap.Any("err", err))
+	}
+	bs.db = db
+	ZapLogger.Info("*BoltStore.New() OK.", zap.Any("path", path))
+}
+
+// Open an existing db without creating anything, writes fail if readOnly.
+func (bs *BoltStore) OpenExisting(path string, readOnly bool) {
+	path = boltPath(path)
+	if _, err := os.Stat(path); err != nil {
+		ZapLogger.Fatal("open bolt db", zap.Any("path", path), zap.Any("err", err))
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		ZapLogger.Fatal("open bolt db", zap.Any("path", path), zap.Any("err", err))
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{kBoltFilesBucket, kBoltOwnersBucket, kBoltPinsBucket} {
+			if tx.Bucket(name) == nil {
+				return fmt.Errorf("bucket %s missing", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ZapLogger.Fatal("open bolt db", zap.Any("path", path), zap.Any("err", err))
+	}
+	bs.db = db
+	ZapLogger.Info("*BoltStore.OpenExisting() OK.", zap.Any("path", path),
+		zap.Any("readOnly", readOnly))
+}
+
+func boltPath(path string) string {
+	if path != "" {
+		return path
+	}
+	return definition.BlobDir() + "/oss_meta.db"
+}
+
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
+
+func ownerKey(owners string, fid string) []byte {
+	return []byte(owners + "\x00" + fid)
+}
+
+// Returns nil row if fid doesn't exist.
+func getRow(tx *bolt.Tx, fid string) (*boltFileRow, error) {
+	encoded := tx.Bucket(kBoltFilesBucket).Get([]byte(fid))
+	if encoded == nil {
+		return nil, nil
+	}
+	var row boltFileRow
+	if err := json.Unmarshal(encoded, &row); err != nil {
+		ZapLogger.Error("Convert bolt row to dbfm failed",
+			zap.Any("fid", fid), zap.Any("err", err))
+		return nil, err
+	}
+	return &row, nil
+}
+
+// Insert or overwrite the row of fid, keeping the owners index in sync.
+func putRow(tx *bolt.Tx, fid string, row *boltFileRow, prevOwners string) error {
+	row.UpdatedAt = time.Now().Unix()
+	encoded, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(kBoltFilesBucket).Put([]byte(fid), encoded); err != nil {
+		return err
+	}
+	idx := tx.Bucket(kBoltOwnersBucket)
+	if err := idx.Delete(ownerKey(prevOwners, fid)); err != nil {
+		return err
+	}
+	return idx.Put(ownerKey(row.Owners, fid), nil)
+}
+
+func deleteRow(tx *bolt.Tx, fid string, owners string) error {
+	if err := tx.Bucket(kBoltFilesBucket).Delete([]byte(fid)); err != nil {
+		return err
+	}
+	return tx.Bucket(kBoltOwnersBucket).Delete(ownerKey(owners, fid))
+}
+
+func (bs *BoltStore) ListFileFromDB(fileId string, state int32) (*definition.FileMeta, error) {
+	fm, curState, err := bs.ListFileAndStateFromDB(fileId)
+	if err != nil || fm == nil || curState != int(state) {
+		return nil, err
+	}
+	return fm, nil
+}
+
+func (bs *BoltStore) ListFileAndStateFromDB(fileId string) (*definition.FileMeta, int, error) {
+	var row *boltFileRow
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		row, err = getRow(tx, fileId)
+		return err
+	})
+	if err != nil {
+		ZapLogger.Error("Query file_meta from bolt failed", zap.Any("fid", fileId), zap.Any("err", err))
+		return nil, -1, err
+	}
+	if row == nil {
+		return nil, -1, nil
+	}
+	fm := DBFileMeta2FileMeta(&row.FileMeta)
+	return &fm, row.State, nil
+}
+
+func (bs *BoltStore) CreateFileWithFidInDB(fileId string, fileMeta *definition.FileMeta) error {
+	dbfm := FileMeta2DBFileMeta(fileMeta)
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(kBoltFilesBucket).Get([]byte(fileId)) != nil {
+			return errors.New("duplicate entry of fid")
+		}
+		row := boltFileRow{
+			FileMeta:  dbfm,
+			Owners:    dbfm.OwnerList,
+			State:     definition.F_DB_STATE_PENDING,
+			CreatedAt: time.Now().Unix(),
+		}
+		return putRow(tx, fileId, &row, dbfm.OwnerList)
+	})
+	if err != nil {
+		ZapLogger.Error("Insert file_meta to bolt failed", zap.Any("dbfm", dbfm), zap.Any("err", err))
+		return err
+	}
+	return nil
+}
+
+func (bs *BoltStore) ListFileAndOwnersFromDB(fileId string) (*definition.FileMeta, string, error) {
+	var row *boltFileRow
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		row, err = getRow(tx, fileId)
+		return err
+	})
+	if err != nil {
+		ZapLogger.Error("Query file_meta, owners from bolt failed",
+			zap.Any("fid", fileId), zap.Any("err", err))
+		return nil, "", err
+	}
+	if row == nil {
+		return nil, "", errors.New("file not found")
+	}
+	fm := DBFileMeta2FileMeta(&row.FileMeta)
+	return &fm, row.Owners, nil
+}
+
+// Update an existing row, fn modifies the row in place.
+func (bs *BoltStore) updateRow(fid string, fn func(row *boltFileRow) error) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		row, err := getRow(tx, fid)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			return errors.New("file not found")
+		}
+		prevOwners := row.Owners
+		if err := fn(row); err != nil {
+			return err
+		}
+		return putRow(tx, fid, row, prevOwners)
+	})
+}
+
+func (bs *BoltStore) UpdateFilemetaAndOwnerInDB(fileId string, dbfm *DBFileMeta) error {
+	err := bs.updateRow(fileId, func(row *boltFileRow) error {
+		row.FileMeta = *dbfm
+		row.Owners = dbfm.OwnerList
+		return nil
+	})
+	if err != nil {
+		ZapLogger.Error("UPDATE file_meta, owners to bolt failed", zap.Any("dbfm", dbfm), zap.Any("err", err))
+	}
+	return err
+}
+
+func (bs *BoltStore) UpdateFilemetaAndStateInDB(fileName string,
+	fileMeta *definition.FileMeta, state int) error {
+	dbfm := FileMeta2DBFileMeta(fileMeta)
+	err := bs.updateRow(fileName, func(row *boltFileRow) error {
+		row.FileMeta = dbfm
+		row.State = state
+		return nil
+	})
+	if err != nil {
+		ZapLogger.Error("UPDATE file_meta, state to bolt failed",
+			zap.Any("dbfm", dbfm), zap.Any("state", state), zap.Any("err", err))
+	}
+	return err
+}
+
+// Check file if it's full moon (all ranges are filled). If yes, update file state.
+func (bs *BoltStore) CommitFileInDB(fid string) error {
+	err := bs.updateRow(fid, func(row *boltFileRow) error {
+		fm := DBFileMeta2FileMeta(&row.FileMeta)
+		if row.FileMeta.RngList != "" && !IsRangeFullCoverage(fm.RngCodeList) {
+			return errors.New("file not ready to commit")
+		}
+		row.State = definition.F_DB_STATE_READY
+		return nil
+	})
+	if err != nil {
+		ZapLogger.Error("CommitFileInDB failed", zap.Any("fid", fid), zap.Any("err", err))
+		return err
+	}
+	ZapLogger.Info("Successfully committed file in DB", zap.Any("fid", fid))
+	return nil
+}
+
+// The file content is the blob of token, owned by the triplet of token.
+// The etag and max-age of the downloaded content are recorded as validated now.
+func (bs *BoltStore) CommitCacheFileInDB(
+	fid, token string, size int64, etag string, maxAge int64) error {
+	err := bs.updateRow(fid, func(row *boltFileRow) error {
+		fm := DBFileMeta2FileMeta(&row.FileMeta)
+		fm.RngCodeList = list.New()
+		fm.RngCodeList.PushBack(range_code.RangeCode{
+			Start: 0,
+			End:   size,
+			Token: token,
+		})
+		fm.Etag = etag
+		fm.ValidatedAt = time.Now().Unix()
+		fm.MaxAge = maxAge
+		row.FileMeta = FileMeta2DBFileMeta(&fm)
+		row.Owners = util.GetTripletIdFromToken(token)
+		row.State = definition.F_DB_STATE_READY
+		return nil
+	})
+	if err != nil {
+		ZapLogger.Error("CommitCacheFileInDB failed", zap.Any("fid", fid), zap.Any("err", err))
+		return err
+	}
+	ZapLogger.Info("Successfully committed cache file in DB", zap.Any("fid", fid))
+	return nil
+}
+
+func (bs *BoltStore) DeleteFileWithTripleIdInDB(tripleId string) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		prefix := ownerKey(tripleId, "")
+		// Collect first, a bucket can't be modified while iterating it.
+		var fids []string
+		c := tx.Bucket(kBoltOwnersBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			fids = append(fids, string(k[len(prefix):]))
+		}
+		for _, fid := range fids {
+			if err := deleteRow(tx, fid, tripleId); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ZapLogger.Error("DELETE files by tripleId in bolt failed",
+			zap.Any("tripleId", tripleId), zap.Any("err", err))
+	}
+	return err
+}
+
+func (bs *BoltStore) DeletePendingFileWithFIdInDB(fileId string) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		row, err := getRow(tx, fileId)
+		if err != nil || row == nil || row.State != definition.F_DB_STATE_PENDING {
+			return err
+		}
+		return deleteRow(tx, fileId, row.Owners)
+	})
+	if err != nil {
+		ZapLogger.Error("DELETE pending file by fileId in bolt failed", zap.Any("fileId", fileId), zap.Any("err", err))
+	}
+	return err
+}
+
+func (bs *BoltStore) DeleteAllPendingFileInDB(keep []string) error {
+	kept := make(map[string]struct{}, len(keep))
+	for _, fid := range keep {
+		kept[fid] = struct{}{}
+	}
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		pending := make(map[string]string)
+		err := tx.Bucket(kBoltFilesBucket).ForEach(func(k, v []byte) error {
+			var row boltFileRow
+			if err := json.Unmarshal(v, &row); err != nil {
+				return err
+			}
+			if _, exist := kept[string(k)]; row.State == definition.F_DB_STATE_PENDING && !exist {
+				pending[string(k)] = row.Owners
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for fid, owners := range pending {
+			if err := deleteRow(tx, fid, owners); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ZapLogger.Error("DeleteAllPendingFileInDB failed", zap.Any("err", err))
+	}
+	return err
+}
+
+func (bs *BoltStore) ListTripleIdOfAllFiles() ([]string, error) {
+	res := make([]string, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(kBoltOwnersBucket).Cursor()
+		for k, _ := c.First(); k != nil; {
+			owners := k[:bytes.IndexByte(k, 0)]
+			res = append(res, string(owners))
+			// Skip the other files of the same owner.
+			k, _ = c.Seek(append(append([]byte{}, owners...), 1))
+		}
+		return nil
+	})
+	if err != nil {
+		ZapLogger.Error("ListTripleIdOfAllFiles failed", zap.Any("err", err))
+		return nil, err
+	}
+	return res, nil
+}
+
+func (bs *BoltStore) ListFilesFromDB(afterFid string, limit int) ([]FileRow, error) {
+	res := make([]FileRow, 0, limit)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(kBoltFilesBucket).Cursor()
+		k, v := c.Seek([]byte(afterFid))
+		if k != nil && string(k) == afterFid {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(res) < limit; k, v = c.Next() {
+			var row boltFileRow
+			if err := json.Unmarshal(v, &row); err != nil {
+				return err
+			}
+			fm := DBFileMeta2FileMeta(&row.FileMeta)
+			res = append(res, FileRow{
+				Fid:       string(k),
+				Meta:      &fm,
+				Owners:    row.Owners,
+				State:     row.State,
+				UpdatedAt: row.UpdatedAt,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		ZapLogger.Error("ListFilesFromDB failed", zap.Any("afterFid", afterFid), zap.Any("err", err))
+		return nil, err
+	}
+	return res, nil
+}
+
+func (bs *BoltStore) DeleteFileWithFidAndOwnerInDB(fileId string, owners string) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		row, err := getRow(tx, fileId)
+		if err != nil || row == nil || row.Owners != owners {
+			return err
+		}
+		return deleteRow(tx, fileId, owners)
+	})
+	if err != nil {
+		ZapLogger.Error("DELETE file by fid and owners in bolt failed",
+			zap.Any("fileId", fileId), zap.Any("owners", owners), zap.Any("err", err))
+	}
+	return err
+}
+
+func (bs *BoltStore) DeleteStalePendingFileInDB(fileId string, updatedBefore int64) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		row, err := getRow(tx, fileId)
+		if err != nil || row == nil ||
+			row.State != definition.F_DB_STATE_PENDING || row.UpdatedAt >= updatedBefore {
+			return err
+		}
+		return deleteRow(tx, fileId, row.Owners)
+	})
+	if err != nil {
+		ZapLogger.Error("DELETE stale pending file in bolt failed",
+			zap.Any("fileId", fileId), zap.Any("err", err))
+	}
+	return err
+}
+
+func (bs *BoltStore) ListFilesWithTripleIdFromDB(tripleId string) ([]FileRow, error) {
+	res := make([]FileRow, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		prefix := ownerKey(tripleId, "")
+		c := tx.Bucket(kBoltOwnersBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			fid := string(k[len(prefix):])
+			row, err := getRow(tx, fid)
+			if err != nil {
+				return err
+			}
+			if row == nil {
+				continue
+			}
+			fm := DBFileMeta2FileMeta(&row.FileMeta)
+			res = append(res, FileRow{
+				Fid:       fid,
+				Meta:      &fm,
+				Owners:    row.Owners,
+				State:     row.State,
+				UpdatedAt: row.UpdatedAt,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		ZapLogger.Error("ListFilesWithTripleIdFromDB failed",
+			zap.Any("tripleId", tripleId), zap.Any("err", err))
+		return nil, err
+	}
+	return res, nil
+}
+
+func (bs *BoltStore) UpdateFileTokenInDB(fileId string, oldToken string, newToken string) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		row, err := getRow(tx, fileId)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			return ErrTokenChanged
+		}
+		fm := DBFileMeta2FileMeta(&row.FileMeta)
+		if !replaceToken(&fm, oldToken, newToken) {
+			return ErrTokenChanged
+		}
+		prevOwners := row.Owners
+		row.FileMeta = FileMeta2DBFileMeta(&fm)
+		row.Owners = util.GetTripletIdFromToken(newToken)
+		return putRow(tx, fileId, row, prevOwners)
+	})
+	if err != nil && err != ErrTokenChanged {
+		ZapLogger.Error("UpdateFileTokenInDB failed", zap.Any("fid", fileId), zap.Any("err", err))
+	}
+	return err
+}
+
+// A url pin and a prefix pin of the same key are different pins.
+func pinKey(key string, prefix bool) []byte {
+	if prefix {
+		return []byte("p\x00" + key)
+	}
+	return []byte("u\x00" + key)
+}
+
+func (bs *BoltStore) PutPinInDB(pin Pin) error {
+	encoded, err := json.Marshal(pin)
+	if err != nil {
+		return err
+	}
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(kBoltPinsBucket).Put(pinKey(pin.Key, pin.Prefix), encoded)
+	})
+	if err != nil {
+		ZapLogger.Error("PutPinInDB failed", zap.Any("pin", pin), zap.Any("err", err))
+	}
+	return err
+}
+
+func (bs *BoltStore) DeletePinInDB(key string, prefix bool) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(kBoltPinsBucket).Delete(pinKey(key, prefix))
+	})
+	if err != nil {
+		ZapLogger.Error("DeletePinInDB failed", zap.Any("key", key),
+			zap.Any("prefix", prefix), zap.Any("err", err))
+	}
+	return err
+}
+
+func (bs *BoltStore) ListPinsFromDB() ([]Pin, error) {
+	res := make([]Pin, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(kBoltPinsBucket).ForEach(func(k, v []byte) error {
+			var pin Pin
+			if err := json.Unmarshal(v, &pin); err != nil {
+				return err
+			}
+			res = append(res, pin)
+			return nil
+		})
+	})
+	if err != nil {
+		ZapLogger.Error("ListPinsFromDB failed", zap.Any("err", err))
+		return nil, err
+	}
+	return res, nil
+}
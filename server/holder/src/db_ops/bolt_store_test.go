@@ -0,0 +1,157 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package db_ops
+
+import (
+	"fmt"
+	"testing"
+
+	definition "github.com/common/definition"
+	range_code "github.com/common/range_code"
+	"github.com/common/util"
+)
+
+func openTestBoltStore(t *testing.T) (*BoltStore, string) {
+	path := t.TempDir() + "/oss_meta.db"
+	bs := new(BoltStore)
+	bs.New(path)
+	t.Cleanup(func() { bs.Close() })
+	return bs, path
+}
+
+func fidsOf(rows []FileRow) string {
+	var fids []string
+	for _, row := range rows {
+		fids = append(fids, row.Fid)
+	}
+	return fmt.Sprint(fids)
+}
+
+// Files go through the cycle of the cache: created pending, committed in a
+// triplet, moved by compaction and deleted with their triplet.
+func TestBoltStoreFileCycle(t *testing.T) {
+	bs, path := openTestBoltStore(t)
+	fm := definition.FileMeta{Name: "http://h/a", MaxAge: -1}
+	for _, fid := range []string{"a", "b", "c", "p"} {
+		if err := bs.CreateFileWithFidInDB(fid, &fm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bs.CreateFileWithFidInDB("a", &fm); err == nil {
+		t.Fatal("file created twice")
+	}
+	if got, state, err := bs.ListFileAndStateFromDB("a"); err != nil || got == nil ||
+		got.Name != fm.Name || state != definition.F_DB_STATE_PENDING {
+		t.Fatalf("got %+v, state %d, %v", got, state, err)
+	}
+	if got, state, err := bs.ListFileAndStateFromDB("missing"); err != nil || got != nil ||
+		state != -1 {
+		t.Fatalf("missing file: got %+v, state %d, %v", got, state, err)
+	}
+
+	tokA := util.GenerateBlobToken("t1", "blba")
+	for fid, token := range map[string]string{"a": tokA,
+		"b": util.GenerateBlobToken("t1", "blbb"), "c": util.GenerateBlobToken("t2", "blbc")} {
+		if err := bs.CommitCacheFileInDB(fid, token, 100, `"v1"`, 60); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, owners, err := bs.ListFileAndOwnersFromDB("a")
+	if err != nil || owners != "t1" || got.Etag != `"v1"` || got.MaxAge != 60 ||
+		got.RngCodeList.Len() != 1 {
+		t.Fatalf("committed: got %+v, owners %s, %v", got, owners, err)
+	}
+	if rng := got.RngCodeList.Front().Value.(range_code.RangeCode); rng.Token != tokA ||
+		rng.Start != 0 || rng.End != 100 {
+		t.Fatalf("committed range %+v", rng)
+	}
+	if _, err := bs.ListFileFromDB("a", definition.F_DB_STATE_READY); err != nil {
+		t.Fatal(err)
+	}
+
+	if triplets, err := bs.ListTripleIdOfAllFiles(); err != nil ||
+		fmt.Sprint(triplets) != "[ t1 t2]" {
+		t.Fatalf("triplets %q, %v", triplets, err)
+	}
+	if rows, err := bs.ListFilesFromDB("", 2); err != nil || fidsOf(rows) != "[a b]" {
+		t.Fatalf("first page %s, %v", fidsOf(rows), err)
+	}
+	if rows, err := bs.ListFilesFromDB("b", 10); err != nil || fidsOf(rows) != "[c p]" {
+		t.Fatalf("next page %s, %v", fidsOf(rows), err)
+	}
+	if rows, err := bs.ListFilesWithTripleIdFromDB("t1"); err != nil || fidsOf(rows) != "[a b]" {
+		t.Fatalf("files of t1 %s, %v", fidsOf(rows), err)
+	}
+
+	// Compaction moves a into t2.
+	tokMoved := util.GenerateBlobToken("t2", "blba")
+	if err := bs.UpdateFileTokenInDB("a", tokA, tokMoved); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.UpdateFileTokenInDB("a", tokA, tokMoved); err != ErrTokenChanged {
+		t.Fatalf("stale token: got %v", err)
+	}
+
+	if err := bs.DeleteAllPendingFileInDB(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.DeleteFileWithTripleIdInDB("t1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.DeleteFileWithFidAndOwnerInDB("c", "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if rows, err := bs.ListFilesFromDB("", 10); err != nil || fidsOf(rows) != "[a c]" {
+		t.Fatalf("after deletes %s, %v", fidsOf(rows), err)
+	}
+	if rows, err := bs.ListFilesWithTripleIdFromDB("t2"); err != nil || fidsOf(rows) != "[a c]" {
+		t.Fatalf("files of t2 %s, %v", fidsOf(rows), err)
+	}
+
+	// Rows survive a reopen.
+	bs.Close()
+	bs = new(BoltStore)
+	bs.New(path)
+	defer bs.Close()
+	if _, owners, err := bs.ListFileAndOwnersFromDB("a"); err != nil || owners != "t2" {
+		t.Fatalf("reopened: owners %s, %v", owners, err)
+	}
+	if err := bs.DeleteFileWithFidAndOwnerInDB("a", "t2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, state, _ := bs.ListFileAndStateFromDB("a"); state != -1 {
+		t.Fatalf("deleted file in state %d", state)
+	}
+}
+
+func TestBoltStorePendingFiles(t *testing.T) {
+	bs, _ := openTestBoltStore(t)
+	fm := definition.FileMeta{Name: "http://h/a", MaxAge: -1}
+	for _, fid := range []string{"keep", "drop", "ready"} {
+		bs.CreateFileWithFidInDB(fid, &fm)
+	}
+	bs.CommitCacheFileInDB("ready", util.GenerateBlobToken("t1", "blb"), 10, "", -1)
+	if err := bs.DeleteAllPendingFileInDB([]string{"keep"}); err != nil {
+		t.Fatal(err)
+	}
+	if rows, err := bs.ListFilesFromDB("", 10); err != nil || fidsOf(rows) != "[keep ready]" {
+		t.Fatalf("got %s, %v", fidsOf(rows), err)
+	}
+	if err := bs.DeletePendingFileWithFIdInDB("ready"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.DeleteStalePendingFileInDB("keep", 0); err != nil {
+		t.Fatal(err)
+	}
+	if rows, _ := bs.ListFilesFromDB("", 10); fidsOf(rows) != "[keep ready]" {
+		t.Fatalf("ready or fresh pending file deleted, got %s", fidsOf(rows))
+	}
+	if err := bs.DeletePendingFileWithFIdInDB("keep"); err != nil {
+		t.Fatal(err)
+	}
+	if rows, _ := bs.ListFilesFromDB("", 10); fidsOf(rows) != "[ready]" {
+		t.Fatalf("got %s", fidsOf(rows))
+	}
+}
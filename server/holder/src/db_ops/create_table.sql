@@ -1,3 +1,5 @@
+-- Reference only, the holder creates and migrates the table at startup,
+-- see kFilesMigrations in files_schema.go.
 create table oss_files (
 	fid varchar(255) NOT NULL DEFAULT "",
 	file_meta json DEFAULT NULL,
@@ -5,6 +7,21 @@ create table oss_files (
     state tinyint(1) NOT NULL DEFAULT 0,
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    size bigint NOT NULL DEFAULT 0,
     PRIMARY KEY (fid),
 	INDEX owners (owners)
-);
\ No newline at end of file
+);
+
+create table oss_files_pins (
+    pin_key varchar(255) NOT NULL DEFAULT "",
+    prefix tinyint(1) NOT NULL DEFAULT 0,
+    expires_at bigint NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (pin_key, prefix)
+);
+
+create table oss_files_schema_version (
+    version int NOT NULL,
+    applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (version)
+);
@@ -7,7 +7,6 @@ package db_ops
 import (
 	"fmt"
 	"os"
-	"strconv"
 
 	"github.com/common/config"
 	"github.com/common/zaplog"
@@ -36,24 +35,7 @@ var driverName string
 
 var dataSourceName string
 
-func argsfunc() {
-	zaplog.ZapLogger.Info("main input")
-	for idx, arg := range os.Args {
-		zaplog.ZapLogger.Info("param", zap.Any("idx", idx), zap.Any("arg", arg))
-	}
-	if len(os.Args) >= 2 {
-		var err error
-		ShardID, err = strconv.Atoi(os.Args[1])
-		if err != nil {
-			zaplog.ZapLogger.Fatal("read shardID from input failed", zap.Any("err", err))
-		}
-	} else {
-		ShardID = 0
-	}
-}
-
 func init() {
-	argsfunc()
 	dir, err := os.Getwd()
 	if err != nil {
 		zaplog.ZapLogger.Fatal("os.Getwd()", zap.Any("err", err))
@@ -63,6 +45,16 @@ func init() {
 	zaplog.ZapLogger.Info("", zap.Any("Directory of oss_db_config file", dirDBConfig))
 
 	alldbConfigInfo = config.ParseDBConfig(dirDBConfig)
+	SelectShard(0)
+}
+
+// Use the DB config of the shard, the one of shard 0 until called. Must be
+// called before any store is created.
+func SelectShard(shardId int) {
+	if alldbConfigInfo == nil || shardId < 0 || shardId >= len(alldbConfigInfo.DbBases) {
+		zaplog.ZapLogger.Fatal("no DB config for shard", zap.Any("shardId", shardId))
+	}
+	ShardID = shardId
 	dbConfigInfo0 = &alldbConfigInfo.DbBases[ShardID]
 	dataSourceName = fmt.Sprintf("%s:%s@%s(%s:%s)/%s",
 		dbConfigInfo0.Username, dbConfigInfo0.Password, dbConfigInfo0.IPProtocol,
@@ -70,9 +62,6 @@ func init() {
 	driverName = dbConfigInfo0.DBType
 	dbIndex := dbConfigInfo0.DbBaseIndex
 	dbConfigInfo = &dbConfigInfo0.Table_name
-	if alldbConfigInfo == nil || dbConfigInfo0 == nil || dbConfigInfo == nil {
-		zaplog.ZapLogger.Fatal("init failed, null pointer.")
-	}
 	zaplog.ZapLogger.Debug("****************************")
 	zaplog.ZapLogger.Debug("", zap.Any("driverName", driverName))
 	zaplog.ZapLogger.Debug("", zap.Any("dataSourceName", dataSourceName))
@@ -34,6 +34,15 @@ type DBOpsFile struct {
 }
 
 func (opsFile *DBOpsFile) New() {
+	opsFile.connect()
+	if err := opsFile.MigrateSchema(); err != nil {
+		ZapLogger.Fatal("MigrateSchema",
+			zap.Any("table", dbConfigInfo.FileTableName), zap.Any("err", err))
+	}
+	ZapLogger.Info("*DBOpsFile.Init() OK.")
+}
+
+func (opsFile *DBOpsFile) connect() {
 	ZapLogger.Debug("", zap.String("driverName", driverName),
 		zap.String("dataSourceName", dataSourceName))
 
@@ -53,7 +62,6 @@ func (opsFile *DBOpsFile) New() {
 	}
 	opsFile.RWLock = new(sync.RWMutex)
 	opsFile.ConnLeft = definition.F_NUM_MAX_FILES_DB_CONN
-	ZapLogger.Info("*DBOpsFile.Init() OK.")
 }
 
 // Transaction uses a special pool, or a special single connection.
@@ -123,6 +131,10 @@ type DBFileMeta struct {
 	RngList string
 
 	Etag string
+
+	ValidatedAt int64
+
+	MaxAge int64
 }
 
 func DBFileMeta2FileMeta(dbfm *DBFileMeta) definition.FileMeta {
@@ -141,6 +153,8 @@ func DBFileMeta2FileMeta(dbfm *DBFileMeta) definition.FileMeta {
 		BlobId:      dbfm.BlobId,
 		RngCodeList: rngll,
 		Etag:        dbfm.Etag,
+		ValidatedAt: dbfm.ValidatedAt,
+		MaxAge:      dbfm.MaxAge,
 	}
 
 	if dbfm.RngList == "" {
@@ -177,9 +191,11 @@ func FileMeta2DBFileMeta(fm *definition.FileMeta) DBFileMeta {
 		Id:        fm.Id,
 		OwnerList: ownerStr,
 		// TODO: add the blob related code.
-		BlobId:  fm.BlobId,
-		RngList: "",
-		Etag:    fm.Etag,
+		BlobId:      fm.BlobId,
+		RngList:     "",
+		Etag:        fm.Etag,
+		ValidatedAt: fm.ValidatedAt,
+		MaxAge:      fm.MaxAge,
 	}
 
 	if fm.RngCodeList == nil {
@@ -505,9 +521,10 @@ func (opsFile *DBOpsFile) CommitFileInDB(fid string) error {
 }
 
 // Check file if it's full moon (all ranges are filled). If yes, update file state.
+// The etag and max-age of the downloaded content are recorded as validated now.
 // TODO: If too many blobs, easily this query slow & timeout.
 func (opsFile *DBOpsFile) CommitCacheFileInDB(
-	fid, token string, size int32) error {
+	fid, token string, size int64, etag string, maxAge int64) error {
 	// Prepare ctx for executing query.
 	var ctx context.Context
 	ctx, stop := context.WithCancel(context.Background())
@@ -562,6 +579,9 @@ func (opsFile *DBOpsFile) CommitCacheFileInDB(
 	tid := util.GetTripletIdFromToken(token)
 	fm.RngCodeList = list.New()
 	fm.RngCodeList.PushBack(rngCode)
+	fm.Etag = etag
+	fm.ValidatedAt = time.Now().Unix()
+	fm.MaxAge = maxAge
 	dbfm = FileMeta2DBFileMeta(&fm)
 	encoded, jsErr = json.Marshal(&dbfm)
 	if jsErr != nil {
@@ -572,8 +592,8 @@ func (opsFile *DBOpsFile) CommitCacheFileInDB(
 	}
 	_, qErr = tx.ExecContext(
 		ctx,
-		"UPDATE "+dbConfigInfo.FileTableName+" SET state = ?, owners = ?,file_meta = ? WHERE fid = ?",
-		definition.F_DB_STATE_READY, tid, encoded, fid)
+		"UPDATE "+dbConfigInfo.FileTableName+" SET state = ?, owners = ?,file_meta = ?, size = ? WHERE fid = ?",
+		definition.F_DB_STATE_READY, tid, encoded, size, fid)
 	if qErr != nil {
 		ZapLogger.Error("CommitCacheFileInDB failed",
 			zap.Any("fid", fid), zap.Any("err", qErr))
@@ -689,19 +709,53 @@ func (opsFile *DBOpsFile) DeletePendingFileWithFIdInDB(fileId string) error {
 	return nil
 }
 
-func (opsFile *DBOpsFile) DeleteAllPendingFileInDB() error {
+func (opsFile *DBOpsFile) DeleteAllPendingFileInDB(keep []string) error {
 	// Prepare ctx for executing query.
 	var ctx context.Context
 	ctx, stop := context.WithCancel(context.Background())
 	defer stop()
-	_, err := opsFile.GetConnWithRetry().ExecContext(ctx,
-		"DELETE FROM "+dbConfigInfo.FileTableName+" WHERE state = ?;",
+	if len(keep) == 0 {
+		_, err := opsFile.GetConnWithRetry().ExecContext(ctx,
+			"DELETE FROM "+dbConfigInfo.FileTableName+" WHERE state = ?;",
+			definition.F_BLOB_STATE_PENDING)
+		opsFile.ReleaseConn()
+		if err != nil {
+			ZapLogger.Error("DeleteAllPendingFileInDB failed", zap.Any("err", err))
+			return err
+		}
+		return nil
+	}
+	// Pending files are the downloads of the last run, few enough to be
+	// deleted 1 by 1 rather than with a query growing with keep.
+	rows, err := opsFile.GetConnWithRetry().QueryContext(ctx,
+		"SELECT fid FROM "+dbConfigInfo.FileTableName+" WHERE state = ?;",
 		definition.F_BLOB_STATE_PENDING)
 	opsFile.ReleaseConn()
 	if err != nil {
 		ZapLogger.Error("DeleteAllPendingFileInDB failed", zap.Any("err", err))
 		return err
 	}
+	kept := make(map[string]struct{}, len(keep))
+	for _, fid := range keep {
+		kept[fid] = struct{}{}
+	}
+	var pending []string
+	for rows.Next() {
+		var fid string
+		if err := rows.Scan(&fid); err != nil {
+			rows.Close()
+			return err
+		}
+		if _, exist := kept[fid]; !exist {
+			pending = append(pending, fid)
+		}
+	}
+	rows.Close()
+	for _, fid := range pending {
+		if err := opsFile.DeletePendingFileWithFIdInDB(fid); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -728,33 +782,175 @@ func (opsFile *DBOpsFile) ListTripleIdOfAllFiles() ([]string, error) {
 	return res, nil
 }
 
-// ////////////////////////////
+func (opsFile *DBOpsFile) ListFilesFromDB(afterFid string, limit int) ([]FileRow, error) {
+	// Prepare ctx for executing query.
+	var ctx context.Context
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	rows, err := opsFile.GetConnWithRetry().QueryContext(ctx,
+		"SELECT fid, file_meta, owners, state, UNIX_TIMESTAMP(updated_at) FROM "+
+			dbConfigInfo.FileTableName+" WHERE fid > ? ORDER BY fid LIMIT ?;",
+		afterFid, limit)
+	opsFile.ReleaseConn()
+	if err != nil {
+		ZapLogger.Error("ListFilesFromDB failed", zap.Any("afterFid", afterFid), zap.Any("err", err))
+		return nil, err
+	}
+	defer rows.Close()
+	return scanFileRows(rows)
+}
 
-// /**************************************************
-// # Below are db schema creation.
-// CREATE DATABASE dir_service;
-// use dir_service;
-
-// create table oss_files (
-// 	fid varchar(255) NOT NULL DEFAULT "",
-// 	file_meta json DEFAULT NULL,
-//     owners varchar(64) DEFAULT "",
-//     state tinyint(1) NOT NULL DEFAULT 0,
-//     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-//     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-//     PRIMARY KEY (fid),
-//     INDEX created_at_fid (created_at, fid), owners (owners)
-// );
-// CREATE TABLE `ss_files` (
-// 	`fid` varchar(32) NOT NULL DEFAULT '',
-// 	`file_meta` json DEFAULT NULL,
-// 	`owners` varchar(255) DEFAULT '',
-// 	`state` tinyint(1) NOT NULL DEFAULT '0',
-// 	`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
-// 	`updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-// 	PRIMARY KEY (`fid`),
-// 	KEY `created_at_fid` (`created_at`,`fid`),
-// 	KEY `tplt_id` (`owners`)
-// );
+func (opsFile *DBOpsFile) ListFilesWithTripleIdFromDB(tripleId string) ([]FileRow, error) {
+	// Prepare ctx for executing query.
+	var ctx context.Context
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	rows, err := opsFile.GetConnWithRetry().QueryContext(ctx,
+		"SELECT fid, file_meta, owners, state, UNIX_TIMESTAMP(updated_at) FROM "+
+			dbConfigInfo.FileTableName+" WHERE owners = ?;",
+		tripleId)
+	opsFile.ReleaseConn()
+	if err != nil {
+		ZapLogger.Error("ListFilesWithTripleIdFromDB failed",
+			zap.Any("tripleId", tripleId), zap.Any("err", err))
+		return nil, err
+	}
+	defer rows.Close()
+	return scanFileRows(rows)
+}
 
-//
+// Scan rows of (fid, file_meta, owners, state, updated_at).
+func scanFileRows(rows *sql.Rows) ([]FileRow, error) {
+	res := make([]FileRow, 0)
+	for rows.Next() {
+		var row FileRow
+		var encoded []byte
+		var owners sql.NullString
+		if err := rows.Scan(&row.Fid, &encoded, &owners, &row.State, &row.UpdatedAt); err != nil {
+			ZapLogger.Error("rows.Scan failed", zap.Any("err", err))
+			return nil, err
+		}
+		var dbfm DBFileMeta
+		if err := json.Unmarshal(encoded, &dbfm); err != nil {
+			ZapLogger.Error("Convert db string to dbfm failed",
+				zap.Any("fid", row.Fid), zap.Any("err", err))
+			return nil, err
+		}
+		fm := DBFileMeta2FileMeta(&dbfm)
+		row.Meta = &fm
+		row.Owners = owners.String
+		res = append(res, row)
+	}
+	if err := rows.Err(); err != nil {
+		ZapLogger.Error("rows.Err", zap.Any("err", err))
+		return nil, err
+	}
+	return res, nil
+}
+
+func (opsFile *DBOpsFile) UpdateFileTokenInDB(fileId string, oldToken string, newToken string) error {
+	// Prepare ctx for executing query.
+	var ctx context.Context
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	// Transaction locks: file entry
+	// Transaction updates: file entry
+	tx, err := opsFile.GetConnForTxn().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Defer a rollback in case anything fails.
+	defer tx.Rollback()
+
+	var encoded []byte
+	err = tx.QueryRowContext(ctx,
+		"SELECT file_meta FROM "+dbConfigInfo.FileTableName+" WHERE fid = ? FOR UPDATE",
+		fileId).Scan(&encoded)
+	if err == sql.ErrNoRows {
+		return ErrTokenChanged
+	} else if err != nil {
+		ZapLogger.Error("UpdateFileTokenInDB Lock file in DB failed",
+			zap.Any("fid", fileId), zap.Any("err", err))
+		return err
+	}
+	var dbfm DBFileMeta
+	if err := json.Unmarshal(encoded, &dbfm); err != nil {
+		ZapLogger.Error("Convert db string to dbfm failed",
+			zap.Any("encoded", encoded), zap.Any("err", err))
+		return err
+	}
+	fm := DBFileMeta2FileMeta(&dbfm)
+	if !replaceToken(&fm, oldToken, newToken) {
+		return ErrTokenChanged
+	}
+	dbfm = FileMeta2DBFileMeta(&fm)
+	encoded, err = json.Marshal(&dbfm)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE "+dbConfigInfo.FileTableName+" SET owners = ?, file_meta = ? WHERE fid = ?",
+		util.GetTripletIdFromToken(newToken), encoded, fileId)
+	if err != nil {
+		ZapLogger.Error("UpdateFileTokenInDB failed",
+			zap.Any("fid", fileId), zap.Any("err", err))
+		return err
+	}
+	return tx.Commit()
+}
+
+// Replace the single range code token of fm, returns false if fm doesn't
+// point at oldToken.
+func replaceToken(fm *definition.FileMeta, oldToken string, newToken string) bool {
+	if fm.RngCodeList == nil || fm.RngCodeList.Len() != 1 {
+		return false
+	}
+	rngCode := fm.RngCodeList.Front().Value.(range_code.RangeCode)
+	if rngCode.Token != oldToken {
+		return false
+	}
+	rngCode.Token = newToken
+	fm.RngCodeList.Front().Value = rngCode
+	return true
+}
+
+func (opsFile *DBOpsFile) DeleteFileWithFidAndOwnerInDB(fileId string, owners string) error {
+	// Prepare ctx for executing query.
+	var ctx context.Context
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	_, err := opsFile.GetConnWithRetry().ExecContext(ctx,
+		"DELETE FROM "+dbConfigInfo.FileTableName+" WHERE fid = ? AND owners = ?;",
+		fileId, owners)
+	opsFile.ReleaseConn()
+	if err != nil {
+		ZapLogger.Error("DELETE file by fid and owners failed",
+			zap.Any("fileId", fileId), zap.Any("owners", owners), zap.Any("err", err))
+		return err
+	}
+	return nil
+}
+
+func (opsFile *DBOpsFile) DeleteStalePendingFileInDB(fileId string, updatedBefore int64) error {
+	// Prepare ctx for executing query.
+	var ctx context.Context
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	_, err := opsFile.GetConnWithRetry().ExecContext(ctx,
+		"DELETE FROM "+dbConfigInfo.FileTableName+
+			" WHERE fid = ? AND state = ? AND updated_at < FROM_UNIXTIME(?);",
+		fileId, definition.F_DB_STATE_PENDING, updatedBefore)
+	opsFile.ReleaseConn()
+	if err != nil {
+		ZapLogger.Error("DELETE stale pending file failed",
+			zap.Any("fileId", fileId), zap.Any("err", err))
+		return err
+	}
+	return nil
+}
+
+// ////////////////////////////
+
+// Schema of the files table is created and migrated by MigrateSchema,
+// see kFilesMigrations.
@@ -0,0 +1,153 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package db_ops
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	. "github.com/common/zaplog"
+	"github.com/go-sql-driver/mysql"
+	"go.uber.org/zap"
+)
+
+// Schema migrations of the files table, applied in order at startup. Each
+// migration is applied once and recorded in the schema version table.
+// Never edit an applied migration, append a new one instead.
+// "{files}" is replaced by the configured files_table_name.
+var kFilesMigrations = []struct {
+	Version int
+	Stmts   []string
+}{
+	{
+		Version: 1,
+		Stmts: []string{`CREATE TABLE IF NOT EXISTS {files} (
+	fid varchar(255) NOT NULL DEFAULT "",
+	file_meta json DEFAULT NULL,
+	owners varchar(64) DEFAULT "",
+	state tinyint(1) NOT NULL DEFAULT 0,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+	PRIMARY KEY (fid),
+	INDEX owners (owners)
+)`},
+	},
+	{
+		Version: 2,
+		Stmts: []string{
+			"ALTER TABLE {files} ADD COLUMN size bigint NOT NULL DEFAULT 0",
+		},
+	},
+	{
+		Version: 3,
+		Stmts: []string{`CREATE TABLE IF NOT EXISTS {files}_pins (
+	pin_key varchar(255) NOT NULL DEFAULT "",
+	prefix tinyint(1) NOT NULL DEFAULT 0,
+	expires_at bigint NOT NULL DEFAULT 0,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (pin_key, prefix)
+)`},
+	},
+}
+
+// MySQL error numbers telling a DDL statement was already applied. MySQL
+// DDL isn't transactional, a migration interrupted before its version got
+// recorded is replayed on next startup.
+const (
+	kErrDupFieldName = 1060
+	kErrDupKeyName   = 1061
+)
+
+// Latest schema version known by this binary.
+func LatestFilesSchemaVersion() int {
+	return kFilesMigrations[len(kFilesMigrations)-1].Version
+}
+
+func pinsTableName() string {
+	return dbConfigInfo.FileTableName + "_pins"
+}
+
+func schemaVersionTableName() string {
+	return dbConfigInfo.FileTableName + "_schema_version"
+}
+
+// Create the files table if it's missing and bring it to the latest schema.
+// Holders sharing a same DB serialize on a named lock, so only 1 of them
+// migrates.
+func (opsFile *DBOpsFile) MigrateSchema() error {
+	ctx, stop := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer stop()
+	// Named locks belong to a session, stick to 1 connection.
+	conn, err := opsFile.GetConnForTxn().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lockName := "riverpass_migrate_" + dbConfigInfo.FileTableName
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 60);", lockName).Scan(&locked)
+	if err != nil {
+		return err
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return errors.New("timeout acquiring schema migration lock")
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?);", lockName)
+
+	_, err = conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+schemaVersionTableName()+` (
+	version int NOT NULL,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (version)
+);`)
+	if err != nil {
+		return err
+	}
+	var current sql.NullInt64
+	err = conn.QueryRowContext(ctx,
+		"SELECT MAX(version) FROM "+schemaVersionTableName()+";").Scan(&current)
+	if err != nil {
+		return err
+	}
+	if int(current.Int64) > LatestFilesSchemaVersion() {
+		ZapLogger.Error("files table schema is newer than this binary",
+			zap.Any("table", dbConfigInfo.FileTableName),
+			zap.Any("version", current.Int64),
+			zap.Any("latest known", LatestFilesSchemaVersion()))
+		return errors.New("unknown schema version")
+	}
+	for _, m := range kFilesMigrations {
+		if int64(m.Version) <= current.Int64 {
+			continue
+		}
+		for _, stmt := range m.Stmts {
+			stmt = strings.ReplaceAll(stmt, "{files}", dbConfigInfo.FileTableName)
+			if _, err := conn.ExecContext(ctx, stmt); err != nil && !isAlreadyApplied(err) {
+				ZapLogger.Error("schema migration failed",
+					zap.Any("version", m.Version), zap.Any("stmt", stmt), zap.Any("err", err))
+				return err
+			}
+		}
+		_, err = conn.ExecContext(ctx,
+			"INSERT INTO "+schemaVersionTableName()+" (version) VALUES (?);", m.Version)
+		if err != nil {
+			return err
+		}
+		ZapLogger.Info("schema migration applied",
+			zap.Any("table", dbConfigInfo.FileTableName), zap.Any("version", m.Version))
+	}
+	return nil
+}
+
+func isAlreadyApplied(err error) bool {
+	var myErr *mysql.MySQLError
+	if !errors.As(err, &myErr) {
+		return false
+	}
+	return myErr.Number == kErrDupFieldName || myErr.Number == kErrDupKeyName
+}
@@ -0,0 +1,110 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package db_ops
+
+import (
+	"errors"
+
+	definition "github.com/common/definition"
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// MetadataStore keeps the file entries of the cache: file meta, the triplet
+// owning the file content, and the file state. MySQL is 1 backend among
+// others, the backend is chosen by db_type of oss_db_config.xml.
+type MetadataStore interface {
+	ListFileFromDB(fileId string, state int32) (*definition.FileMeta, error)
+	// Returns nil file meta and state -1 if the file doesn't exist.
+	ListFileAndStateFromDB(fileId string) (*definition.FileMeta, int, error)
+	// Inserts a pending file entry, fails if the file already exists.
+	CreateFileWithFidInDB(fileId string, fileMeta *definition.FileMeta) error
+	ListFileAndOwnersFromDB(fileId string) (*definition.FileMeta, string, error)
+	UpdateFilemetaAndOwnerInDB(fileId string, dbfm *DBFileMeta) error
+	UpdateFilemetaAndStateInDB(fileName string, fileMeta *definition.FileMeta, state int) error
+	CommitFileInDB(fid string) error
+	CommitCacheFileInDB(fid, token string, size int64, etag string, maxAge int64) error
+	DeleteFileWithTripleIdInDB(tripleId string) error
+	DeletePendingFileWithFIdInDB(fileId string) error
+	// Delete all pending files but those of keep.
+	DeleteAllPendingFileInDB(keep []string) error
+	// Distinct owners of all files, pending files are owned by "".
+	ListTripleIdOfAllFiles() ([]string, error)
+	// Up to limit files whose fid is greater than afterFid, ordered by fid.
+	ListFilesFromDB(afterFid string, limit int) ([]FileRow, error)
+	// Deletes the file only if it's still owned by owners.
+	DeleteFileWithFidAndOwnerInDB(fileId string, owners string) error
+	// Deletes the file only if it's pending and not updated since
+	// updatedBefore, in unix seconds.
+	DeleteStalePendingFileInDB(fileId string, updatedBefore int64) error
+	// Files owned by the triplet.
+	ListFilesWithTripleIdFromDB(tripleId string) ([]FileRow, error)
+	// Points the file at newToken and its triplet, only if the file still
+	// points at oldToken, otherwise ErrTokenChanged is returned.
+	UpdateFileTokenInDB(fileId string, oldToken string, newToken string) error
+	// Inserts the pin, or updates its expiry if it exists.
+	PutPinInDB(pin Pin) error
+	DeletePinInDB(key string, prefix bool) error
+	ListPinsFromDB() ([]Pin, error)
+}
+
+var ErrTokenChanged = errors.New("file token changed")
+
+// A row of the files table.
+type FileRow struct {
+	Fid    string
+	Meta   *definition.FileMeta
+	Owners string
+	State  int
+	// Unix seconds.
+	UpdatedAt int64
+}
+
+// An object pinned in cache, by url or by url prefix.
+type Pin struct {
+	Key    string `json:"key"`
+	Prefix bool   `json:"prefix"`
+	// Unix seconds, 0 never expires.
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+const (
+	K_db_type_mysql = "mysql"
+	K_db_type_bolt  = "bolt"
+)
+
+// Create and initialize the metadata store of the configured db_type.
+func NewMetadataStore() MetadataStore {
+	switch driverName {
+	case K_db_type_bolt:
+		store := new(BoltStore)
+		store.New(dbConfigInfo0.DBPath)
+		return store
+	case K_db_type_mysql:
+		store := new(DBOpsFile)
+		store.New()
+		return store
+	}
+	ZapLogger.Fatal("unsupported db_type", zap.Any("db_type", driverName))
+	return nil
+}
+
+// Open the metadata store of the configured db_type without creating or
+// migrating anything, for offline tools. Only the bolt backend enforces
+// readOnly, MySQL tools just don't write.
+func OpenMetadataStore(readOnly bool) MetadataStore {
+	switch driverName {
+	case K_db_type_bolt:
+		store := new(BoltStore)
+		store.OpenExisting(dbConfigInfo0.DBPath, readOnly)
+		return store
+	case K_db_type_mysql:
+		store := new(DBOpsFile)
+		store.connect()
+		return store
+	}
+	ZapLogger.Fatal("unsupported db_type", zap.Any("db_type", driverName))
+	return nil
+}
@@ -0,0 +1,78 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+package db_ops
+
+import (
+	"context"
+
+	. "github.com/common/zaplog"
+	"go.uber.org/zap"
+)
+
+// Pins live in the pins table next to the files table, see
+// kFilesMigrations.
+
+func (opsFile *DBOpsFile) PutPinInDB(pin Pin) error {
+	// Prepare ctx for executing query.
+	var ctx context.Context
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	_, err := opsFile.GetConnWithRetry().ExecContext(ctx,
+		"INSERT INTO "+pinsTableName()+" (pin_key, prefix, expires_at) VALUES (?, ?, ?)"+
+			" ON DUPLICATE KEY UPDATE expires_at = VALUES(expires_at);",
+		pin.Key, pin.Prefix, pin.ExpiresAt)
+	opsFile.ReleaseConn()
+	if err != nil {
+		ZapLogger.Error("PutPinInDB failed", zap.Any("pin", pin), zap.Any("err", err))
+		return err
+	}
+	return nil
+}
+
+func (opsFile *DBOpsFile) DeletePinInDB(key string, prefix bool) error {
+	// Prepare ctx for executing query.
+	var ctx context.Context
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	_, err := opsFile.GetConnWithRetry().ExecContext(ctx,
+		"DELETE FROM "+pinsTableName()+" WHERE pin_key = ? AND prefix = ?;",
+		key, prefix)
+	opsFile.ReleaseConn()
+	if err != nil {
+		ZapLogger.Error("DeletePinInDB failed", zap.Any("key", key),
+			zap.Any("prefix", prefix), zap.Any("err", err))
+		return err
+	}
+	return nil
+}
+
+func (opsFile *DBOpsFile) ListPinsFromDB() ([]Pin, error) {
+	// Prepare ctx for executing query.
+	var ctx context.Context
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	rows, err := opsFile.GetConnWithRetry().QueryContext(ctx,
+		"SELECT pin_key, prefix, expires_at FROM "+pinsTableName()+";")
+	opsFile.ReleaseConn()
+	if err != nil {
+		ZapLogger.Error("ListPinsFromDB failed", zap.Any("err", err))
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]Pin, 0)
+	for rows.Next() {
+		var pin Pin
+		if err := rows.Scan(&pin.Key, &pin.Prefix, &pin.ExpiresAt); err != nil {
+			ZapLogger.Error("rows.Scan failed", zap.Any("err", err))
+			return nil, err
+		}
+		res = append(res, pin)
+	}
+	if err := rows.Err(); err != nil {
+		ZapLogger.Error("rows.Err", zap.Any("err", err))
+		return nil, err
+	}
+	return res, nil
+}
@@ -21,11 +21,11 @@ type FileReader struct {
 	// Reference to a initialized physical blob holder
 	Pbh       *blobs.PhyBH
 	BlobSegDb *dbops.DBOpsBlobSeg
-	FileDb    *dbops.DBOpsFile
+	FileDb    dbops.MetadataStore
 }
 
 func (fr *FileReader) ReadAt(
-	fid string, offset int32, size int32) (data []byte, err error) {
+	fid string, offset int64, size int64) (data []byte, err error) {
 	// Shall be already ordered.
 	bms, err := fr.BlobSegDb.ListBlobSegsByFidFromDB(fid)
 	if err != nil {
@@ -44,11 +44,11 @@ func (fr *FileReader) ReadAt(
 			break
 		}
 		var curBlobData []byte
-		curStart := int32(math.Max(float64(bm.RngCode.Start), float64(offset)))
-		curEnd := int32(math.Min(float64(bm.RngCode.End), float64(offset+size)))
+		curStart := int64(math.Max(float64(bm.RngCode.Start), float64(offset)))
+		curEnd := int64(math.Min(float64(bm.RngCode.End), float64(offset+size)))
 		wg.Add(1)
-		go func(token string, start int32, end int32,
-			curStart int32, curEnd int32, offset int32) {
+		go func(token string, start int64, end int64,
+			curStart int64, curEnd int64, offset int64) {
 			defer wg.Done()
 			curBlobData, err = fr.readPiece(
 				token,
@@ -70,7 +70,7 @@ func (fr *FileReader) ReadAt(
 }
 
 func (fr *FileReader) ReadFromCache(
-	fid string, offset int32, size int32, rngCodeList *list.List) (data []byte, err error) {
+	fid string, offset int64, size int64, rngCodeList *list.List) (data []byte, err error) {
 	// Shall be already ordered.
 	start := rngCodeList.Front().Value.(range_code.RangeCode).Start
 	end := rngCodeList.Front().Value.(range_code.RangeCode).End
@@ -82,8 +82,8 @@ func (fr *FileReader) ReadFromCache(
 			zap.Any("offset", offset), zap.Any("size", size))
 	}
 	var curBlobData []byte
-	curStart := int32(math.Max(float64(start), float64(offset)))
-	curEnd := int32(math.Min(float64(end), float64(offset+size)))
+	curStart := int64(math.Max(float64(start), float64(offset)))
+	curEnd := int64(math.Min(float64(end), float64(offset+size)))
 	curBlobData, err = fr.readPiece(token, curStart-start, curEnd-start)
 	if err != nil {
 		ZapLogger.Error("readPiece", zap.Any("token", token), zap.Any("err", err))
@@ -94,18 +94,45 @@ func (fr *FileReader) ReadFromCache(
 	return allBytes, nil
 }
 
+// Open the cached file for streaming read. Memory usage doesn't depend on the
+// object size, caller must close the returned reader.
+func (fr *FileReader) OpenFromCache(
+	fid string, rngCodeList *list.List) (*blobs.BlobReader, error) {
+	if rngCodeList == nil || rngCodeList.Len() == 0 {
+		return nil, &blobs.StorageError{Kind: blobs.ErrNotFound, Op: "open file",
+			File: fid, Err: errors.New("empty range code list")}
+	}
+	rngCode := rngCodeList.Front().Value.(range_code.RangeCode)
+	br, err := fr.Pbh.Open(rngCode.Token)
+	if err != nil {
+		ZapLogger.Error("Pbh.Open", zap.Any("fid", fid),
+			zap.Any("token", rngCode.Token), zap.Any("err", err))
+		return nil, err
+	}
+	if br.Size() != rngCode.End-rngCode.Start {
+		ZapLogger.Error("blob size mismatch", zap.Any("fid", fid),
+			zap.Any("size on disk", br.Size()),
+			zap.Any("start", rngCode.Start), zap.Any("end", rngCode.End))
+		br.Close()
+		return nil, &blobs.StorageError{Kind: blobs.ErrCorrupt, Op: "open file",
+			File: fid, Err: errors.New("blob size mismatch")}
+	}
+	return br, nil
+}
+
 func (fr *FileReader) readPiece(
-	token string, start int32, end int32) (piece []byte, err error) {
+	token string, start int64, end int64) (piece []byte, err error) {
 	data, err := fr.Pbh.Get(token)
 	if err != nil {
 		return nil, err
 	}
 	dataLen := len(data)
-	if start >= int32(dataLen) || end > int32(dataLen) {
+	if start >= int64(dataLen) || end > int64(dataLen) {
 		ZapLogger.Error("index out of range", zap.Any("token", token),
 			zap.Any("start", start), zap.Any("end", end),
 			zap.Any("dataLen", dataLen))
-		return nil, errors.New("index out of range")
+		return nil, &blobs.StorageError{Kind: blobs.ErrCorrupt, Op: "read piece",
+			File: token, Err: errors.New("index out of range")}
 	}
 	return data[start:end], nil
 }
@@ -5,9 +5,11 @@
 package file_handler
 
 import (
+	"bytes"
 	"errors"
 	blobs "holder/src/blob_handler"
 	dbops "holder/src/db_ops"
+	"io"
 
 	. "github.com/common/zaplog"
 	"go.uber.org/zap"
@@ -19,11 +21,13 @@ type FileWriter struct {
 	// Reference to a initialized physical blob holder
 	Pbh       *blobs.PhyBH
 	BlobSegDb *dbops.DBOpsBlobSeg
-	FileDb    *dbops.DBOpsFile
+	FileDb    dbops.MetadataStore
+	// Bytes reserved by PhyBH.Reserve for the write of the stream.
+	Reserved int64
 }
 
 // Positional Write. Temporarily deprecated in this code base.
-func (fu *FileWriter) WriteAt(fid string, offset int32, size int32, data []byte) error {
+func (fu *FileWriter) WriteAt(fid string, offset int64, size int64, data []byte) error {
 	if err := fu.checkUploader(); err != nil {
 		return err
 	}
@@ -33,7 +37,7 @@ func (fu *FileWriter) WriteAt(fid string, offset int32, size int32, data []byte)
 	partialToken := util.GenerateBlobToken("", blobId)
 
 	err := fu.BlobSegDb.CreateBlobSegInDB(
-		[]int32{offset, offset + size}, fid, partialToken)
+		[]int64{offset, offset + size}, fid, partialToken)
 	if err != nil {
 		ZapLogger.Error("Create blob entry in DB failed",
 			zap.Any("blob entry", partialToken),
@@ -49,7 +53,7 @@ func (fu *FileWriter) WriteAt(fid string, offset int32, size int32, data []byte)
 	}
 
 	err = fu.BlobSegDb.CommitBlobInDB(
-		[]int32{offset, offset + size}, fid, fullToken)
+		[]int64{offset, offset + size}, fid, fullToken)
 	if err != nil {
 		ZapLogger.Error("Commit blob failed", zap.Any("token", fullToken), zap.Any("fid", fid))
 		return err
@@ -62,13 +66,18 @@ func (fu *FileWriter) WriteAt(fid string, offset int32, size int32, data []byte)
 }
 
 func (fu *FileWriter) WriteFileToCache(fid string, data []byte) (string, error) {
+	return fu.WriteStreamToCache(fid, bytes.NewReader(data), int64(len(data)))
+}
+
+// Write size bytes read from r as the single blob of the cached file.
+func (fu *FileWriter) WriteStreamToCache(fid string, r io.Reader, size int64) (string, error) {
 	if err := fu.checkUploader(); err != nil {
 		return "", err
 	}
 
 	blobId := util.ShordGuidGenerator()
 	// TODO: Implement blacklist gc.
-	fullToken, err := fu.Pbh.Put(blobId, data)
+	fullToken, err := fu.Pbh.PutStreamReserved(blobId, r, size, fu.Reserved)
 	if err != nil {
 		ZapLogger.Error("Put data failed", zap.Any("fid", fid), zap.Any("err", err))
 		return "", err
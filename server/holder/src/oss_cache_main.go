@@ -5,6 +5,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	blobs "holder/src/blob_handler"
@@ -12,38 +13,70 @@ import (
 	_ "holder/src/db_ops"
 	db_ops "holder/src/db_ops"
 	files "holder/src/file_handler"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"sync"
+	"syscall"
 	"time"
 
 	config "github.com/common/config"
 	definition "github.com/common/definition"
 	"github.com/common/range_code"
+	"github.com/common/util"
 	. "github.com/common/zaplog"
 	_ "github.com/common/zaplog"
 	"go.uber.org/zap"
 )
 
-var ShardID = db_ops.ShardID
+var ShardID int
 var Address = db_ops.Address
 
 // Physical blob Handler:
 var PhyBH *blobs.PhyBH
-var FDb *db_ops.DBOpsFile
+var FDb db_ops.MetadataStore
 var CMgr *cache.CacheManager
 var OssServer *OssHolderServer
 
 // All the handler func map for request from client
 var RequestHandlers = map[string]func(http.ResponseWriter, *http.Request){
-	"/getFile": HttpRead,
+	"/getFile":  HttpRead,
+	"/pin":      HttpPin,
+	"/prefetch": HttpPrefetch,
 }
 
 type OssHolderServer struct {
 	mgr       *cache.CacheManager
-	dbOpsFile *db_ops.DBOpsFile
-	mtx       sync.Mutex
+	dbOpsFile db_ops.MetadataStore
+	// Coalesces metadata lookups and validations of a same file.
+	flight util.SingleFlight
+}
+
+// Result of a metadata lookup, shared by concurrent readers of a file.
+type fileLookup struct {
+	fm    *definition.FileMeta
+	state int
+	// When the lookup and validation finished.
+	ts time.Time
+	// Origin info of a missed file looked up for its admission.
+	stat *cache.ObjectInfo
+}
+
+// The shard id of the holder is its 1st argument, 0 if none.
+func shardArg() int {
+	ZapLogger.Info("main input")
+	for idx, arg := range os.Args {
+		ZapLogger.Info("param", zap.Any("idx", idx), zap.Any("arg", arg))
+	}
+	if len(os.Args) < 2 {
+		return 0
+	}
+	shardId, err := strconv.Atoi(os.Args[1])
+	if err != nil {
+		ZapLogger.Fatal("read shardID from input failed", zap.Any("err", err))
+	}
+	return shardId
 }
 
 func argsfunc() {
@@ -60,6 +93,9 @@ func argsfunc() {
 }
 
 func init() {
+	db_ops.SelectShard(shardArg())
+	ShardID = db_ops.ShardID
+
 	// Config initialization...
 	dir, err := os.Getwd()
 	if err != nil {
@@ -76,14 +112,15 @@ func init() {
 	Address = cfg.ParseOssHolderConfigAddress(ShardID)
 
 	// Object initalizations...
-	FDb = new(db_ops.DBOpsFile)
-	FDb.New()
-	ZapLogger.Debug("[init] DBOpsFile initialization finished:",
-		zap.Any("PhyBH", *FDb))
+	FDb = db_ops.NewMetadataStore()
+	ZapLogger.Debug("[init] MetadataStore initialization finished:",
+		zap.Any("FDb", FDb))
 
 	// Physical blob Handler:
 	PhyBH = new(blobs.PhyBH)
-	PhyBH.New(ShardID, FDb)
+	if err := PhyBH.New(ShardID, FDb); err != nil {
+		ZapLogger.Fatal("PhyBH.New", zap.Any("err", err))
+	}
 	ZapLogger.Debug("[init] PhyBH initialization finished:",
 		zap.Any("PhyBH", *PhyBH))
 
@@ -114,115 +151,383 @@ func HttpRead(w http.ResponseWriter, r *http.Request) {
 	values := r.URL.Query()
 	url = values.Get("url")
 	ZapLogger.Info("HttpRead", zap.Any("url", url))
-	resp, err := http.Get(url)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		ZapLogger.Error("url is not available", zap.Any("url", url))
-		w.WriteHeader(404)
+	br, etag, d, err := OssServer.TryReadFromCache(url)
+	if errors.Is(err, cache.ErrNotAdmitted) {
+		proxyFromOrigin(w, r, url)
 		return
 	}
-	// only support get Etag from oss object response's header
-	etag := resp.Header.Get("Etag")
-	//offset := 0,size := 0 means read all data from 0 to len(data).
-	data, err := OssServer.TryReadFromCache(url, 0, 0, etag)
 	if err != nil {
 		ZapLogger.Error("TryReadFromCache", zap.Any("err", err))
 		w.WriteHeader(404)
 		return
 	}
-	if data == nil {
-		ZapLogger.Info("file not found on disk, get from oss")
+	h := w.Header()
+	h.Set("Content-type", "application/octet-stream")
+	h.Set("Content-Disposition", "attachment;filename="+url)
+	if br != nil {
+		defer br.Close()
+		if etag != "" {
+			h.Set("Etag", etag)
+		}
+		// ServeContent handles Range, If-Range and multipart/byteranges, only
+		// the requested bytes are read from the blob.
+		http.ServeContent(w, r, "", time.Time{}, io.NewSectionReader(br, 0, br.Size()))
+		if br.Corrupted() {
+			// The response is cut short. With 4K alignment no bad chunk was
+			// sent, without it the whole blob checksum is only known at the
+			// end, when the bytes before were sent already.
+			OssServer.refetchCorrupted(url, br.Token())
+			return
+		}
+		ZapLogger.Info("READ SUCCESSFULLY", zap.Any("url", url), zap.Any("size", br.Size()))
+		return
+	}
+	if r.Header.Get("Range") != "" {
+		// The whole object keeps downloading into cache in background, the
+		// requested ranges are forwarded to origin.
+		d.Release()
+		proxyFromOrigin(w, r, url)
+		return
+	}
+	rc := d.NewReader()
+	defer rc.Close()
+	if d.Validators.Etag != "" {
+		h.Set("Etag", d.Validators.Etag)
+	}
+	if d.Size >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(d.Size, 10))
+	}
+	w.WriteHeader(200)
+	// Stream from the in-flight download, memory usage doesn't grow with
+	// object size.
+	written, err := io.Copy(w, rc)
+	if err != nil {
+		ZapLogger.Error("stream file failed", zap.Any("url", url),
+			zap.Any("written", written), zap.Any("err", err))
+		return
+	}
+	ZapLogger.Info("READ SUCCESSFULLY", zap.Any("url", url), zap.Any("size", written))
+}
+
+// Admin endpoint of pins, answers the pins and pinned bytes:
+//   - GET /pin lists them.
+//   - POST /pin?url=<url> pins the object of url and fetches it if it isn't
+//     cached, prefix=<prefix> instead of url pins all objects whose cache
+//     key starts with it, the prefix is normalized as cache keys are.
+//     ttl_sec=<sec> makes it expire.
+//   - DELETE /pin?url=<url> or ?prefix=<prefix> unpins.
+func HttpPin(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	key, prefix := values.Get("url"), false
+	if key == "" {
+		key, prefix = cache.CacheKeyPrefix(values.Get("prefix")), true
+	} else {
+		key = cache.CacheKey(key)
+	}
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var ttlSec int64
+		if ttl := values.Get("ttl_sec"); ttl != "" {
+			ttlSec, err = strconv.ParseInt(ttl, 10, 64)
+			if err != nil || ttlSec < 0 {
+				http.Error(w, "invalid ttl_sec", http.StatusBadRequest)
+				return
+			}
+		}
+		if key == "" {
+			http.Error(w, "url or prefix required", http.StatusBadRequest)
+			return
+		}
+		if prefix {
+			err = CMgr.Pin(key, prefix, ttlSec)
+		} else {
+			_, err = CMgr.PinUrl(values.Get("url"), ttlSec)
+		}
+	case http.MethodDelete:
+		if key == "" {
+			http.Error(w, "url or prefix required", http.StatusBadRequest)
+			return
+		}
+		err = CMgr.Unpin(key, prefix)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		ZapLogger.Error("HttpPin", zap.Any("method", r.Method), zap.Any("key", key),
+			zap.Any("prefix", prefix), zap.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(CMgr.GetPinStats())
+}
+
+// Prefetch endpoint, answers jobs as JSON:
+//   - POST /prefetch queues a job fetching the urls of the body, 1 per
+//     line, or those of the manifest at ?manifest=<url>.
+//   - GET /prefetch?job=<id> polls the job, GET /prefetch lists all jobs.
+func HttpPrefetch(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	var res interface{}
+	switch r.Method {
+	case http.MethodGet:
+		if id := values.Get("job"); id != "" {
+			job, exist := CMgr.GetPrefetchJob(id)
+			if !exist {
+				http.Error(w, "unknown job", http.StatusNotFound)
+				return
+			}
+			res = job
+		} else {
+			res = CMgr.ListPrefetchJobs()
+		}
+	case http.MethodPost:
+		var urls []string
+		var err error
+		if manifest := values.Get("manifest"); manifest != "" {
+			urls, err = cache.LoadPrefetchManifest(manifest)
+		} else {
+			urls, err = cache.ReadPrefetchList(r.Body)
+		}
+		if err != nil {
+			ZapLogger.Error("read prefetch urls failed", zap.Any("err", err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		job, err := CMgr.Prefetch(urls)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res = job
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// Forward a read, ranged or not, to origin and relay its answer.
+func proxyFromOrigin(w http.ResponseWriter, r *http.Request, url string) {
+	origin, err := cache.OriginOf(url)
+	if err != nil {
+		ZapLogger.Error("read from origin failed", zap.Any("url", url), zap.Any("err", err))
 		w.WriteHeader(404)
+		return
+	}
+	rng := r.Header.Get("Range")
+	resp, err := origin.Get(url, rng, "")
+	if err == nil && resp.Partial {
+		// The range is of another version than the client has, answer the
+		// whole object.
+		if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != resp.Validators.Etag {
+			resp.Body.Close()
+			resp, err = origin.Get(url, "", "")
+		}
+	}
+	if err != nil {
+		ZapLogger.Error("read from origin failed", zap.Any("url", url), zap.Any("err", err))
+		switch {
+		case errors.Is(err, cache.ErrOriginNotFound):
+			w.WriteHeader(404)
+		case errors.Is(err, cache.ErrOriginRangeNotSatisfiable):
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		default:
+			w.WriteHeader(502)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	h := w.Header()
+	if resp.ContentType != "" {
+		h.Set("Content-Type", resp.ContentType)
+	}
+	if resp.Validators.Etag != "" {
+		h.Set("Etag", resp.Validators.Etag)
+	}
+	if resp.Size >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(resp.Size, 10))
+	}
+	if resp.Partial {
+		h.Set("Content-Range", resp.ContentRange)
+		w.WriteHeader(http.StatusPartialContent)
 	} else {
-		ZapLogger.Info("READ SUCCESSFULLY", zap.Any("url", url))
-		h := w.Header()
-		h.Set("Content-type", "application/octet-stream")
-		h.Set("Content-Disposition", "attachment;filename="+url)
-		h.Set("Content-Length", strconv.Itoa(len(data)))
-		w.WriteHeader(200)
-		w.Write(data)
+		w.WriteHeader(http.StatusOK)
+	}
+	if written, err := io.Copy(w, resp.Body); err != nil {
+		ZapLogger.Error("relay read from origin failed", zap.Any("url", url),
+			zap.Any("written", written), zap.Any("err", err))
 	}
 }
 
-func (oSvr *OssHolderServer) New(cm *cache.CacheManager, fdb *db_ops.DBOpsFile) {
+func (oSvr *OssHolderServer) New(cm *cache.CacheManager, fdb db_ops.MetadataStore) {
 	oSvr.mgr = cm
 	oSvr.dbOpsFile = fdb
 }
 
+// Returns the blob reader of the object of url and its etag on a cache
+// hit, the object is looked up by the cache key of url. On a cache miss,
+// the origin download of url is returned instead, so the caller can read
+// through it while it's being written into the cache.
+// ErrNotAdmitted is returned for a miss not to be cached.
+// Caller must close the blob reader or release the download.
+// A hit validated within its ttl is served without asking OSS, otherwise
+// the etag is validated with a conditional request.
 func (s *OssHolderServer) TryReadFromCache(
-	fileName string, offset int32, size int32, etag string) ([]byte, error) {
-	listTs := time.Now()
-	var fm *definition.FileMeta
-	// TODO: optimize this db lock
-	s.mtx.Lock()
-	fm, state, err := s.ListFileAndState(fileName)
-	if err != nil {
-		ZapLogger.Error("ListFileAndState", zap.Any("err", err))
-		return nil, err
+	url string) (*blobs.BlobReader, string, *cache.Download, error) {
+	fid := cache.CacheKey(url)
+	// Concurrent requests of a same file share 1 DB lookup, 1 insert on a
+	// miss and 1 validation against OSS. Origin downloads are coalesced by
+	// the cache manager.
+	val, err, shared := s.flight.Do(fid, func() (interface{}, error) {
+		return s.lookupAndValidate(fid, url)
+	})
+	if errors.Is(err, cache.ErrNotAdmitted) {
+		return nil, "", nil, err
+	} else if err != nil {
+		ZapLogger.Error("lookupAndValidate", zap.Any("file", fid), zap.Any("err", err))
+		return nil, "", nil, err
 	}
-	if state == -1 {
-		// Didn't find the file in cache.
-		fid, err := s.CreateFileForCache(fileName, etag)
-		if err != nil {
-			ZapLogger.Error("CreateFileForCache", zap.Any("err", err))
-			return nil, err
-		}
-		s.mgr.EnqueueWriteReq(fid, fileName)
-		s.mtx.Unlock()
-		return nil, nil
+	if shared {
+		ZapLogger.Debug("shared file lookup", zap.Any("file", fid))
 	}
-	s.mtx.Unlock()
+	lookup := val.(*fileLookup)
+	fm, state, listTs := lookup.fm, lookup.state, lookup.ts
 	if state == definition.F_BLOB_STATE_PENDING {
 		// cache is downloading
 		ZapLogger.Info("Didn't find the file in cache(cache is downloading)",
-			zap.Any("file", fileName))
-		return nil, nil
+			zap.Any("file", fid))
+		return s.attachDownload(fid, url, lookup.stat)
 	} else if state == definition.F_BLOB_STATE_READY {
-		if fm == nil {
-			ZapLogger.Error("file meta is nil in db", zap.Any("file", fileName))
-			return nil, errors.New("file meta is nil in db")
-		}
-		if etag != fm.Etag {
-			fm.Etag = etag
-			s.dbOpsFile.UpdateFilemetaAndStateInDB(fileName,
-				fm, definition.F_BLOB_STATE_PENDING)
-			ZapLogger.Info("Cache is outdate, redownload", zap.Any("file", fileName))
-			s.mgr.EnqueueWriteReq(fileName, fileName)
-			return nil, nil
-		}
 		// Read the file from cache.
-		fid := fileName
 		if fm.RngCodeList == nil {
 			ZapLogger.Info("fm.RngCodeList is nil")
-			return nil, nil
+			return nil, "", nil, errors.New("file has no range code")
 		}
 		fr := files.FileReader{
 			Pbh:    PhyBH,
 			FileDb: s.dbOpsFile,
 		}
-		var readBytes []byte
-		offset = fm.RngCodeList.Front().Value.(range_code.RangeCode).Start
-		size = fm.RngCodeList.Front().Value.(range_code.RangeCode).End
-		ZapLogger.Info("read from", zap.Any("start", offset), zap.Any("size", size))
+		ZapLogger.Info("read from",
+			zap.Any("start", fm.RngCodeList.Front().Value.(range_code.RangeCode).Start),
+			zap.Any("size", fm.RngCodeList.Front().Value.(range_code.RangeCode).End))
 		if time.Now().Sub(listTs).Milliseconds() > definition.F_cache_purge_waiting_ms {
 			ZapLogger.Error("[TryReadFromCache] faild:",
-				zap.Any("fail to avoid stale cache data: ", fileName))
-			return nil, errors.New("data not in cache")
+				zap.Any("fail to avoid stale cache data: ", fid))
+			return nil, "", nil, errors.New("data not in cache")
 		}
-		if readBytes, err = fr.ReadFromCache(fid, offset, size, fm.RngCodeList); err != nil {
+		rngCode := fm.RngCodeList.Front().Value.(range_code.RangeCode)
+		br, err := fr.OpenFromCache(fid, fm.RngCodeList)
+		if errors.Is(err, blobs.ErrNotFound) || errors.Is(err, blobs.ErrCorrupt) {
+			// The blob is gone or its triplet got quarantined, serve the
+			// file from origin while it's cached again.
+			ZapLogger.Warn("[TryReadFromCache] cached copy lost, refetching",
+				zap.Any("file", fid), zap.Any("err", err))
+			if err := s.mgr.InvalidateCorruptedFile(fid, rngCode.Token); err != nil {
+				return nil, "", nil, err
+			}
+			s.CreateFileForCache(fid, url, "")
+			return s.attachDownload(fid, url, nil)
+		} else if err != nil {
 			ZapLogger.Error("[TryReadFromCache] faild:",
 				zap.Any("err", err))
-			return nil, err
+			return nil, "", nil, err
 		}
-		return readBytes, nil
+		s.mgr.TouchObject(fid, rngCode.Token, rngCode.End-rngCode.Start)
+		return br, fm.Etag, nil, nil
 	}
 	ZapLogger.Error("logical error, state is invalid",
-		zap.Any("file", fileName),
+		zap.Any("file", fid),
 		zap.Any("state", state))
-	return nil, errors.New("logical error, state is invalid.")
+	return nil, "", nil, errors.New("logical error, state is invalid.")
+}
+
+// Look up the file fid in DB, create it as pending if it doesn't exist. If
+// the cached copy is ready but no longer fresh, validate it against the
+// origin of url and turn it pending if it's outdated.
+func (s *OssHolderServer) lookupAndValidate(fid string, url string) (*fileLookup, error) {
+	fm, state, err := s.ListFileAndState(fid)
+	if err != nil {
+		return nil, err
+	}
+	if state == -1 {
+		// Didn't find the file in cache. Objects not admitted are served
+		// from origin without being cached.
+		admitted, stat := s.mgr.Admit(fid, url)
+		if !admitted {
+			return nil, cache.ErrNotAdmitted
+		}
+		// Etag is filled when the download is committed.
+		if _, err := s.CreateFileForCache(fid, url, ""); err != nil {
+			ZapLogger.Error("CreateFileForCache", zap.Any("err", err))
+			return nil, err
+		}
+		return &fileLookup{state: definition.F_BLOB_STATE_PENDING, ts: time.Now(), stat: stat}, nil
+	}
+	if fm == nil {
+		ZapLogger.Error("file meta is nil in db", zap.Any("file", fid))
+		return nil, errors.New("file meta is nil in db")
+	}
+	if state != definition.F_BLOB_STATE_READY || cache.IsFresh(fm, url, time.Now()) {
+		return &fileLookup{fm: fm, state: state, ts: time.Now()}, nil
+	}
+	valid, v, err := cache.Revalidate(url, fm.Etag)
+	if errors.Is(err, cache.ErrOriginNotFound) {
+		// Deleted at origin, the refetch fails and drops the cached copy.
+		valid, err = false, nil
+	}
+	if err != nil {
+		// OSS unreachable, better serve the cached copy than nothing.
+		ZapLogger.Warn("Revalidate failed, serving cached copy",
+			zap.Any("file", fid), zap.Any("err", err))
+	} else if !valid {
+		ZapLogger.Info("Cache is outdate, redownload", zap.Any("file", fid))
+		fm.Name = url
+		if err := s.dbOpsFile.UpdateFilemetaAndStateInDB(fid,
+			fm, definition.F_BLOB_STATE_PENDING); err != nil {
+			return nil, err
+		}
+		state = definition.F_BLOB_STATE_PENDING
+	} else {
+		fm.ValidatedAt = time.Now().Unix()
+		fm.MaxAge = v.MaxAge
+		s.dbOpsFile.UpdateFilemetaAndStateInDB(fid,
+			fm, definition.F_BLOB_STATE_READY)
+	}
+	return &fileLookup{fm: fm, state: state, ts: time.Now()}, nil
+}
+
+// Attach to the origin download of the pending file, starting it from url
+// if no one did yet. Returns once origin answered.
+func (s *OssHolderServer) attachDownload(fid string, url string,
+	stat *cache.ObjectInfo) (*blobs.BlobReader, string, *cache.Download, error) {
+	d, err := s.mgr.AttachDownload(fid, url, stat)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if err = d.WaitReady(); err != nil {
+		d.Release()
+		return nil, "", nil, err
+	}
+	return nil, "", d, nil
+}
+
+// Drop the corrupted cached copy of the object of url and download it
+// again.
+func (s *OssHolderServer) refetchCorrupted(url string, token string) {
+	fid := cache.CacheKey(url)
+	if err := s.mgr.InvalidateCorruptedFile(fid, token); err != nil {
+		return
+	}
+	if _, err := s.CreateFileForCache(fid, url, ""); err != nil {
+		// Someone else already started the refetch.
+		return
+	}
+	s.mgr.EnqueueWriteReq(fid, url)
 }
 
 func (s *OssHolderServer) ListFile(fileName string, state int32) (*definition.FileMeta, error) {
@@ -243,27 +548,42 @@ func (s *OssHolderServer) ListFileAndState(fileName string) (*definition.FileMet
 	return fm, state, nil
 }
 
-func (s *OssHolderServer) CreateFileForCache(fileName string, etag string) (string, error) {
+// The file fid is named by the url it's fetched from.
+func (s *OssHolderServer) CreateFileForCache(fid string, url string, etag string) (string, error) {
 	fm := definition.FileMeta{
-		Name:   fileName,
+		Name:   url,
 		Id:     "",
 		BlobId: "",
 		Etag:   etag,
+		MaxAge: -1,
 	}
-	err := s.dbOpsFile.CreateFileWithFidInDB(fileName, &fm)
+	err := s.dbOpsFile.CreateFileWithFidInDB(fid, &fm)
 	if err != nil {
 		ZapLogger.Error("CreateFileWithFid to DB failed", zap.Any("err", err))
 		return "", err
 	}
-	return fileName, nil
+	return fid, nil
 }
 
 // file_handler end
 //////////////////////////////
 
+// Save what a restart needs but isn't persisted as it changes, then exit.
+func handleShutdown() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	ZapLogger.Info("Shutting down", zap.Any("signal", s.String()))
+	if err := CMgr.SaveEvictionState(); err != nil {
+		ZapLogger.Error("SaveEvictionState", zap.Any("err", err))
+	}
+	os.Exit(0)
+}
+
 func main() {
 	flag.Parse()
 	RegisterHttpHandler()
+	go handleShutdown()
 	err := http.ListenAndServe(Address, nil)
 	if err != nil {
 		ZapLogger.Error("Listen to http requests failed", zap.Any("err", err))
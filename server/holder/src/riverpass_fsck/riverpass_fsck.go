@@ -0,0 +1,357 @@
+// ///////////////////////////////////////////////
+// 2023 Shanghai AI Laboratory all rights reserved
+// ///////////////////////////////////////////////
+
+// riverpass-fsck inspects and repairs the blob directory of a holder shard
+// while the holder is stopped. Run it from the holder directory, like the
+// holder itself, so the configs are found:
+//
+//	riverpass-fsck -shard <shard_id> list
+//	riverpass-fsck -shard <shard_id> check
+//	riverpass-fsck -shard <shard_id> repair [triplet_id|token ...]
+//	riverpass-fsck -shard <shard_id> quarantine <triplet_id|token>
+//	riverpass-fsck -shard <shard_id> export <token> <file>
+//
+// Only repair and quarantine write to the blob directory, and only
+// quarantine writes to the metadata store: it deletes the files pointing at
+// what it quarantines. Given a token, only the blob is quarantined; given a
+// triplet id, the whole triplet is, with every file of it.
+//
+// Exits with 1 if problems are found, 2 on usage or I/O error.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	blobs "holder/src/blob_handler"
+	db_ops "holder/src/db_ops"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	config "github.com/common/config"
+	definition "github.com/common/definition"
+	"github.com/common/range_code"
+	"github.com/common/util"
+)
+
+const usage = `usage: riverpass-fsck -shard <shard_id> <command> [args]
+
+commands:
+  list                           list triplets with their state, blobs, bytes and checksum status
+  check                          list, then cross-check triplets against the metadata store
+  repair [triplet_id|token ...]  truncate torn tails and drop dangling index entries
+  quarantine <triplet_id|token>  move the blob of token, or all of the triplet, to the quarantine
+                                 directory and delete the files pointing at it
+  export <token> <file>          verify the blob of token and write its content to file
+`
+
+var shardId = flag.Int("shard", -1, "id of the holder shard")
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if *shardId < 0 || flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	db_ops.SelectShard(*shardId)
+	dir, err := os.Getwd()
+	if err != nil {
+		fail(err)
+	}
+	var cfg config.OssConfig
+	cfg.LoadXMLConfig(dir + "/../oss_server_config.xml")
+
+	args := flag.Args()[1:]
+	var problems int
+	switch flag.Arg(0) {
+	case "list":
+		problems = list(false)
+	case "check":
+		problems = list(true)
+	case "repair":
+		problems = repair(args)
+	case "quarantine":
+		if len(args) != 1 {
+			fail(errors.New("quarantine takes 1 triplet id or token"))
+		}
+		if err := quarantine(args[0]); err != nil {
+			fail(err)
+		}
+	case "export":
+		if len(args) != 2 {
+			fail(errors.New("export takes a token and a file"))
+		}
+		if err := export(args[0], args[1]); err != nil {
+			fail(err)
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if problems > 0 {
+		fmt.Printf("%d problem(s) found\n", problems)
+		os.Exit(1)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "riverpass-fsck:", err)
+	os.Exit(2)
+}
+
+func loadTriplets(readOnly bool) ([]*blobs.Triplet, map[string]error) {
+	tplts, failed, err := blobs.LoadTripletsOnDisk(*shardId, readOnly)
+	if err != nil {
+		fail(err)
+	}
+	sort.Slice(tplts, func(i, j int) bool { return tplts[i].Id < tplts[j].Id })
+	return tplts, failed
+}
+
+// Print 1 line per triplet, returns the number of problems found. With
+// crossCheck, the files of the metadata store are checked against the
+// triplets too.
+func list(crossCheck bool) int {
+	tplts, failed := loadTriplets(true)
+	problems := len(failed)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TRIPLET\tSTATE\tBLOBS\tLIVE\tDEAD\tVERIFIED\tUNVERIFIED\tCORRUPTED\tTORN\tDANGLING")
+	for _, tplt := range tplts {
+		live, total := tplt.LiveBytes()
+		sums := tplt.VerifyChecksums()
+		recovery, err := tplt.Reconcile(false)
+		if err != nil {
+			failed[tplt.Id] = err
+			continue
+		}
+		problems += len(sums.Corrupted) + len(recovery.DroppedBlobs)
+		if recovery.TornBytes > 0 {
+			problems++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n",
+			tplt.Id, tplt.State(), tplt.NumBlobs(), live, total-live,
+			sums.Verified, sums.Unverified, len(sums.Corrupted),
+			recovery.TornBytes, len(recovery.DroppedBlobs))
+	}
+	w.Flush()
+	for _, tplt := range tplts {
+		for _, found := range tplt.Unrepaired() {
+			fmt.Printf("triplet %s: %s\n", tplt.Id, found)
+			problems++
+		}
+	}
+	for id, err := range failed {
+		fmt.Printf("triplet %s failed to load: %v\n", id, err)
+	}
+	if crossCheck {
+		problems += checkMetadata(tplts)
+	}
+	return problems
+}
+
+// Report files pointing at missing triplets or blobs, and triplets no file
+// points at. Triplets that failed to load count as missing.
+func checkMetadata(tplts []*blobs.Triplet) int {
+	store := db_ops.OpenMetadataStore(true)
+	byId := make(map[string]*blobs.Triplet)
+	for _, tplt := range tplts {
+		byId[tplt.Id] = tplt
+	}
+	owned := make(map[string]bool)
+	problems := 0
+	after := ""
+	for {
+		rows, err := store.ListFilesFromDB(after, 1000)
+		if err != nil {
+			fail(err)
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			after = row.Fid
+			owned[row.Owners] = true
+			if row.State != definition.F_DB_STATE_READY {
+				fmt.Printf("file %s: pending\n", row.Fid)
+				continue
+			}
+			if row.Meta == nil || row.Meta.RngCodeList == nil {
+				fmt.Printf("file %s: no range code\n", row.Fid)
+				problems++
+				continue
+			}
+			for e := row.Meta.RngCodeList.Front(); e != nil; e = e.Next() {
+				token := e.Value.(range_code.RangeCode).Token
+				tpltId, blbId, ok := splitToken(token)
+				tplt := byId[tpltId]
+				if !ok || tplt == nil {
+					fmt.Printf("file %s: triplet of %s missing\n", row.Fid, token)
+					problems++
+				} else if tplt.IdxHeader.Get(blbId) == nil {
+					fmt.Printf("file %s: blob of %s missing\n", row.Fid, token)
+					problems++
+				}
+			}
+		}
+	}
+	for _, tplt := range tplts {
+		if !owned[tplt.Id] {
+			fmt.Printf("triplet %s: orphan, no file points at it\n", tplt.Id)
+			problems++
+		}
+	}
+	return problems
+}
+
+// Reconcile the given triplets, or the ones of the given tokens, all of
+// them if none given.
+func repair(tpltIds []string) int {
+	tplts, failed := loadTriplets(true)
+	want := make(map[string]bool)
+	for _, id := range tpltIds {
+		want[tripletOf(id)] = true
+	}
+	problems := 0
+	for _, inspected := range tplts {
+		if len(want) > 0 && !want[inspected.Id] {
+			continue
+		}
+		// Loading writable migrates legacy files, truncates torn records
+		// and creates a missing manifest.
+		tplt, err := blobs.LoadTripletOnDisk(*shardId, inspected.Id, false)
+		if err != nil {
+			fmt.Printf("triplet %s: repair failed: %v\n", inspected.Id, err)
+			problems++
+			continue
+		}
+		if found := inspected.Unrepaired(); len(found) > 0 {
+			fmt.Printf("triplet %s: repaired %s\n", tplt.Id, strings.Join(found, ", "))
+		}
+		report, err := tplt.Reconcile(true)
+		if err != nil {
+			fmt.Printf("triplet %s: repair failed: %v\n", tplt.Id, err)
+			problems++
+			continue
+		}
+		if report.Clean() {
+			continue
+		}
+		fmt.Printf("triplet %s: truncated %d torn bytes, dropped %d blobs %v\n",
+			tplt.Id, report.TornBytes, len(report.DroppedBlobs), report.DroppedBlobs)
+	}
+	for id, err := range failed {
+		if len(want) == 0 || want[id] {
+			fmt.Printf("triplet %s failed to load, quarantine it: %v\n", id, err)
+			problems++
+		}
+	}
+	return problems
+}
+
+// Quarantine the blob of a token or a whole triplet, and delete the files
+// pointing at it from the metadata store.
+func quarantine(arg string) error {
+	tpltId, blbId, isToken := splitToken(arg)
+	if !isToken {
+		tpltId = arg
+		if ok, err := blobs.TripletOnDisk(*shardId, tpltId); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("triplet %s not on disk", tpltId)
+		}
+	}
+	store := db_ops.OpenMetadataStore(false)
+	rows, err := store.ListFilesWithTripleIdFromDB(tpltId)
+	if err != nil {
+		return err
+	}
+	if !isToken {
+		size := blobs.QuarantineTripletFiles(*shardId, tpltId)
+		if err := store.DeleteFileWithTripleIdInDB(tpltId); err != nil {
+			return err
+		}
+		fmt.Printf("quarantined triplet %s, %d bytes, %d files deleted\n", tpltId, size, len(rows))
+		return nil
+	}
+	size, err := blobs.QuarantineBlob(*shardId, tpltId, blbId)
+	if err != nil {
+		return err
+	}
+	deleted := 0
+	for _, row := range rows {
+		if !pointsAt(row, tpltId, blbId) {
+			continue
+		}
+		if err := store.DeleteFileWithFidAndOwnerInDB(row.Fid, row.Owners); err != nil {
+			return err
+		}
+		deleted++
+	}
+	fmt.Printf("quarantined blob %s, %d bytes, %d files deleted\n", arg, size, deleted)
+	return nil
+}
+
+// Whether a range code of the file of row is in the blob of the triplet.
+func pointsAt(row db_ops.FileRow, tpltId string, blbId string) bool {
+	if row.Meta == nil || row.Meta.RngCodeList == nil {
+		return false
+	}
+	for e := row.Meta.RngCodeList.Front(); e != nil; e = e.Next() {
+		t, b, ok := splitToken(e.Value.(range_code.RangeCode).Token)
+		if ok && t == tpltId && b == blbId {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy the verified content of the blob of token into path.
+func export(token string, path string) error {
+	tpltId, blbId, ok := splitToken(token)
+	if !ok {
+		return fmt.Errorf("malformed token %q", token)
+	}
+	tplt, err := blobs.LoadTripletOnDisk(*shardId, tpltId, true)
+	if err != nil {
+		return err
+	}
+	br, err := tplt.OpenBlob(blbId)
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Read from offset 0 through, so the whole blob checksum is verified.
+	n, err := io.Copy(f, io.NewSectionReader(br, 0, br.Size()))
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	fmt.Printf("exported %d bytes to %s\n", n, path)
+	return nil
+}
+
+// Triplet id of arg, which is either a token or a triplet id.
+func tripletOf(arg string) string {
+	if tpltId, _, ok := splitToken(arg); ok {
+		return tpltId
+	}
+	return arg
+}
+
+func splitToken(token string) (string, string, bool) {
+	token = strings.TrimPrefix(token, definition.K_LARGE_OBJECT_PREFIX)
+	if !strings.HasPrefix(token, "tr_") || !strings.Contains(token, "_bb_") {
+		return "", "", false
+	}
+	return util.GetTripletIdFromToken(token), util.GetBlobIdFromToken(token), true
+}